@@ -0,0 +1,114 @@
+package tilenol
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig is the YAML configuration for authenticating incoming requests
+type AuthConfig struct {
+	// BearerTokens is a list of static tokens accepted via "Authorization: Bearer <token>"
+	BearerTokens []string `yaml:"bearerTokens"`
+	// BasicAuth is a mapping of usernames to passwords accepted via HTTP basic auth
+	BasicAuth map[string]string `yaml:"basicAuth"`
+}
+
+// Authenticator is a generic interface for verifying the credentials of incoming requests
+type Authenticator interface {
+	// Authenticate determines whether or not the request carries valid credentials
+	Authenticate(r *http.Request) bool
+	// Challenge is the WWW-Authenticate header value sent when authentication fails
+	Challenge() string
+}
+
+// CreateAuthenticators creates the list of Authenticators configured by an AuthConfig
+func CreateAuthenticators(config *AuthConfig) []Authenticator {
+	var authenticators []Authenticator
+	if config == nil {
+		return authenticators
+	}
+	if len(config.BearerTokens) > 0 {
+		authenticators = append(authenticators, &BearerTokenAuthenticator{Tokens: config.BearerTokens})
+	}
+	if len(config.BasicAuth) > 0 {
+		authenticators = append(authenticators, &BasicAuthenticator{Users: config.BasicAuth})
+	}
+	return authenticators
+}
+
+// BearerTokenAuthenticator is an Authenticator that accepts a static set of bearer tokens
+type BearerTokenAuthenticator struct {
+	// Tokens is the list of accepted bearer tokens
+	Tokens []string
+}
+
+// Authenticate checks the request's bearer token against the accepted tokens
+func (b *BearerTokenAuthenticator) Authenticate(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	token := auth[len(prefix):]
+	for _, t := range b.Tokens {
+		if secureEquals(token, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge implements the Authenticator interface for bearer tokens
+func (b *BearerTokenAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// BasicAuthenticator is an Authenticator that accepts HTTP basic auth credentials
+type BasicAuthenticator struct {
+	// Users is a mapping of the accepted usernames to their passwords
+	Users map[string]string
+}
+
+// Authenticate checks the request's basic auth credentials against the accepted users
+func (b *BasicAuthenticator) Authenticate(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, exists := b.Users[username]
+	return exists && secureEquals(password, expected)
+}
+
+// Challenge implements the Authenticator interface for basic auth
+func (b *BasicAuthenticator) Challenge() string {
+	return `Basic realm="tilenol"`
+}
+
+// secureEquals compares two secrets in constant time
+func secureEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// RequireAuth creates a middleware that rejects requests with HTTP 401 unless they are accepted
+// by at least one of the given Authenticators. Without any Authenticators, all requests are
+// allowed through.
+func RequireAuth(authenticators []Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range authenticators {
+				if a.Authenticate(r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			for _, a := range authenticators {
+				w.Header().Add("WWW-Authenticate", a.Challenge())
+			}
+			writeError(w, r, UnauthorizedError{http.StatusText(http.StatusUnauthorized)})
+		})
+	}
+}
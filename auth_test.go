@@ -0,0 +1,81 @@
+package tilenol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAuthenticators(t *testing.T) {
+	assert.Len(t, CreateAuthenticators(nil), 0)
+	authenticators := CreateAuthenticators(&AuthConfig{
+		BearerTokens: []string{"token"},
+		BasicAuth:    map[string]string{"user": "pass"},
+	})
+	assert.Len(t, authenticators, 2)
+}
+
+func TestRequireAuth(t *testing.T) {
+	authenticators := CreateAuthenticators(&AuthConfig{
+		BearerTokens: []string{"token"},
+		BasicAuth:    map[string]string{"user": "pass"},
+	})
+	handler := RequireAuth(authenticators)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	doRequest := func(setup func(r *http.Request)) *http.Response {
+		r := httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil)
+		setup(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	res := doRequest(func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "Missing credentials should be rejected")
+	assert.Len(t, res.Header["Www-Authenticate"], 2)
+
+	res = doRequest(func(r *http.Request) { r.Header.Set("Accept", "application/json") })
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	var body ErrorResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, UnauthorizedErrorCode, body.Code)
+
+	res = doRequest(func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") })
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "Invalid bearer token should be rejected")
+
+	res = doRequest(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") })
+	assert.Equal(t, http.StatusOK, res.StatusCode, "Valid bearer token should be accepted")
+
+	res = doRequest(func(r *http.Request) { r.SetBasicAuth("user", "nope") })
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "Invalid basic auth should be rejected")
+
+	res = doRequest(func(r *http.Request) { r.SetBasicAuth("user", "pass") })
+	assert.Equal(t, http.StatusOK, res.StatusCode, "Valid basic auth should be accepted")
+}
+
+func TestAPIAuth(t *testing.T) {
+	server := &Server{
+		Cache:        &NilCache{},
+		Auth:         CreateAuthenticators(&AuthConfig{BearerTokens: []string{"token"}}),
+		InternalAuth: CreateAuthenticators(&AuthConfig{BearerTokens: []string{"internal"}}),
+	}
+	api, internal := server.setupRoutes()
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	r := httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	internal.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode, "Internal endpoints should be gated separately")
+}
@@ -13,6 +13,18 @@ var (
 type CacheConfig struct {
 	// Redis is an optional YAML key for configuring a RedisCache
 	Redis *RedisConfig `yaml:"redis"`
+	// ServeStaleOnError configures the tile server to respond with the last cached tile (even
+	// if it has expired) when computing a tile fails, e.g. during a source outage
+	ServeStaleOnError bool `yaml:"serveStaleOnError"`
+}
+
+// Validate checks that serving stale tiles is possible with the configured cache, which is the
+// case for the in-memory cache and for Redis caches that retain stale copies (see StaleTTL)
+func (c *CacheConfig) Validate() error {
+	if c.ServeStaleOnError && c.Redis != nil && c.Redis.StaleTTL <= 0 {
+		return errors.New("Redis caches must have a \"staleTTL\" configured to serveStaleOnError")
+	}
+	return nil
 }
 
 // Cache is a generic interface for a tile server cache
@@ -25,6 +37,20 @@ type Cache interface {
 	Put(key string, val []byte) error
 }
 
+// StaleCache is an optional interface for caches that retain values past their expiration,
+// which allows serving stale tiles when computing a tile fails
+type StaleCache interface {
+	// GetStale retrieves the last stored value for a key, even if it has expired
+	GetStale(key string) ([]byte, error)
+}
+
+// NegativeCache is an optional interface for caches that store empty tiles (without any
+// features) with their own expiry, which is usually longer than that of data tiles
+type NegativeCache interface {
+	// PutEmpty stores a new empty tile value in the cache at a given key
+	PutEmpty(key string, val []byte) error
+}
+
 // CreateCache creates a new generic Cache from a CacheConfig
 func CreateCache(config *CacheConfig) (Cache, error) {
 	if config != nil {
@@ -0,0 +1,213 @@
+package tilenol
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive source failures that open a
+	// circuit breaker
+	DefaultFailureThreshold = 5
+	// DefaultCircuitCooldown is the default duration that an open circuit breaker short-circuits
+	// requests, before letting a trial request through to the source
+	DefaultCircuitCooldown = 30 * time.Second
+)
+
+const (
+	// CircuitClosed is the circuit breaker state in which requests reach the source
+	CircuitClosed = iota
+	// CircuitOpen is the circuit breaker state in which requests are short-circuited
+	CircuitOpen
+	// CircuitHalfOpen is the circuit breaker state in which a single trial request is let
+	// through after the cooldown
+	CircuitHalfOpen
+)
+
+// Error type for HTTP Status code 503, returned for requests to a layer whose circuit breaker
+// is open
+type CircuitOpenError struct {
+	Layer string
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker is open for layer: %s", e.Layer)
+}
+
+// CircuitBreakerConfig is the YAML configuration for a layer's circuit breaker
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive source failures that open the circuit
+	// (defaults to DefaultFailureThreshold)
+	FailureThreshold int `yaml:"failureThreshold"`
+	// Cooldown is how long the open circuit short-circuits requests before letting a trial
+	// request through (defaults to DefaultCircuitCooldown)
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Validate checks that the circuit breaker thresholds aren't negative
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.FailureThreshold < 0 || c.Cooldown < 0 {
+		return errors.New("Circuit breaker failureThreshold and cooldown can't be negative")
+	}
+	return nil
+}
+
+// CircuitBreakerSource wraps a Source with a circuit breaker, which short-circuits requests with
+// a CircuitOpenError for a cooldown period after consecutive source failures, instead of
+// continuing to hit a failing backend. The circuit state is exposed in the Metrics map as
+// "circuit_<layer>_state" (see CircuitClosed, CircuitOpen and CircuitHalfOpen).
+type CircuitBreakerSource struct {
+	Source
+	// Layer is the name of the layer that the source belongs to
+	Layer string
+	// FailureThreshold is the number of consecutive failures that open the circuit
+	FailureThreshold int
+	// Cooldown is how long the open circuit short-circuits requests
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+	// now returns the current time, and can be overridden for testing
+	now func() time.Time
+
+	state    *expvar.Int
+	rejected *expvar.Int
+}
+
+// NewCircuitBreakerSource wraps the layer's Source with a circuit breaker
+func NewCircuitBreakerSource(layer string, source Source, config *CircuitBreakerConfig) *CircuitBreakerSource {
+	threshold, cooldown := config.FailureThreshold, config.Cooldown
+	if threshold == 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown == 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+	return &CircuitBreakerSource{
+		Source:           source,
+		Layer:            layer,
+		FailureThreshold: threshold,
+		Cooldown:         cooldown,
+		now:              time.Now,
+		state:            newGauge("circuit_" + layer + "_state"),
+		rejected:         newGauge("circuit_" + layer + "_rejected"),
+	}
+}
+
+// GetFeatures retrieves the features from the wrapped Source, unless the circuit is open
+func (c *CircuitBreakerSource) GetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	if !c.allow() {
+		c.rejected.Add(1)
+		return nil, CircuitOpenError{c.Layer}
+	}
+	fc, err := c.Source.GetFeatures(ctx, req)
+	c.record(ctx, err)
+	return fc, err
+}
+
+// LastModified returns the last modification time from the wrapped Source, if it is a
+// LastModifiedSource. While the circuit is open, the modification time is unknown.
+func (c *CircuitBreakerSource) LastModified(ctx context.Context, req *TileRequest) (time.Time, error) {
+	source, ok := c.Source.(LastModifiedSource)
+	if !ok || c.State() != CircuitClosed {
+		return time.Time{}, nil
+	}
+	return source.LastModified(ctx, req)
+}
+
+// State returns the current state of the circuit
+func (c *CircuitBreakerSource) State() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentState()
+}
+
+// currentState determines the state of the circuit, and must be called with the lock held
+func (c *CircuitBreakerSource) currentState() int {
+	switch {
+	case c.openedAt.IsZero():
+		return CircuitClosed
+	case c.trial || c.now().Sub(c.openedAt) >= c.Cooldown:
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
+
+// allow returns whether or not a request may reach the source, letting a single trial request
+// through once the cooldown has passed
+func (c *CircuitBreakerSource) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.currentState() {
+	case CircuitClosed:
+		return true
+	case CircuitHalfOpen:
+		if c.trial {
+			return false
+		}
+		c.trial = true
+		c.state.Set(CircuitHalfOpen)
+		return true
+	}
+	return false
+}
+
+// isRequestError determines whether or not a source error was caused by the request itself
+// (e.g. a malformed raw query), rather than by the availability of the backend
+func isRequestError(err error) bool {
+	switch err.(type) {
+	case InvalidRequestError, ForbiddenError, UnknownLayerError:
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 22 is "Data Exception", and class 42 is "Syntax Error or Access Rule Violation"
+		class := pqErr.Code.Class()
+		return class == "22" || class == "42"
+	}
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) {
+		// Other than timeouts and throttling, 4xx responses are caused by the query
+		return esErr.Status >= 400 && esErr.Status < 500 &&
+			esErr.Status != http.StatusRequestTimeout && esErr.Status != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// record updates the circuit with the result of a source request. Errors caused by the request
+// itself (invalid, forbidden or canceled requests) don't count as failures.
+func (c *CircuitBreakerSource) record(ctx context.Context, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && (isRequestError(err) || ctx.Err() != nil) {
+		// Let another request try the source instead
+		c.trial = false
+		return
+	}
+	if err == nil {
+		if !c.openedAt.IsZero() {
+			Logger.Infof("Closing circuit breaker for layer [%s]", c.Layer)
+		}
+		c.failures, c.openedAt, c.trial = 0, time.Time{}, false
+		c.state.Set(CircuitClosed)
+		return
+	}
+	c.failures++
+	if c.trial || c.failures >= c.FailureThreshold {
+		Logger.Warnf("Opening circuit breaker for layer [%s] after %d consecutive failures: %v", c.Layer, c.failures, err)
+		c.openedAt, c.trial = c.now(), false
+		c.state.Set(CircuitOpen)
+	}
+}
@@ -0,0 +1,130 @@
+package tilenol
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/lib/pq"
+	"github.com/olivere/elastic"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakySource struct {
+	err   error
+	calls int
+}
+
+func (f *flakySource) GetFeatures(context.Context, *TileRequest) (*geojson.FeatureCollection, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return geojson.NewFeatureCollection(), nil
+}
+
+func TestCircuitBreakerSource(t *testing.T) {
+	source := &flakySource{err: errors.New("Source unavailable")}
+	breaker := NewCircuitBreakerSource("test", source, &CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Minute})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+	req := &TileRequest{}
+
+	// The circuit opens after consecutive failures
+	for i := 0; i < 2; i++ {
+		_, err := breaker.GetFeatures(ctx, req)
+		assert.Equal(t, source.err, err)
+	}
+	assert.Equal(t, CircuitOpen, breaker.State())
+	_, err := breaker.GetFeatures(ctx, req)
+	assert.Equal(t, CircuitOpenError{"test"}, err)
+	assert.Equal(t, 2, source.calls, "Expected the open circuit to short-circuit the source")
+	assert.Equal(t, int64(CircuitOpen), breaker.state.Value())
+	assert.Equal(t, int64(1), breaker.rejected.Value())
+
+	// A failed trial request after the cooldown reopens the circuit
+	now = now.Add(time.Minute)
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	_, err = breaker.GetFeatures(ctx, req)
+	assert.Equal(t, source.err, err)
+	assert.Equal(t, CircuitOpen, breaker.State())
+
+	// A successful trial request closes the circuit
+	now = now.Add(time.Minute)
+	source.err = nil
+	_, err = breaker.GetFeatures(ctx, req)
+	assert.Nil(t, err)
+	assert.Equal(t, CircuitClosed, breaker.State())
+	assert.Equal(t, int64(CircuitClosed), breaker.state.Value())
+}
+
+func TestCircuitBreakerIgnoresInvalidRequests(t *testing.T) {
+	source := &flakySource{err: InvalidRequestError{"Invalid geometry"}}
+	breaker := NewCircuitBreakerSource("invalid", source, &CircuitBreakerConfig{FailureThreshold: 1})
+	for i := 0; i < 3; i++ {
+		breaker.GetFeatures(context.Background(), &TileRequest{})
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+	assert.Equal(t, 3, source.calls)
+}
+
+func TestIsRequestError(t *testing.T) {
+	requestErrors := []error{
+		InvalidRequestError{"Invalid geometry"},
+		ForbiddenError{"Missing the request scope"},
+		UnknownLayerError{"Unknown layer"},
+		&pq.Error{Code: "42601"},
+		&pq.Error{Code: "22P02"},
+		&elastic.Error{Status: 400},
+	}
+	for _, err := range requestErrors {
+		assert.True(t, isRequestError(err), "Expected a request error: %v", err)
+	}
+	backendErrors := []error{
+		errors.New("Source unavailable"),
+		&pq.Error{Code: "08006"},
+		&pq.Error{Code: "53300"},
+		&pq.Error{Code: "57P01"},
+		&elastic.Error{Status: 408},
+		&elastic.Error{Status: 429},
+		&elastic.Error{Status: 503},
+	}
+	for _, err := range backendErrors {
+		assert.False(t, isRequestError(err), "Expected a backend error: %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresBadQueries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+	breaker := NewCircuitBreakerSource("bad_queries", pgis, &CircuitBreakerConfig{FailureThreshold: 2})
+	req := &TileRequest{Args: map[string][]string{"q": {"height >"}}}
+	for i := 0; i < 3; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery("height >").WillReturnError(&pq.Error{Code: "42601", Message: "syntax error at end of input"})
+		mock.ExpectRollback()
+		_, err = breaker.GetFeatures(context.Background(), req)
+		assert.NotNil(t, err)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, CircuitClosed, breaker.State(), "Expected bad queries to leave the circuit closed")
+}
+
+func TestCircuitOpenErrorStatus(t *testing.T) {
+	server := &Server{}
+	w := httptest.NewRecorder()
+	server.handleError(CircuitOpenError{"test"}, w, httptest.NewRequest("GET", "/test/0/0/0.mvt", nil))
+	assert.Equal(t, 503, w.Code)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"runtime"
+	"text/tabwriter"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stationa/tilenol"
@@ -44,12 +46,30 @@ var (
 			Envar("TILENOL_SIMPLIFY_SHAPES").
 			Short('s').
 			Bool()
+	encodeWorkers = runCmd.
+			Flag("encode-workers", "Maximum number of tiles to encode concurrently (defaults to the number of CPUs)").
+			Envar("TILENOL_ENCODE_WORKERS").
+			Short('w').
+			Default("0").
+			Int()
 	numProcs = runCmd.
 			Flag("num-processes", "Sets the number of processes to be used").
 			Envar("TILENOL_NUM_PROCESSES").
 			Short('n').
 			Default("0").
 			Int()
+	validateCmd = kingpin.
+			Command("validate", "Validates the server configuration and prints the layer plan")
+	validateConfigFile = validateCmd.
+				Flag("config-file", "Server configuration file").
+				Envar("TILENOL_CONFIG_FILE").
+				Short('f').
+				Default("tilenol.yml").
+				File()
+	checkConnectivity = validateCmd.
+				Flag("check-connectivity", "Also connects to each layer source").
+				Short('c').
+				Bool()
 	versionCmd = kingpin.
 			Command("version", "Prints out the version")
 )
@@ -66,6 +86,32 @@ func printVersionInfo() {
 	fmt.Printf("tilenol version=%s (%s)\n", Version, Commitish)
 }
 
+// validateConfig loads and validates the configuration, optionally connecting to each layer
+// source, and prints the name, source type and zoom range of each layer
+func validateConfig() error {
+	config, err := tilenol.LoadConfig(*validateConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if *checkConnectivity {
+		for _, layerConfig := range config.Layers {
+			if _, err := tilenol.CreateLayer(layerConfig); err != nil {
+				return fmt.Errorf("Could not create layer \"%s\": %v", layerConfig.Name, err)
+			}
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tSOURCE\tZOOM")
+	for _, layerConfig := range config.Layers {
+		minzoom, maxzoom := layerConfig.ZoomRange()
+		fmt.Fprintf(w, "%s\t%s\t%d-%d\n", layerConfig.Name, layerConfig.Source.Type(), minzoom, maxzoom)
+	}
+	return w.Flush()
+}
+
 func main() {
 	if *numProcs < 1 {
 		*numProcs = runtime.NumCPU()
@@ -84,6 +130,7 @@ func main() {
 		opts = append(opts, tilenol.Port(*port))
 		opts = append(opts, tilenol.InternalPort(*internalPort))
 		opts = append(opts, tilenol.ConfigFile(*configFile))
+		opts = append(opts, tilenol.EncodeWorkers(*encodeWorkers))
 		if *cors {
 			opts = append(opts, tilenol.EnableCORS)
 		}
@@ -96,6 +143,8 @@ func main() {
 			panic(err)
 		}
 		s.Start()
+	case validateCmd.FullCommand():
+		kingpin.FatalIfError(validateConfig(), "Invalid configuration")
 	case versionCmd.FullCommand():
 		printVersionInfo()
 	}
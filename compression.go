@@ -0,0 +1,42 @@
+package tilenol
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip determines whether or not the client accepts gzipped responses, according to its
+// Accept-Encoding header. Clients without an Accept-Encoding header accept any encoding, while an
+// explicit gzip coding takes precedence over a "*" wildcard.
+func acceptsGzip(r *http.Request) bool {
+	values, present := r.Header["Accept-Encoding"]
+	if !present {
+		return true
+	}
+	gzipQ, anyQ := -1.0, -1.0
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(params[0])) {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
@@ -0,0 +1,62 @@
+package tilenol
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	accepted := []string{"gzip", "deflate, gzip;q=0.5", "*", "br, *;q=0.1", "GZIP", "x-gzip"}
+	for _, value := range accepted {
+		r := httptest.NewRequest("GET", "/0/0/0.mvt", nil)
+		r.Header.Set("Accept-Encoding", value)
+		assert.True(t, acceptsGzip(r), "Expected gzip to be accepted: %s", value)
+	}
+	refused := []string{"", "identity", "gzip;q=0", "*, gzip;q=0", "*;q=0", "deflate"}
+	for _, value := range refused {
+		r := httptest.NewRequest("GET", "/0/0/0.mvt", nil)
+		r.Header.Set("Accept-Encoding", value)
+		assert.False(t, acceptsGzip(r), "Expected gzip to be refused: %s", value)
+	}
+	assert.True(t, acceptsGzip(httptest.NewRequest("GET", "/0/0/0.mvt", nil)))
+}
+
+func TestUncompressedTiles(t *testing.T) {
+	server := &Server{
+		Cache: NewInMemoryCache(),
+		Layers: []Layer{
+			Layer{Name: "points", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})},
+		},
+	}
+	api, _ := server.setupRoutes()
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		return w
+	}
+
+	w := get("/points/0/0/0.pbf", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	gzipped, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+
+	// The cached tile is decompressed for clients that don't accept gzip
+	w = get("/points/0/0/0.pbf", "identity")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, gzipped, w.Body.Bytes())
+	layers, err := mvt.Unmarshal(w.Body.Bytes())
+	assert.Nil(t, err, "Failed to decode MVT tile: %v", err)
+	assert.Len(t, layers[0].Features, 1)
+}
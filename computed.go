@@ -0,0 +1,233 @@
+package tilenol
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// ComputedProperty is a feature property that is computed from an arithmetic expression over
+// the other properties of the feature (e.g. "count / area"). Expressions support numbers,
+// property names, parentheses, unary minus and the +, -, *, / and % operators.
+type ComputedProperty struct {
+	Name string
+	Expr string
+
+	eval exprNode
+}
+
+// exprNode evaluates a (sub)expression against the properties of a feature
+type exprNode func(properties geojson.Properties) (float64, error)
+
+// ParseComputedProperty parses the expression of a computed property
+func ParseComputedProperty(name, expr string) (*ComputedProperty, error) {
+	p := &exprParser{expr: expr}
+	eval, err := p.parseSum()
+	if err == nil && p.skipSpace() < len(expr) {
+		err = fmt.Errorf("unexpected %q", expr[p.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression for computed property [%s]: %v", name, err)
+	}
+	return &ComputedProperty{Name: name, Expr: expr, eval: eval}, nil
+}
+
+// parseComputedProperties parses the configured computed properties of a layer, sorted by name
+// so that they are computed in a stable order
+func parseComputedProperties(exprs map[string]string) ([]*ComputedProperty, error) {
+	var computed []*ComputedProperty
+	for name, expr := range exprs {
+		property, err := ParseComputedProperty(name, expr)
+		if err != nil {
+			return nil, err
+		}
+		computed = append(computed, property)
+	}
+	sort.Slice(computed, func(i, j int) bool { return computed[i].Name < computed[j].Name })
+	return computed, nil
+}
+
+// Eval evaluates the expression against the properties of a feature, failing for missing or
+// non-numeric properties and non-finite results (e.g. division by zero)
+func (c *ComputedProperty) Eval(properties geojson.Properties) (float64, error) {
+	v, err := c.eval(properties)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("%s is not a finite number", c.Expr)
+	}
+	return v, nil
+}
+
+// computeProperties adds the computed properties to each of the features, where expressions
+// that fail to evaluate only drop that property of the feature
+func computeProperties(ctx context.Context, fc *geojson.FeatureCollection, computed []*ComputedProperty) {
+	for _, feature := range fc.Features {
+		if feature.Properties == nil {
+			feature.Properties = geojson.Properties{}
+		}
+		for _, property := range computed {
+			v, err := property.Eval(feature.Properties)
+			if err != nil {
+				RequestLogger(ctx).Warnf("Dropping computed property [%s] of feature [%v]: %v", property.Name, feature.ID, err)
+				delete(feature.Properties, property.Name)
+				continue
+			}
+			feature.Properties[property.Name] = v
+		}
+	}
+}
+
+// exprParser is a recursive descent parser for arithmetic expressions
+type exprParser struct {
+	expr string
+	pos  int
+}
+
+// skipSpace advances past any whitespace, returning the new position
+func (p *exprParser) skipSpace() int {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+		p.pos++
+	}
+	return p.pos
+}
+
+// peek returns the next non-whitespace character, or zero at the end of the expression
+func (p *exprParser) peek() byte {
+	if p.skipSpace() >= len(p.expr) {
+		return 0
+	}
+	return p.expr[p.pos]
+}
+
+// parseSum parses a sequence of terms separated by + or -
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(op, left, right)
+	}
+	return left, nil
+}
+
+// parseProduct parses a sequence of factors separated by *, / or %
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/' || op == '%'; op = p.peek() {
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(op, left, right)
+	}
+	return left, nil
+}
+
+// parseFactor parses a number, a property name, a parenthesized expression or a negation
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return func(properties geojson.Properties) (float64, error) {
+			v, err := operand(properties)
+			return -v, err
+		}, nil
+	case c == '(':
+		p.pos++
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return inner, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.expr) && strings.IndexByte("0123456789.eE", p.expr[p.pos]) >= 0 {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.expr[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.expr[start:p.pos])
+		}
+		return func(geojson.Properties) (float64, error) { return n, nil }, nil
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		start := p.pos
+		for p.pos < len(p.expr) && isPropertyNameChar(p.expr[p.pos]) {
+			p.pos++
+		}
+		return propertyNode(p.expr[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+// isPropertyNameChar returns whether or not the character may be part of a property name
+func isPropertyNameChar(c byte) bool {
+	return c == '_' || c == '.' || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+// propertyNode evaluates to the numeric value of a feature property
+func propertyNode(name string) exprNode {
+	return func(properties geojson.Properties) (float64, error) {
+		property, exists := properties[name]
+		if !exists || property == nil {
+			return 0, fmt.Errorf("missing property %s", name)
+		}
+		v, isNumber := floatValue(property)
+		if !isNumber {
+			return 0, fmt.Errorf("property %s is not a number: %#v", name, property)
+		}
+		return v, nil
+	}
+}
+
+// binaryNode applies an arithmetic operator to the values of two subexpressions
+func binaryNode(op byte, left, right exprNode) exprNode {
+	return func(properties geojson.Properties) (float64, error) {
+		l, err := left(properties)
+		if err != nil {
+			return 0, err
+		}
+		r, err := right(properties)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '+':
+			return l + r, nil
+		case '-':
+			return l - r, nil
+		case '*':
+			return l * r, nil
+		case '/':
+			return l / r, nil
+		}
+		return math.Mod(l, r), nil
+	}
+}
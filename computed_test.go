@@ -0,0 +1,61 @@
+package tilenol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputedPropertyEval(t *testing.T) {
+	properties := geojson.Properties{"count": 10, "area": 4.0, "rank": 3, "type": "park"}
+	tests := map[string]float64{
+		"count / area":         2.5,
+		"count - area * 2":     2,
+		"(count - area) * 2":   12,
+		"-rank + 1":            -2,
+		"count % rank":         1,
+		"1.5e1 / (rank - 0.5)": 6,
+	}
+	for expr, expected := range tests {
+		computed, err := ParseComputedProperty("value", expr)
+		assert.Nil(t, err, expr)
+		v, err := computed.Eval(properties)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, expected, v, expr)
+	}
+
+	for _, expr := range []string{"missing + 1", "type * 2", "count / (rank - 3)"} {
+		computed, err := ParseComputedProperty("value", expr)
+		assert.Nil(t, err, expr)
+		_, err = computed.Eval(properties)
+		assert.NotNil(t, err, expr)
+	}
+
+	for _, expr := range []string{"", "count /", "(count", "count area", "count ^ 2", "1..2"} {
+		_, err := ParseComputedProperty("value", expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestComputeProperties(t *testing.T) {
+	computed, err := parseComputedProperties(map[string]string{"density": "count / area"})
+	assert.Nil(t, err)
+	fc := geojson.NewFeatureCollection()
+	valid := geojson.NewFeature(orb.Point{0, 0})
+	valid.Properties = geojson.Properties{"count": 10, "area": 4}
+	invalid := geojson.NewFeature(orb.Point{0, 0})
+	invalid.Properties = geojson.Properties{"count": 10, "area": 0, "density": 1}
+	fc.Append(valid)
+	fc.Append(invalid)
+
+	computeProperties(context.Background(), fc, computed)
+	assert.Equal(t, 2.5, valid.Properties["density"])
+	assert.NotContains(t, invalid.Properties, "density", "Failed expressions only drop the property")
+	assert.Equal(t, 10, invalid.Properties["count"])
+
+	_, err = CreateLayer(LayerConfig{Name: "test", Computed: map[string]string{"density": "count /"}})
+	assert.NotNil(t, err)
+}
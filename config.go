@@ -1,7 +1,12 @@
 package tilenol
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +17,35 @@ type Config struct {
 	Cache *CacheConfig `yaml:"cache"`
 	// Layers configures the tile server layers
 	Layers []LayerConfig `yaml:"layers"`
+	// LayersDir is the optional directory (relative to the config file) of additional layer
+	// definitions, where each *.yaml or *.yml file holds either a single layer or a list of
+	// layers. Its layers are appended to the Layers in file name order.
+	LayersDir string `yaml:"layersDir"`
+	// Tilesets optionally configures named groups of layers
+	Tilesets []TilesetConfig `yaml:"tilesets"`
+	// Auth optionally configures authentication for the tile endpoints
+	Auth *AuthConfig `yaml:"auth"`
+	// InternalAuth optionally configures authentication for the internal endpoints (e.g.
+	// healthcheck)
+	InternalAuth *AuthConfig `yaml:"internalAuth"`
+	// Server optionally tunes the HTTP server timeouts, HTTP/2 and TLS settings
+	Server *HTTPServerConfig `yaml:"server"`
+	// PrefetchNeighbors optionally pre-warms the cache with the neighbors of rendered tiles
+	PrefetchNeighbors bool `yaml:"prefetchNeighbors"`
+	// JSONP optionally enables wrapping JSON tile responses in a "callback" parameter
+	JSONP bool `yaml:"jsonp"`
+	// DefaultLayer optionally names the layer (or tileset) served at the tile paths without a
+	// layers segment
+	DefaultLayer string `yaml:"defaultLayer"`
+	// ServerTiming optionally adds Server-Timing headers with the source fetch and encode
+	// durations to rendered tiles
+	ServerTiming bool `yaml:"serverTiming"`
+	// TileBounds optionally adds X-Tile-Bounds headers with the WGS84 bounds of the tiles to
+	// tile responses
+	TileBounds bool `yaml:"tileBounds"`
+	// MaxLayerConcurrency optionally limits the number of layers of a multi-layer tile request
+	// whose features are retrieved concurrently
+	MaxLayerConcurrency int `yaml:"maxLayerConcurrency"`
 }
 
 // LoadConfig loads the configuration from disk, and decodes it into a Config object
@@ -22,10 +56,128 @@ func LoadConfig(configFile *os.File) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.LayersDir != "" {
+		dir := config.LayersDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(configFile.Name()), dir)
+		}
+		layers, err := loadLayersDir(dir, config.Layers)
+		if err != nil {
+			return nil, err
+		}
+		config.Layers = layers
+	}
 	Logger.Debugf("Loaded config: %+v", config)
 	return &config, nil
 }
 
+// loadLayersDir appends the layer definitions of the YAML files in the directory to the layers,
+// in file name order. A layer name that is already defined (in the base config or in another
+// file) is an error.
+func loadLayersDir(dir string, layers []LayerConfig) ([]LayerConfig, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read layersDir: %v", err)
+	}
+	defined := make(map[string]string)
+	for _, layerConfig := range layers {
+		defined[layerConfig.Name] = "the base config"
+	}
+	var names []string
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if !file.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fileLayers, err := loadLayersFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load layers from %s: %v", path, err)
+		}
+		for _, layerConfig := range fileLayers {
+			if previous, exists := defined[layerConfig.Name]; exists {
+				return nil, fmt.Errorf("Duplicate layer name \"%s\" in %s (already defined in %s)", layerConfig.Name, path, previous)
+			}
+			defined[layerConfig.Name] = path
+			layers = append(layers, layerConfig)
+		}
+	}
+	return layers, nil
+}
+
+// loadLayersFile decodes the single layer or the list of layers defined in a YAML file
+func loadLayersFile(path string) ([]LayerConfig, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(body, &node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 {
+		return nil, nil
+	}
+	var layers []LayerConfig
+	if node.Content[0].Kind == yaml.SequenceNode {
+		err = node.Content[0].Decode(&layers)
+	} else {
+		var layerConfig LayerConfig
+		err = node.Content[0].Decode(&layerConfig)
+		layers = append(layers, layerConfig)
+	}
+	return layers, err
+}
+
+// Validate checks that the Config is well-formed, without connecting to any of the layer sources
+func (c *Config) Validate() error {
+	var layers []Layer
+	for _, layerConfig := range c.Layers {
+		if err := layerConfig.Validate(); err != nil {
+			return fmt.Errorf("Invalid layer \"%s\": %v", layerConfig.Name, err)
+		}
+		if len(filterLayersByNames(layers, []string{layerConfig.Name})) > 0 {
+			return fmt.Errorf("Duplicate layer name: \"%s\"", layerConfig.Name)
+		}
+		layers = append(layers, Layer{Name: layerConfig.Name})
+	}
+	for _, tilesetConfig := range c.Tilesets {
+		if _, err := CreateTileset(tilesetConfig, layers); err != nil {
+			return err
+		}
+	}
+	if c.DefaultLayer != "" && !c.hasLayerOrTileset(c.DefaultLayer) {
+		return fmt.Errorf("Unknown default layer: \"%s\"", c.DefaultLayer)
+	}
+	if c.Cache != nil {
+		if err := c.Cache.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.MaxLayerConcurrency < 0 {
+		return fmt.Errorf("Invalid maxLayerConcurrency: %d", c.MaxLayerConcurrency)
+	}
+	return c.Server.withDefaults().validate()
+}
+
+// hasLayerOrTileset returns whether or not a layer or tileset with the given name is configured
+func (c *Config) hasLayerOrTileset(name string) bool {
+	for _, layerConfig := range c.Layers {
+		if layerConfig.Name == name {
+			return true
+		}
+	}
+	for _, tilesetConfig := range c.Tilesets {
+		if tilesetConfig.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // ConfigOption is a function that changes a configuration setting of the server.Server
 type ConfigOption func(s *Server) error
 
@@ -36,11 +188,24 @@ func ConfigFile(configFile *os.File) ConfigOption {
 		if err != nil {
 			return err
 		}
+		if err := config.Validate(); err != nil {
+			return err
+		}
 		cache, err := CreateCache(config.Cache)
 		if err != nil {
 			return err
 		}
 		s.Cache = cache
+		s.ServeStaleOnError = config.Cache != nil && config.Cache.ServeStaleOnError
+		s.Auth = CreateAuthenticators(config.Auth)
+		s.InternalAuth = CreateAuthenticators(config.InternalAuth)
+		s.HTTPConfig = config.Server
+		s.PrefetchNeighbors = config.PrefetchNeighbors
+		s.EnableJSONP = config.JSONP
+		s.DefaultLayer = config.DefaultLayer
+		s.ServerTiming = config.ServerTiming
+		s.TileBounds = config.TileBounds
+		s.MaxLayerConcurrency = config.MaxLayerConcurrency
 		var layers []Layer
 		for _, layerConfig := range config.Layers {
 			layer, err := CreateLayer(layerConfig)
@@ -50,6 +215,15 @@ func ConfigFile(configFile *os.File) ConfigOption {
 			layers = append(layers, *layer)
 		}
 		s.Layers = layers
+		var tilesets []Tileset
+		for _, tilesetConfig := range config.Tilesets {
+			tileset, err := CreateTileset(tilesetConfig, layers)
+			if err != nil {
+				return err
+			}
+			tilesets = append(tilesets, *tileset)
+		}
+		s.Tilesets = tilesets
 		return nil
 	}
 }
@@ -70,6 +244,14 @@ func InternalPort(internalPort uint16) ConfigOption {
 	}
 }
 
+// EncodeWorkers changes the maximum number of tiles that are encoded concurrently
+func EncodeWorkers(encodeWorkers int) ConfigOption {
+	return func(s *Server) error {
+		s.EncodeWorkers = encodeWorkers
+		return nil
+	}
+}
+
 // EnableCORS configures the server for CORS (cross-origin resource sharing)
 func EnableCORS(s *Server) error {
 	s.EnableCORS = true
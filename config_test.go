@@ -0,0 +1,94 @@
+package tilenol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	httpSource := SourceConfig{HTTP: &HTTPSourceConfig{URLTemplate: "http://localhost/{z}/{x}/{y}"}}
+	config := Config{
+		Layers: []LayerConfig{
+			LayerConfig{Name: "roads", Source: httpSource},
+			LayerConfig{Name: "pois", Source: httpSource},
+		},
+		Tilesets: []TilesetConfig{
+			TilesetConfig{Name: "combined", Layers: []string{"roads", "pois"}},
+		},
+	}
+	assert.Nil(t, config.Validate())
+
+	config.DefaultLayer = "combined"
+	assert.Nil(t, config.Validate())
+	config.DefaultLayer = "buildings"
+	assert.NotNil(t, config.Validate(), "Expected to fail due to an unknown default layer")
+	config.DefaultLayer = ""
+
+	config.Tilesets[0].Layers = []string{"roads", "buildings"}
+	assert.NotNil(t, config.Validate(), "Expected to fail due to an unknown tileset layer")
+	config.Tilesets = nil
+
+	config.Layers[1].Name = "roads"
+	assert.NotNil(t, config.Validate(), "Expected to fail due to a duplicate layer name")
+	config.Layers[1].Name = "pois"
+
+	config.Layers[1].Source = SourceConfig{HTTP: &HTTPSourceConfig{}}
+	assert.NotNil(t, config.Validate(), "Expected to fail due to a missing urlTemplate")
+	config.Layers[1].Source = httpSource
+
+	config.Cache = &CacheConfig{Redis: &RedisConfig{}, ServeStaleOnError: true}
+	assert.NotNil(t, config.Validate(), "Expected to fail due to serveStaleOnError without a staleTTL")
+	config.Cache.Redis.StaleTTL = time.Hour
+	assert.Nil(t, config.Validate())
+	config.Cache = &CacheConfig{ServeStaleOnError: true}
+	assert.Nil(t, config.Validate())
+
+	config.Server = &HTTPServerConfig{TLSCertFile: "cert.pem"}
+	assert.NotNil(t, config.Validate(), "Expected to fail due to a missing tlsKeyFile")
+}
+
+func TestLoadConfigLayersDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tilenol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"tilenol.yml":               "layersDir: layers.d\nlayers:\n  - name: roads\n",
+		"layers.d/20-pois.yaml":     "- name: pois\n- name: parks\n",
+		"layers.d/10-buildings.yml": "name: buildings\nminzoom: 14\n",
+		"layers.d/README.md":        "Not a layer",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configFile, err := os.Open(filepath.Join(dir, "tilenol.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer configFile.Close()
+	config, err := LoadConfig(configFile)
+	assert.Nil(t, err)
+	var names []string
+	for _, layerConfig := range config.Layers {
+		names = append(names, layerConfig.Name)
+	}
+	assert.Equal(t, []string{"roads", "buildings", "pois", "parks"}, names)
+	assert.Equal(t, 14, *config.Layers[1].Minzoom)
+
+	// Duplicate layer names across files are an error
+	ioutil.WriteFile(filepath.Join(dir, "layers.d/30-roads.yaml"), []byte("name: roads\n"), 0644)
+	_, err = loadLayersDir(filepath.Join(dir, "layers.d"), config.Layers[:1])
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "30-roads.yaml")
+}
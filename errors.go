@@ -0,0 +1,132 @@
+package tilenol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic"
+)
+
+const (
+	// BadTileErrorCode is the error code of invalid tile requests (e.g. out of range tile
+	// coordinates or malformed parameters)
+	BadTileErrorCode = "bad_tile"
+	// UnknownLayerErrorCode is the error code of requests for layers that aren't configured
+	UnknownLayerErrorCode = "unknown_layer"
+	// UnauthorizedErrorCode is the error code of requests without valid credentials (see
+	// RequireAuth)
+	UnauthorizedErrorCode = "unauthorized"
+	// ForbiddenErrorCode is the error code of requests to scoped layers without the value they
+	// are scoped to
+	ForbiddenErrorCode = "forbidden"
+	// BackendUnavailableErrorCode is the error code of requests whose layer source is
+	// unavailable (e.g. while its circuit breaker is open)
+	BackendUnavailableErrorCode = "backend_unavailable"
+	// TimeoutErrorCode is the error code of requests whose source queries timed out
+	TimeoutErrorCode = "timeout"
+	// InternalErrorCode is the error code of any other failed requests
+	InternalErrorCode = "internal_error"
+)
+
+// Error type for HTTP Status code 404, returned for requests of layers that aren't configured
+type UnknownLayerError struct {
+	s string
+}
+
+func (e UnknownLayerError) Error() string {
+	return e.s
+}
+
+// Error type for HTTP Status code 401, returned for requests without valid credentials
+type UnauthorizedError struct {
+	s string
+}
+
+func (e UnauthorizedError) Error() string {
+	return e.s
+}
+
+// newUnknownLayerError creates an UnknownLayerError that lists the available layers
+func newUnknownLayerError(msg string, layers []Layer) UnknownLayerError {
+	names := make([]string, len(layers))
+	for i, layer := range layers {
+		names[i] = layer.Name
+	}
+	return UnknownLayerError{fmt.Sprintf("%s, request one of the available layers: %s", msg, strings.Join(names, ", "))}
+}
+
+// ErrorResponse is the JSON body of error responses
+type ErrorResponse struct {
+	// Error is the error message
+	Error string `json:"error"`
+	// Code is one of the stable error codes (e.g. BadTileErrorCode), for programmatic clients
+	Code string `json:"code"`
+}
+
+// errorStatus determines the HTTP status code and the error code of an error
+func errorStatus(err error) (int, string) {
+	switch err.(type) {
+	case InvalidRequestError:
+		return http.StatusBadRequest, BadTileErrorCode
+	case UnauthorizedError:
+		return http.StatusUnauthorized, UnauthorizedErrorCode
+	case ForbiddenError:
+		return http.StatusForbidden, ForbiddenErrorCode
+	case UnknownLayerError:
+		return http.StatusNotFound, UnknownLayerErrorCode
+	case CircuitOpenError:
+		return http.StatusServiceUnavailable, BackendUnavailableErrorCode
+	}
+	if isTimeoutError(err) {
+		return http.StatusGatewayTimeout, TimeoutErrorCode
+	}
+	return http.StatusInternalServerError, InternalErrorCode
+}
+
+// isTimeoutError determines whether or not an error was caused by a timed out source query,
+// which is either a context deadline or a backend-side timeout
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 57014 is query_canceled, which is returned for statement timeouts
+		return pqErr.Code == "57014"
+	}
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) {
+		return esErr.Status == http.StatusRequestTimeout || esErr.Status == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// wantsJSONError returns whether or not the error response of a request should be JSON, which
+// is the case for the JSON tile formats and for clients that accept JSON
+func wantsJSONError(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, ".json") || strings.HasSuffix(r.URL.Path, ".topojson") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeError writes the error response of a request, either as an ErrorResponse or as plain
+// text depending on the requested format
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	RequestLogger(r.Context()).Errorf("Tile request failed: %s (HTTP error %d)", err.Error(), status)
+	if !wantsJSONError(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	body, _ := json.Marshal(&ErrorResponse{Error: err.Error(), Code: code})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,72 @@
+package tilenol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/olivere/elastic"
+	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponses(t *testing.T) {
+	server := &Server{
+		Cache:  &NilCache{},
+		Layers: []Layer{Layer{Name: "points", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})}},
+	}
+	api, _ := server.setupRoutes()
+
+	// JSON tile formats get JSON error bodies
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/30/0/0.topojson", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var res ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, BadTileErrorCode, res.Code)
+	assert.Contains(t, res.Error, "Invalid zoom level")
+
+	// Vector tiles get plain text error bodies, unless the client accepts JSON
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/roads/0/0/0.mvt", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(t, w.Body.String(), "available layers: points")
+
+	r := httptest.NewRequest("GET", "/roads/0/0/0.mvt", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, UnknownLayerErrorCode, res.Code)
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, e := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{InvalidRequestError{"invalid"}, http.StatusBadRequest, BadTileErrorCode},
+		{UnknownLayerError{"unknown"}, http.StatusNotFound, UnknownLayerErrorCode},
+		{UnauthorizedError{"unauthorized"}, http.StatusUnauthorized, UnauthorizedErrorCode},
+		{CircuitOpenError{"points"}, http.StatusServiceUnavailable, BackendUnavailableErrorCode},
+		{fmt.Errorf("search failed: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, TimeoutErrorCode},
+		{&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}, http.StatusGatewayTimeout, TimeoutErrorCode},
+		{&elastic.Error{Status: http.StatusRequestTimeout}, http.StatusGatewayTimeout, TimeoutErrorCode},
+		{&pq.Error{Code: "42601", Message: "syntax error"}, http.StatusInternalServerError, InternalErrorCode},
+		{errors.New("boom"), http.StatusInternalServerError, InternalErrorCode},
+	} {
+		status, code := errorStatus(e.err)
+		assert.Equal(t, e.status, status, e.err.Error())
+		assert.Equal(t, e.code, code, e.err.Error())
+	}
+}
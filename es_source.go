@@ -1,14 +1,24 @@
 package tilenol
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/olivere/elastic"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/maptile"
 )
@@ -29,13 +39,99 @@ type ElasticsearchConfig struct {
 	Host string `yaml:"host"`
 	// Host is the port number of the backend Elasticsearch cluster
 	Port int `yaml:"port"`
+	// CloudID is the optional cloud ID of an Elastic Cloud deployment, which is decoded into the
+	// HTTPS endpoint of the cluster instead of configuring the Host and Port
+	CloudID string `yaml:"cloudId"`
+	// APIKey is the optional API key that requests to the cluster are authorized with, either
+	// base64 encoded (as shown when creating the key) or as "id:api_key"
+	APIKey string `yaml:"apiKey"`
 	// Index is the name of the Elasticsearch index used for retrieving feature data
 	Index string `yaml:"index"`
-	// GeometryField is the name of the document field that holds the feature geometry
+	// GeometryField is the name of the document field that holds the feature geometry, where
+	// numeric path segments index into arrays (e.g. "locations.0.shape")
 	GeometryField string `yaml:"geometryField"`
+	// AutoDetectGeometry configures the source to introspect the index mapping at startup for
+	// its single geo field, instead of configuring the GeometryField
+	AutoDetectGeometry bool `yaml:"autoDetectGeometry"`
+	// LatField is the optional name of a numeric document field holding the latitude, used
+	// together with LonField when a document doesn't have a GeometryField value
+	LatField string `yaml:"latField"`
+	// LonField is the optional name of a numeric document field holding the longitude, used
+	// together with LatField when a document doesn't have a GeometryField value
+	LonField string `yaml:"lonField"`
 	// SourceFields is a mapping from the feature property name to the source document
 	// field name
 	SourceFields map[string]string `yaml:"sourceFields"`
+	// TrackTotalHits optionally controls whether or not Elasticsearch tracks the total hit
+	// count of searches (when unset, the Elasticsearch default is used)
+	TrackTotalHits *bool `yaml:"trackTotalHits"`
+	// FeatureMinzoomField is the optional name of a numeric document field holding the minimum
+	// zoom level at which each feature is shown
+	FeatureMinzoomField string `yaml:"featureMinzoomField"`
+	// GeometryOnly configures the source to return features without any properties, including
+	// the otherwise injected "id" property
+	GeometryOnly bool `yaml:"geometryOnly"`
+	// DocValueFields configures the source to fetch the SourceFields via "docvalue_fields"
+	// rather than from the document source, which only works for doc-value friendly fields
+	// (e.g. keywords and numerics). The document source is then only fetched for the geometry.
+	DocValueFields bool `yaml:"docValueFields"`
+	// QueryTimeout is the optional Elasticsearch query-level timeout (e.g. 5s), after which
+	// searches return partial results and the tile is flagged with PartialTileHeader
+	QueryTimeout time.Duration `yaml:"queryTimeout"`
+	// TimeField is the optional name of a date document field holding the last modification
+	// time of each document, used to compute the Last-Modified header of tiles and to filter
+	// features for SinceArg requests
+	TimeField string `yaml:"timeField"`
+	// BaseQueryFile is the optional path to a JSON file holding an Elasticsearch query (or a
+	// search body with a "query" key), used as the base query of every tile search
+	BaseQueryFile string `yaml:"baseQueryFile"`
+	// SearchTemplate optionally configures a stored Elasticsearch search template, whose
+	// rendered query is used as the base query of every tile search
+	SearchTemplate *ElasticsearchSearchTemplateConfig `yaml:"searchTemplate"`
+	// IncludeScore configures the source to add each hit's relevance score as a "_score"
+	// property. Since the default query only filters, this only applies to sources with a
+	// scoring base query (see BaseQueryFile and SearchTemplate) and to requests with a "q"
+	// query, which then scores the hits instead of only filtering them.
+	IncludeScore bool `yaml:"includeScore"`
+	// SearchParams optionally passes extra parameters through to every tile search (e.g.
+	// terminate_after or preference). Parameters that aren't supported for the scrolled
+	// searches of the source are logged and ignored.
+	SearchParams map[string]interface{} `yaml:"searchParams"`
+	// SourceExcludes is an optional list of document fields (e.g. large blobs) excluded from
+	// the fetched document source. Without any SourceFields, every other top-level document
+	// field is then returned as a feature property.
+	SourceExcludes []string `yaml:"sourceExcludes"`
+	// IDProperty optionally overrides the name of the feature property that the document ID is
+	// added as (defaults to DefaultIDProperty). A mapped source field of the same name takes
+	// precedence over the document ID.
+	IDProperty string `yaml:"idProperty"`
+	// IndexedShape optionally configures where the pre-indexed area-of-interest shapes of
+	// IndexedShapeArg requests are stored
+	IndexedShape *ElasticsearchIndexedShapeConfig `yaml:"indexedShape"`
+	// PreciseIntegers configures the source to decode the integers of the document source
+	// exactly (as 64-bit integers), instead of as float64 values that lose precision beyond
+	// 2^53 (e.g. for large numeric IDs)
+	PreciseIntegers bool `yaml:"preciseIntegers"`
+}
+
+// ElasticsearchIndexedShapeConfig is the YAML configuration for the pre-indexed shapes that
+// IndexedShapeArg requests clip a layer to, instead of sending a complex geometry every time
+type ElasticsearchIndexedShapeConfig struct {
+	// Index is the name of the index holding the shape documents
+	Index string `yaml:"index"`
+	// Type is the optional document type of the shape documents (required before
+	// Elasticsearch 7)
+	Type string `yaml:"type"`
+	// Path is the name of the document field holding the shape (defaults to "shape")
+	Path string `yaml:"path"`
+}
+
+// ElasticsearchSearchTemplateConfig is the YAML configuration for a stored search template
+type ElasticsearchSearchTemplateConfig struct {
+	// ID is the ID of the stored search template
+	ID string `yaml:"id"`
+	// Params are the parameters used to render the search template
+	Params map[string]interface{} `yaml:"params"`
 }
 
 // ElasticsearchSource is a Source implementation that retrieves feature data from an
@@ -43,13 +139,51 @@ type ElasticsearchConfig struct {
 type ElasticsearchSource struct {
 	// ES is the internal Elasticsearch cluster client
 	ES *elastic.Client
+	// Layer is the optional name of the layer that the source belongs to, which labels the
+	// source's metrics (defaults to the Index)
+	Layer string
 	// Index is the name of the Elasticsearch index used for retrieving feature data
 	Index string
 	// GeometryField is the name of the document field that holds the feature geometry
 	GeometryField string
+	// LatField is the optional name of the document field holding the fallback latitude
+	LatField string
+	// LonField is the optional name of the document field holding the fallback longitude
+	LonField string
 	// SourceFields is a mapping from the feature property name to the source document
 	// field name
 	SourceFields map[string]string
+	// TrackTotalHits optionally controls whether or not the total hit count is tracked
+	TrackTotalHits *bool
+	// FeatureMinzoomField is the optional name of the document field holding the per-feature
+	// minimum zoom level
+	FeatureMinzoomField string
+	// GeometryOnly configures the source to return features without any properties
+	GeometryOnly bool
+	// DocValueFields configures the source to fetch the SourceFields via "docvalue_fields"
+	DocValueFields bool
+	// QueryTimeout is the optional Elasticsearch query-level timeout
+	QueryTimeout time.Duration
+	// TimeField is the optional name of the document field holding the modification time
+	TimeField string
+	// BaseQuery is the optional base query of every tile search, which the tile bounds and
+	// request-time filters are ANDed with
+	BaseQuery elastic.Query
+	// IncludeScore configures the source to add each hit's relevance score as a property
+	IncludeScore bool
+	// scoredQuery is set for the requests whose "q" query scores the hits (see IncludeScore)
+	scoredQuery bool
+	// SearchParams are the supported extra parameters passed through to every tile search
+	SearchParams map[string]interface{}
+	// IDProperty is the name of the feature property holding the document ID, where an empty
+	// name means DefaultIDProperty
+	IDProperty string
+	// SourceExcludes is the optional list of document fields excluded from the document source
+	SourceExcludes []string
+	// IndexedShape optionally configures the pre-indexed shapes of IndexedShapeArg requests
+	IndexedShape *ElasticsearchIndexedShapeConfig
+	// PreciseIntegers configures the source to decode document source integers exactly
+	PreciseIntegers bool
 }
 
 // Dict is a type alias for map[string]interface{} that cleans up literals and also adds
@@ -67,24 +201,316 @@ func (d *Dict) Map() map[string]interface{} {
 	return *d
 }
 
+// Validate checks that the ElasticsearchConfig is well-formed, without connecting to the cluster
+func (c *ElasticsearchConfig) Validate() error {
+	if c.Index == "" {
+		return errors.New("Elasticsearch sources must have an \"index\" configured")
+	}
+	if c.CloudID != "" {
+		if c.Host != "" || c.Port != 0 {
+			return errors.New("Only one of cloudId and host/port can be configured")
+		}
+		if _, err := parseCloudID(c.CloudID); err != nil {
+			return err
+		}
+	}
+	if c.GeometryField == "" && !c.AutoDetectGeometry {
+		return errors.New("Elasticsearch sources must have a \"geometryField\" configured")
+	}
+	if c.GeometryField != "" && c.AutoDetectGeometry {
+		return errors.New("Only one of geometryField and autoDetectGeometry can be configured")
+	}
+	if c.GeometryField != "" {
+		for _, part := range strings.Split(c.GeometryField, ".") {
+			if part == "" {
+				return fmt.Errorf("The geometryField %s can't have empty path parts", c.GeometryField)
+			}
+		}
+	}
+	if (c.LatField == "") != (c.LonField == "") {
+		return errors.New("Both latField and lonField must be set to use point coordinates")
+	}
+	if c.BaseQueryFile != "" && c.SearchTemplate != nil {
+		return errors.New("Only one of baseQueryFile and searchTemplate can be configured")
+	}
+	if c.IndexedShape != nil && c.IndexedShape.Index == "" {
+		return errors.New("The indexedShape must have an \"index\" configured")
+	}
+	if err := c.validateSourceExcludes(); err != nil {
+		return err
+	}
+	if c.BaseQueryFile != "" {
+		body, err := ioutil.ReadFile(c.BaseQueryFile)
+		if err != nil {
+			return err
+		}
+		if _, err := parseBaseQuery(body); err != nil {
+			return fmt.Errorf("Invalid baseQueryFile %s: %v", c.BaseQueryFile, err)
+		}
+	}
+	return validateSearchParams(c.SearchParams)
+}
+
+// validateSourceExcludes checks that the GeometryField isn't excluded from the document source
+func (c *ElasticsearchConfig) validateSourceExcludes() error {
+	if c.GeometryField == "" {
+		return nil
+	}
+	for _, field := range c.SourceExcludes {
+		if fieldPath(field) == fieldPath(c.GeometryField) {
+			return fmt.Errorf("The geometryField %s can't be excluded from the document source", c.GeometryField)
+		}
+	}
+	return nil
+}
+
 // NewElasticsearchSource creates a new Source that retrieves feature data from an
 // Elasticsearch cluster
 func NewElasticsearchSource(config *ElasticsearchConfig) (Source, error) {
-	es, err := elastic.NewClient(
-		elastic.SetURL(fmt.Sprintf("http://%s:%d", config.Host, config.Port)),
-		elastic.SetGzip(true),
-		// TODO: Should this be configurable?
-		elastic.SetHealthcheckTimeoutStartup(10*time.Second),
-	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	es, err := sharedElasticsearchClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.AutoDetectGeometry {
+		field, err := detectGeometryField(context.Background(), es, config.Index)
+		if err != nil {
+			return nil, err
+		}
+		Logger.Infof("Detected geometry field [%s] of index [%s]", field, config.Index)
+		detected := *config
+		detected.GeometryField = field
+		config = &detected
+		if err := config.validateSourceExcludes(); err != nil {
+			return nil, err
+		}
+	}
+	baseQuery, err := loadBaseQuery(context.Background(), es, config)
+	if err != nil {
+		return nil, err
+	}
+	source := &ElasticsearchSource{
+		ES:                  es,
+		Index:               config.Index,
+		GeometryField:       config.GeometryField,
+		LatField:            config.LatField,
+		LonField:            config.LonField,
+		SourceFields:        config.SourceFields,
+		TrackTotalHits:      config.TrackTotalHits,
+		FeatureMinzoomField: config.FeatureMinzoomField,
+		GeometryOnly:        config.GeometryOnly,
+		DocValueFields:      config.DocValueFields,
+		QueryTimeout:        config.QueryTimeout,
+		TimeField:           config.TimeField,
+		BaseQuery:           baseQuery,
+		IncludeScore:        config.IncludeScore,
+		SearchParams:        supportedSearchParams(config.SearchParams),
+		IDProperty:          config.IDProperty,
+		SourceExcludes:      config.SourceExcludes,
+		IndexedShape:        config.IndexedShape,
+		PreciseIntegers:     config.PreciseIntegers,
+	}
+	if _, mapped := source.SourceFields[source.idProperty()]; mapped && !source.GeometryOnly {
+		Logger.Warnf("Source field mapped to the [%s] property of index [%s] takes precedence over the document ID", source.idProperty(), source.Index)
+	}
+	return source, nil
+}
+
+// detectGeometryField introspects the mapping of the index (or of every index matched by an
+// alias or pattern) for its single geo field. Since tiles are queried with geo_shape queries,
+// the field must be mapped as a geo_shape.
+func detectGeometryField(ctx context.Context, es *elastic.Client, index string) (string, error) {
+	mappings, err := es.GetMapping().Index(index).Do(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get the mapping of index %s: %v", index, err)
+	}
+	fields := make(map[string]string)
+	for _, mapping := range mappings {
+		if m, isMap := mapping.(map[string]interface{}); isMap {
+			collectGeoFields(m, "", fields)
+		}
+	}
+	if len(fields) != 1 {
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("Expected a single geo field in the mapping of index %s to auto-detect, found %d %v", index, len(fields), names)
+	}
+	for name, fieldType := range fields {
+		if fieldType != "geo_shape" {
+			return "", fmt.Errorf("The detected geometry field %s of index %s must be a geo_shape, not a %s", name, index, fieldType)
+		}
+		return name, nil
+	}
+	return "", nil
+}
+
+// collectGeoFields recursively collects the (dotted) paths and types of the geo_shape and
+// geo_point fields of a mapping, which may be nested under mapping types (before
+// Elasticsearch 7) and object fields
+func collectGeoFields(mapping map[string]interface{}, prefix string, fields map[string]string) {
+	properties, hasProperties := mapping["properties"].(map[string]interface{})
+	if !hasProperties {
+		// Descend into the "mappings" and the mapping types
+		for _, child := range mapping {
+			if m, isMap := child.(map[string]interface{}); isMap {
+				collectGeoFields(m, prefix, fields)
+			}
+		}
+		return
+	}
+	for name, property := range properties {
+		field, isMap := property.(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		switch field["type"] {
+		case "geo_shape", "geo_point":
+			fields[prefix+name] = field["type"].(string)
+		default:
+			if _, isObject := field["properties"]; isObject {
+				collectGeoFields(field, prefix+name+".", fields)
+			}
+		}
+	}
+}
+
+var (
+	// esClients holds the Elasticsearch clients shared by the sources of the same cluster,
+	// keyed by the cluster URL and API key
+	esClients   = make(map[string]*elastic.Client)
+	esClientsMu sync.Mutex
+	// newElasticsearchClient creates the client of a cluster, and can be overridden for testing
+	newElasticsearchClient = func(url string, options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+		return elastic.NewClient(append([]elastic.ClientOptionFunc{
+			elastic.SetURL(url),
+			elastic.SetGzip(true),
+			// TODO: Should this be configurable?
+			elastic.SetHealthcheckTimeoutStartup(10 * time.Second),
+		}, options...)...)
+	}
+)
+
+// sharedElasticsearchClient returns the client of the configured cluster, creating it for the
+// first source of the cluster, so that layers of the same cluster (and credentials) share its
+// connections (and sniffing/health checks)
+func sharedElasticsearchClient(config *ElasticsearchConfig) (*elastic.Client, error) {
+	url := fmt.Sprintf("http://%s:%d", config.Host, config.Port)
+	var options []elastic.ClientOptionFunc
+	if config.CloudID != "" {
+		var err error
+		if url, err = parseCloudID(config.CloudID); err != nil {
+			return nil, err
+		}
+		// The nodes of Elastic Cloud clusters are only reachable through the cloud endpoint
+		options = append(options, elastic.SetSniff(false))
+	}
+	key := url
+	if config.APIKey != "" {
+		header := http.Header{}
+		header.Set("Authorization", "ApiKey "+encodeAPIKey(config.APIKey))
+		options = append(options, elastic.SetHeaders(header))
+		key += "#" + config.APIKey
+	}
+
+	esClientsMu.Lock()
+	defer esClientsMu.Unlock()
+	if es, exists := esClients[key]; exists {
+		return es, nil
+	}
+	es, err := newElasticsearchClient(url, options...)
 	if err != nil {
 		return nil, err
 	}
-	return &ElasticsearchSource{
-		ES:            es,
-		Index:         config.Index,
-		GeometryField: config.GeometryField,
-		SourceFields:  config.SourceFields,
-	}, nil
+	esClients[key] = es
+	return es, nil
+}
+
+// parseCloudID decodes the HTTPS endpoint of the Elasticsearch cluster of an Elastic Cloud
+// deployment from its cloud ID, which is formatted as "<name>:<base64 data>", where the data
+// holds the "$"-separated domain (with an optional port) and the Elasticsearch and Kibana UUIDs
+func parseCloudID(cloudID string) (string, error) {
+	invalid := fmt.Errorf("Invalid Elasticsearch cloudId: %s", cloudID)
+	encoded := cloudID[strings.LastIndex(cloudID, ":")+1:]
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", invalid
+	}
+	parts := strings.Split(string(data), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", invalid
+	}
+	domain, port := parts[0], ""
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		domain, port = domain[:i], domain[i:]
+	}
+	return fmt.Sprintf("https://%s.%s%s", parts[1], domain, port), nil
+}
+
+// encodeAPIKey returns the base64 encoding of an "id:api_key" API key, or the API key itself if
+// it is already encoded
+func encodeAPIKey(apiKey string) string {
+	if strings.Contains(apiKey, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(apiKey))
+	}
+	return apiKey
+}
+
+const (
+	// ScoreProperty is the feature property holding the hit's relevance score, see IncludeScore
+	ScoreProperty = "_score"
+	// DefaultIDProperty is the default feature property holding the document ID
+	DefaultIDProperty = "id"
+)
+
+// loadBaseQuery loads the optional base query of the source, either from the BaseQueryFile or
+// by rendering the stored SearchTemplate (Validate ensures that only one of them is configured)
+func loadBaseQuery(ctx context.Context, es *elastic.Client, config *ElasticsearchConfig) (elastic.Query, error) {
+	if config.BaseQueryFile != "" {
+		body, err := ioutil.ReadFile(config.BaseQueryFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseBaseQuery(body)
+	}
+	if config.SearchTemplate != nil {
+		res, err := es.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   "/_render/template",
+			Body: map[string]interface{}{
+				"id":     config.SearchTemplate.ID,
+				"params": config.SearchTemplate.Params,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not render search template [%s]: %v", config.SearchTemplate.ID, err)
+		}
+		var rendered struct {
+			TemplateOutput json.RawMessage `json:"template_output"`
+		}
+		if err := json.Unmarshal(res.Body, &rendered); err != nil {
+			return nil, err
+		}
+		return parseBaseQuery(rendered.TemplateOutput)
+	}
+	return nil, nil
+}
+
+// parseBaseQuery parses a JSON Elasticsearch query, which is either a query object or a search
+// body whose "query" key holds the query object
+func parseBaseQuery(body []byte) (elastic.Query, error) {
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("Invalid base query: %v", err)
+	}
+	if query, exists := parsed["query"]; exists {
+		body = query
+	}
+	return elastic.NewRawStringQuery(string(body)), nil
 }
 
 // Create a new ElasticsearchSource from the input object, but adds extra SourceFields
@@ -97,12 +523,9 @@ func (e *ElasticsearchSource) withExtraFields(extraFields map[string]string) *El
 	for k, v := range extraFields {
 		sourceFields[k] = v
 	}
-	return &ElasticsearchSource{
-		ES:            e.ES,
-		Index:         e.Index,
-		GeometryField: e.GeometryField,
-		SourceFields:  sourceFields,
-	}
+	clone := *e
+	clone.SourceFields = sourceFields
+	return &clone
 }
 
 // GetFeatures implements the Source interface, to get feature data from an
@@ -114,35 +537,231 @@ func (e *ElasticsearchSource) GetFeatures(ctx context.Context, req *TileRequest)
 
 // getSourceFields returns the list of source fields to include in the fetched features
 func (e *ElasticsearchSource) getSourceFields() []string {
-	fields := []string{e.GeometryField}
+	fields := []string{fieldPath(e.GeometryField)}
+	if e.hasLatLonFields() {
+		fields = append(fields, fieldPath(e.LatField), fieldPath(e.LonField))
+	}
+	if e.GeometryOnly || e.DocValueFields {
+		return fields
+	}
 	for _, v := range e.SourceFields {
-		fields = append(fields, v)
+		fields = append(fields, fieldPath(v))
 	}
 	return fields
 }
 
+// allSourceFields returns whether or not every (non-excluded) top-level document field is
+// returned as a feature property, which is the case for sources with SourceExcludes but without
+// SourceFields
+func (e *ElasticsearchSource) allSourceFields() bool {
+	return len(e.SourceExcludes) > 0 && len(e.SourceFields) == 0 && !e.GeometryOnly
+}
+
 // newSearchSource constructs a full Elasticsearch request body from a given query and
 // adds document source inclusions/exclusions
 func (e *ElasticsearchSource) newSearchSource(query elastic.Query) *elastic.SearchSource {
 	includes := e.getSourceFields()
-	// TODO: Do we need to do anything fancier here?
-	excludes := []string{}
-	return elastic.NewSearchSource().
+	if e.allSourceFields() {
+		includes = nil
+	}
+	excludes := make([]string, len(e.SourceExcludes))
+	for i, field := range e.SourceExcludes {
+		excludes[i] = fieldPath(field)
+	}
+	ss := elastic.NewSearchSource().
 		FetchSourceIncludeExclude(includes, excludes).
 		Query(query)
+	if e.DocValueFields && !e.GeometryOnly {
+		for _, v := range e.SourceFields {
+			ss = ss.DocvalueField(v)
+		}
+	}
+	if e.TrackTotalHits != nil {
+		ss = ss.TrackTotalHits(*e.TrackTotalHits)
+	}
+	if e.QueryTimeout > 0 {
+		ss = ss.TimeoutInMillis(int(e.QueryTimeout / time.Millisecond))
+	}
+	for k, v := range e.SearchParams {
+		if apply, exists := searchSourceParams[k]; exists {
+			// The values were already checked by validateSearchParams
+			apply(ss, v)
+		}
+	}
+	return ss
+}
+
+// newScroll constructs the scrolled search of the request body, with the optional search
+// parameters passed in the URL
+func (e *ElasticsearchSource) newScroll(ss *elastic.SearchSource) *elastic.ScrollService {
+	scroll := e.ES.Scroll(e.Index).SearchSource(ss).Size(ScrollSize)
+	for k, v := range e.SearchParams {
+		if apply, exists := scrollParams[k]; exists {
+			apply(scroll, v)
+		}
+	}
+	return scroll
+}
+
+// searchSourceParams are the SearchParams that are set in the search request body
+var searchSourceParams = map[string]func(*elastic.SearchSource, interface{}) error{
+	"terminate_after": func(ss *elastic.SearchSource, v interface{}) error {
+		n, err := intParam(v)
+		ss.TerminateAfter(n)
+		return err
+	},
+	"min_score": func(ss *elastic.SearchSource, v interface{}) error {
+		n, err := floatParam(v)
+		ss.MinScore(n)
+		return err
+	},
+	"track_scores": func(ss *elastic.SearchSource, v interface{}) error {
+		b, err := boolParam(v)
+		ss.TrackScores(b)
+		return err
+	},
+	"version": func(ss *elastic.SearchSource, v interface{}) error {
+		b, err := boolParam(v)
+		ss.Version(b)
+		return err
+	},
+}
+
+// scrollParams are the SearchParams that are set in the search request URL
+var scrollParams = map[string]func(*elastic.ScrollService, interface{}) error{
+	"preference": func(s *elastic.ScrollService, v interface{}) error {
+		str, err := stringParam(v)
+		s.Preference(str)
+		return err
+	},
+	"routing": func(s *elastic.ScrollService, v interface{}) error {
+		str, err := stringParam(v)
+		s.Routing(str)
+		return err
+	},
+	"ignore_unavailable": func(s *elastic.ScrollService, v interface{}) error {
+		b, err := boolParam(v)
+		s.IgnoreUnavailable(b)
+		return err
+	},
+	"allow_no_indices": func(s *elastic.ScrollService, v interface{}) error {
+		b, err := boolParam(v)
+		s.AllowNoIndices(b)
+		return err
+	},
+	"expand_wildcards": func(s *elastic.ScrollService, v interface{}) error {
+		str, err := stringParam(v)
+		s.ExpandWildcards(str)
+		return err
+	},
+}
+
+// validateSearchParams checks the values of the supported search parameters, by applying them
+// to throwaway requests
+func validateSearchParams(params map[string]interface{}) error {
+	ss, scroll := elastic.NewSearchSource(), elastic.NewScrollService(nil)
+	for k, v := range params {
+		var err error
+		if apply, exists := searchSourceParams[k]; exists {
+			err = apply(ss, v)
+		} else if apply, exists := scrollParams[k]; exists {
+			err = apply(scroll, v)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid Elasticsearch search parameter %s: %v", k, err)
+		}
+	}
+	return nil
 }
 
-// boundsFilter converts an XYZ map tile into an Elasticsearch-friendly geo_shape query
+// supportedSearchParams returns the search parameters that can be passed through, warning
+// about (and dropping) any others
+func supportedSearchParams(params map[string]interface{}) map[string]interface{} {
+	supported := make(map[string]interface{})
+	for k, v := range params {
+		_, source := searchSourceParams[k]
+		_, scroll := scrollParams[k]
+		if !source && !scroll {
+			Logger.Warnf("Ignoring unsupported Elasticsearch search parameter: %s", k)
+			continue
+		}
+		supported[k] = v
+	}
+	return supported
+}
+
+// intParam converts a search parameter value into an int
+func intParam(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		if n == math.Trunc(n) {
+			return int(n), nil
+		}
+	case string:
+		return strconv.Atoi(n)
+	}
+	return 0, fmt.Errorf("Value is not an integer: %v", v)
+}
+
+// floatParam converts a search parameter value into a float64
+func floatParam(v interface{}) (float64, error) {
+	if n, ok := v.(int); ok {
+		return float64(n), nil
+	}
+	return toFloat(v, true)
+}
+
+// boolParam converts a search parameter value into a bool
+func boolParam(v interface{}) (bool, error) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		return strconv.ParseBool(b)
+	}
+	return false, fmt.Errorf("Value is not a boolean: %v", v)
+}
+
+// stringParam converts a search parameter value into a string
+func stringParam(v interface{}) (string, error) {
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	return "", fmt.Errorf("Value is not a string: %v", v)
+}
+
+// boundsFilter converts an XYZ map tile into an Elasticsearch-friendly geo_shape query.
+// If the tile bounds cross the antimeridian, the envelope is split in two and either half
+// may match.
 func boundsFilter(geometryField string, tile maptile.Tile) *Dict {
-	tileBounds := tile.Bound()
+	bounds := splitAntimeridian(tile.Bound())
+	if len(bounds) == 1 {
+		return envelopeFilter(geometryField, bounds[0])
+	}
+	var should []interface{}
+	for _, b := range bounds {
+		should = append(should, envelopeFilter(geometryField, b))
+	}
+	return &Dict{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+// envelopeFilter creates a geo_shape intersection query for a single rectangular bound
+func envelopeFilter(geometryField string, bound orb.Bound) *Dict {
 	return &Dict{
 		"geo_shape": map[string]interface{}{
 			geometryField: map[string]interface{}{
 				"shape": map[string]interface{}{
 					"type": "envelope",
 					"coordinates": [][]float64{
-						{tileBounds.Left(), tileBounds.Top()},
-						{tileBounds.Right(), tileBounds.Bottom()},
+						{bound.Left(), bound.Top()},
+						{bound.Right(), bound.Bottom()},
 					},
 				},
 				"relation": "intersects",
@@ -151,6 +770,99 @@ func boundsFilter(geometryField string, tile maptile.Tile) *Dict {
 	}
 }
 
+// geometryFilter creates a geo_shape intersection query for an arbitrary geometry
+func geometryFilter(geometryField string, geom orb.Geometry) *Dict {
+	return &Dict{
+		"geo_shape": map[string]interface{}{
+			geometryField: map[string]interface{}{
+				"shape":    geojson.NewGeometry(geom),
+				"relation": "intersects",
+			},
+		},
+	}
+}
+
+// IndexedShapeArg is the request parameter for clipping Elasticsearch layers to the
+// pre-indexed shape with the given document ID, see ElasticsearchIndexedShapeConfig. Layers
+// without a configured IndexedShape ignore it.
+const IndexedShapeArg = "shape"
+
+// indexedShapeArg returns the optional IndexedShapeArg request argument
+func (t *TileRequest) indexedShapeArg() string {
+	values := t.Args[IndexedShapeArg]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// indexedShapeFilter creates a geo_shape intersection query for a pre-indexed shape, which
+// Elasticsearch looks up by its document ID rather than receiving the shape in the query
+func indexedShapeFilter(geometryField string, config *ElasticsearchIndexedShapeConfig, id string) *Dict {
+	shape := map[string]interface{}{
+		"index": config.Index,
+		"id":    id,
+	}
+	if config.Type != "" {
+		shape["type"] = config.Type
+	}
+	if config.Path != "" {
+		shape["path"] = config.Path
+	}
+	return &Dict{
+		"geo_shape": map[string]interface{}{
+			geometryField: map[string]interface{}{
+				"indexed_shape": shape,
+				"relation":      "intersects",
+			},
+		},
+	}
+}
+
+// termQueries creates the term queries of the mandatory term filters of the request
+func termQueries(req *TileRequest) []elastic.Query {
+	var queries []elastic.Query
+	for _, field := range req.termFields() {
+		queries = append(queries, elastic.NewTermQuery(field, req.Terms[field]))
+	}
+	return queries
+}
+
+// minzoomFilter creates a query that matches documents whose minimum zoom level is at or below
+// the given zoom, or that don't have a minimum zoom level at all
+func minzoomFilter(minzoomField string, z int) elastic.Query {
+	return elastic.NewBoolQuery().
+		Should(
+			elastic.NewRangeQuery(minzoomField).Lte(z),
+			elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(minzoomField)),
+		).
+		MinimumNumberShouldMatch(1)
+}
+
+// splitAntimeridian splits a bound that wraps around the antimeridian (either because
+// left > right, or because it extends past +/-180 degrees longitude) into the two bounds
+// on either side of it. Bounds that don't cross the antimeridian are returned as-is.
+func splitAntimeridian(bound orb.Bound) []orb.Bound {
+	left, right := bound.Left(), bound.Right()
+	bottom, top := bound.Bottom(), bound.Top()
+	if right-left >= 360 {
+		return []orb.Bound{{Min: orb.Point{-180, bottom}, Max: orb.Point{180, top}}}
+	}
+	if left < -180 {
+		left += 360
+	}
+	if right > 180 {
+		right -= 360
+	}
+	if left <= right {
+		return []orb.Bound{{Min: orb.Point{left, bottom}, Max: orb.Point{right, top}}}
+	}
+	return []orb.Bound{
+		{Min: orb.Point{left, bottom}, Max: orb.Point{180, top}},
+		{Min: orb.Point{-180, bottom}, Max: orb.Point{right, top}},
+	}
+}
+
 // Given the list of extra source arguments that were specified with request, transform
 // these into a map of property name to ES document source path, or return an error
 // if there is a malformed extra source argument.
@@ -168,13 +880,95 @@ func makeFieldMap(incArgs []string) (map[string]string, error) {
 	return result, nil
 }
 
+// lastModifiedAgg is the name of the max aggregation that computes the latest TimeField value
+// of the documents within the tile bounds
+const lastModifiedAgg = "last_modified"
+
+// LastModified implements the LastModifiedSource interface, returning the latest TimeField
+// value of the documents within the tile bounds (or a zero time when TimeField isn't
+// configured). Request-time "q" filters are ignored, since the latest modification time of
+// all documents within the bounds is still a valid (if conservative) bound. Note that this
+// issues a (size 0) aggregation search for every tile request, including the ones served from
+// the tile cache, so TimeField should be a doc-value field that is cheap to aggregate on.
+func (e *ElasticsearchSource) LastModified(ctx context.Context, req *TileRequest) (time.Time, error) {
+	if e.TimeField == "" {
+		return time.Time{}, nil
+	}
+	query := elastic.NewBoolQuery().Filter(boundsFilter(fieldPath(e.GeometryField), req.MapTile()))
+	if e.BaseQuery != nil {
+		query = query.Filter(e.BaseQuery)
+	}
+	query = query.Filter(termQueries(req)...)
+	results, err := e.ES.Search(e.Index).
+		Query(query).
+		Size(0).
+		Aggregation(lastModifiedAgg, elastic.NewMaxAggregation().Field(e.TimeField)).
+		Do(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	max, found := results.Aggregations.Max(lastModifiedAgg)
+	if !found || max.Value == nil {
+		return time.Time{}, nil
+	}
+	// Elasticsearch represents dates as milliseconds since the epoch
+	return time.Unix(0, int64(*max.Value)*int64(time.Millisecond)).UTC(), nil
+}
+
 // doGetFeatures scrolls the configured Elasticsearch index for all documents that fall
 // within the tile boundaries
 func (e *ElasticsearchSource) doGetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
 	// Check for optional ES query argument.
-	var query = elastic.NewBoolQuery().Filter(boundsFilter(e.GeometryField, req.MapTile()))
+	var query = elastic.NewBoolQuery().Filter(boundsFilter(fieldPath(e.GeometryField), req.MapTile()))
 	if qs, exists := req.Args["q"]; exists && len(qs) > 0 { // TODO: We ignore all but the first "q" arg.
-		query = query.Filter(elastic.NewQueryStringQuery(qs[0]))
+		if e.IncludeScore {
+			// Score the hits by the query, so that their _score reflects it
+			query = query.Must(elastic.NewQueryStringQuery(qs[0]))
+			scored := *e
+			scored.scoredQuery = true
+			e = &scored
+		} else {
+			query = query.Filter(elastic.NewQueryStringQuery(qs[0]))
+		}
+	}
+
+	// Only include the features of the request's scope
+	query = query.Filter(termQueries(req)...)
+
+	// AND in the optional base query, as a scoring clause so that its relevance is retained
+	if e.BaseQuery != nil {
+		query = query.Must(e.BaseQuery)
+	}
+
+	// Only include features that are visible at the requested zoom level
+	if e.FeatureMinzoomField != "" {
+		query = query.Filter(minzoomFilter(e.FeatureMinzoomField, req.Z))
+	}
+
+	// Check for an optional area-of-interest geometry to clip the layer to
+	geom, err := req.geometryArg()
+	if err != nil {
+		return nil, err
+	}
+	if geom != nil {
+		query = query.Filter(geometryFilter(fieldPath(e.GeometryField), geom))
+	}
+
+	// Check for an optional pre-indexed area-of-interest shape to clip the layer to
+	if shape := req.indexedShapeArg(); shape != "" && e.IndexedShape != nil {
+		query = query.Filter(indexedShapeFilter(fieldPath(e.GeometryField), e.IndexedShape, shape))
+	}
+
+	// Only include features that changed after the optional since argument
+	if e.TimeField != "" {
+		since, err := req.sinceArg()
+		if err != nil {
+			return nil, err
+		}
+		if !since.IsZero() {
+			millis := since.UnixNano() / int64(time.Millisecond)
+			query = query.Filter(elastic.NewRangeQuery(e.TimeField).Gt(millis).Format("epoch_millis"))
+		}
 	}
 
 	// Check for extra fields specifications. They must have the form of <property_name>:<ES_document_path>,
@@ -191,21 +985,30 @@ func (e *ElasticsearchSource) doGetFeatures(ctx context.Context, req *TileReques
 
 	ss := e.newSearchSource(query)
 	s, _ := ss.Source()
-	Logger.Debugf("Search source: %#v", s)
+	RequestLogger(ctx).Debugf("Search source: %#v", s)
 
 	fc := geojson.NewFeatureCollection()
-	scroll := e.ES.Scroll(e.Index).SearchSource(ss).Size(ScrollSize)
+	scroll := e.newScroll(ss)
+	// Release the scroll context on the cluster as soon as the features are fetched, instead
+	// of leaving it open until it expires
+	defer clearScroll(ctx, scroll)
+	Metrics.Add(e.metricName("searches"), 1)
+	Metrics.Add(e.metricName("scrolls_active"), 1)
+	defer Metrics.Add(e.metricName("scrolls_active"), -1)
 	for {
-		scrollCtx, scrollCancel := context.WithTimeout(ctx, ScrollTimeout)
-		defer scrollCancel()
-		results, err := scroll.Do(scrollCtx)
+		results, err := nextScrollPage(ctx, scroll)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		Logger.Tracef("Scrolling %d hits", len(results.Hits.Hits))
+		e.recordScrollPage(results)
+		if results.TimedOut {
+			RequestLogger(ctx).Warnf("Elasticsearch query on index [%s] timed out, returning partial results", e.Index)
+			req.MarkPartial()
+		}
+		RequestLogger(ctx).Tracef("Scrolling %d hits", len(results.Hits.Hits))
 		for _, hit := range results.Hits.Hits {
 			feat, err := e.HitToFeature(hit)
 			if err != nil {
@@ -213,41 +1016,82 @@ func (e *ElasticsearchSource) doGetFeatures(ctx context.Context, req *TileReques
 			}
 			fc.Append(feat)
 		}
-		scrollCancel()
 	}
 	return fc, nil
 }
 
+// metricName returns the name of one of the source's metrics in the Metrics map, which is
+// "elasticsearch_<layer>_<name>"
+func (e *ElasticsearchSource) metricName(name string) string {
+	label := e.Layer
+	if label == "" {
+		label = e.Index
+	}
+	return "elasticsearch_" + label + "_" + name
+}
+
+// recordScrollPage updates the source's metrics with a fetched page of scroll results: the
+// number of pages, the number of hits and the size of their document sources (in bytes). The
+// ratio of pages to searches is the average number of scroll pages per tile.
+func (e *ElasticsearchSource) recordScrollPage(results *elastic.SearchResult) {
+	var size int
+	for _, hit := range results.Hits.Hits {
+		if hit.Source != nil {
+			size += len(*hit.Source)
+		}
+	}
+	Metrics.Add(e.metricName("scroll_pages"), 1)
+	Metrics.Add(e.metricName("hits"), int64(len(results.Hits.Hits)))
+	Metrics.Add(e.metricName("bytes"), int64(size))
+}
+
+// nextScrollPage fetches the next page of results of the scroll, bounded by the ScrollTimeout
+func nextScrollPage(ctx context.Context, scroll *elastic.ScrollService) (*elastic.SearchResult, error) {
+	scrollCtx, scrollCancel := context.WithTimeout(ctx, ScrollTimeout)
+	defer scrollCancel()
+	return scroll.Do(scrollCtx)
+}
+
+// clearScroll releases the scroll context on the cluster. The scroll is cleared even if the
+// request was canceled, since that's exactly when the scroll would otherwise be left open.
+func clearScroll(ctx context.Context, scroll *elastic.ScrollService) {
+	clearCtx, clearCancel := context.WithTimeout(context.Background(), ScrollTimeout)
+	defer clearCancel()
+	if err := scroll.Clear(clearCtx); err != nil {
+		RequestLogger(ctx).Debugf("Could not clear scroll: %v", err)
+	}
+}
+
 // HitToFeature converts an Elasticsearch hit object into a GeoJSON feature, by
 // using the hit's geometry as the feature geometry, and mapping all other requested
 // source fields to feature properties
 func (e *ElasticsearchSource) HitToFeature(hit *elastic.SearchHit) (*geojson.Feature, error) {
 	id := hit.Id
-	var source map[string]interface{}
-	err := json.Unmarshal(*hit.Source, &source)
+	source, err := e.decodeSource(*hit.Source)
 	if err != nil {
 		return nil, err
 	}
-	// Extract geometry value (potentially nested in the source)
-	geometryFieldParts := strings.Split(e.GeometryField, ".")
-	numParts := len(geometryFieldParts)
-	lastPart := geometryFieldParts[numParts-1]
-	parent, found := GetNested(source, geometryFieldParts[0:numParts-1])
-	if !found {
-		return nil, fmt.Errorf("Couldn't find geometry at field: %s", e.GeometryField)
-	}
-	parentMap := parent.(map[string]interface{})
-	geometry := parentMap[lastPart]
-	// Remove geometry from source to avoid sending extra data
-	delete(parentMap, lastPart)
-	gj, _ := json.Marshal(geometry)
-	geom, _ := geojson.UnmarshalGeometry(gj)
-	feat := geojson.NewFeature(geom.Geometry())
+	geom, err := e.extractGeometry(source)
+	if err != nil {
+		return nil, err
+	}
+	feat := geojson.NewFeature(geom)
 	feat.ID = id
 	feat.Properties = make(map[string]interface{})
+	if e.GeometryOnly {
+		return feat, nil
+	}
+	if e.allSourceFields() {
+		// Populate the feature with the other top-level source fields
+		for field, val := range source {
+			if !e.isGeometryField(field) {
+				feat.Properties[field] = val
+			}
+		}
+	}
 	// Populate the feature with the mapped source fields
 	for prop, fieldName := range e.SourceFields {
-		val, found := GetNested(source, strings.Split(fieldName, "."))
+		val, found := e.fieldValue(hit, source, fieldName)
 		if found {
 			if val != nil {
 				feat.Properties[prop] = val
@@ -256,11 +1100,174 @@ func (e *ElasticsearchSource) HitToFeature(hit *elastic.SearchHit) (*geojson.Fea
 			}
 		}
 	}
-	feat.Properties["id"] = id
+	// Scores are constant for the default filter-only query, so don't bother including them
+	if e.IncludeScore && (e.BaseQuery != nil || e.scoredQuery) && hit.Score != nil {
+		feat.Properties[ScoreProperty] = *hit.Score
+	}
+	// Don't overwrite a mapped source field of the same name with the document ID
+	if _, mapped := e.SourceFields[e.idProperty()]; !mapped {
+		feat.Properties[e.idProperty()] = id
+	}
 	return feat, nil
 }
 
-// GetNested is a utility function to traverse a path of keys in a nested JSON object
+// decodeSource decodes the document source of a hit, optionally decoding integers exactly
+func (e *ElasticsearchSource) decodeSource(raw []byte) (map[string]interface{}, error) {
+	var source map[string]interface{}
+	if !e.PreciseIntegers {
+		err := json.Unmarshal(raw, &source)
+		return source, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&source); err != nil {
+		return nil, err
+	}
+	return preciseNumbers(source).(map[string]interface{}), nil
+}
+
+// preciseNumbers recursively converts the json.Number values of a decoded JSON value into
+// int64 or uint64 values if they are integers that fit, and into float64 values otherwise, so
+// that all other code (and the tile encoders) keep dealing with plain numeric types
+func preciseNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = preciseNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = preciseNumbers(child)
+		}
+	}
+	return v
+}
+
+// isGeometryField returns whether or not the top-level document field holds (part of) the
+// feature geometry
+func (e *ElasticsearchSource) isGeometryField(field string) bool {
+	for _, path := range []string{e.GeometryField, e.LatField, e.LonField} {
+		if path != "" && strings.Split(path, ".")[0] == field {
+			return true
+		}
+	}
+	return false
+}
+
+// idProperty returns the name of the feature property holding the document ID
+func (e *ElasticsearchSource) idProperty() string {
+	if e.IDProperty == "" {
+		return DefaultIDProperty
+	}
+	return e.IDProperty
+}
+
+// fieldValue retrieves the value of a mapped source field, either from the document source or
+// from the hit's doc value fields
+func (e *ElasticsearchSource) fieldValue(hit *elastic.SearchHit, source map[string]interface{}, fieldName string) (interface{}, bool) {
+	if !e.DocValueFields {
+		return GetNested(source, strings.Split(fieldName, "."))
+	}
+	val, found := hit.Fields[fieldName]
+	if !found {
+		return nil, false
+	}
+	// Doc values are always returned as arrays, so unwrap single values
+	if values, isArray := val.([]interface{}); isArray && len(values) == 1 {
+		return values[0], true
+	}
+	return val, true
+}
+
+// hasLatLonFields determines whether or not fallback lat/lon fields are configured
+func (e *ElasticsearchSource) hasLatLonFields() bool {
+	return e.LatField != "" && e.LonField != ""
+}
+
+// extractGeometry pulls the feature geometry out of the document source, removing it
+// from the source to avoid sending extra data. If the document has no geometry and
+// fallback lat/lon fields are configured, a point geometry is constructed from those.
+func (e *ElasticsearchSource) extractGeometry(source map[string]interface{}) (orb.Geometry, error) {
+	// Extract geometry value (potentially nested in the source)
+	parent, lastPart, found := e.geometryParent(source)
+	if found {
+		var geometry interface{}
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			geometry = p[lastPart]
+			// Remove geometry from source to avoid sending extra data
+			delete(p, lastPart)
+		case []interface{}:
+			// The geometry may also be an element of an array (e.g. "shapes.0")
+			geometry, _ = GetNested(p, []string{lastPart})
+		}
+		if geometry != nil {
+			gj, _ := json.Marshal(geometry)
+			geom, err := geojson.UnmarshalGeometry(gj)
+			if err != nil {
+				return nil, err
+			}
+			return geom.Geometry(), nil
+		}
+	}
+	if e.hasLatLonFields() {
+		return e.latLonPoint(source)
+	}
+	return nil, fmt.Errorf("Couldn't find geometry at field: %s", e.GeometryField)
+}
+
+// geometryParent returns the value holding the GeometryField of the document source, along with
+// the last part of the GeometryField. The parent of a top-level field (e.g. "location") is the
+// source itself, while the parent of a nested field (e.g. "a.b.location") is the object (or
+// array) at its parent path (e.g. "a.b"), if any.
+func (e *ElasticsearchSource) geometryParent(source map[string]interface{}) (interface{}, string, bool) {
+	i := strings.LastIndex(e.GeometryField, ".")
+	if i < 0 {
+		return source, e.GeometryField, true
+	}
+	parent, found := GetNested(source, strings.Split(e.GeometryField[:i], "."))
+	return parent, e.GeometryField[i+1:], found
+}
+
+// latLonPoint constructs a point geometry from the configured lat/lon document fields
+func (e *ElasticsearchSource) latLonPoint(source map[string]interface{}) (orb.Geometry, error) {
+	lat, latErr := toFloat(GetNested(source, strings.Split(e.LatField, ".")))
+	lon, lonErr := toFloat(GetNested(source, strings.Split(e.LonField, ".")))
+	if latErr != nil || lonErr != nil {
+		return nil, fmt.Errorf("Couldn't find geometry at field '%s' or lat/lon at fields '%s'/'%s'",
+			e.GeometryField, e.LatField, e.LonField)
+	}
+	return orb.Point{lon, lat}, nil
+}
+
+// toFloat converts a numeric (or numeric string) JSON value into a float64
+func toFloat(v interface{}, found bool) (float64, error) {
+	if !found {
+		return 0, errors.New("No value found")
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	if f, isNumber := floatValue(v); isNumber {
+		return f, nil
+	}
+	return 0, fmt.Errorf("Value is not numeric: %v", v)
+}
+
+// GetNested is a utility function to traverse a path of keys in a nested JSON object, where
+// numeric keys index into arrays (e.g. "locations.0.shape")
 func GetNested(something interface{}, keyParts []string) (interface{}, bool) {
 	if len(keyParts) == 0 {
 		return something, true
@@ -272,7 +1279,25 @@ func GetNested(something interface{}, keyParts []string) (interface{}, bool) {
 			if found {
 				return GetNested(v, keyParts[1:])
 			}
+		case []interface{}:
+			i, err := strconv.Atoi(keyParts[0])
+			if err == nil && i >= 0 && i < len(m) {
+				return GetNested(m[i], keyParts[1:])
+			}
 		}
 	}
 	return nil, false
 }
+
+// fieldPath converts a document path that may contain array indices (see GetNested) into the
+// Elasticsearch field name, e.g. "locations.0.shape" into "locations.shape"
+func fieldPath(path string) string {
+	parts := strings.Split(path, ".")
+	fieldParts := parts[:0]
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			fieldParts = append(fieldParts, part)
+		}
+	}
+	return strings.Join(fieldParts, ".")
+}
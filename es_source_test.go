@@ -1,8 +1,21 @@
 package tilenol
 
 import (
-	"github.com/paulmach/orb/maptile"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
 )
 
 func TestGetNested(t *testing.T) {
@@ -53,6 +66,117 @@ func floatEquals(a, b float64) bool {
 	return (a-b) < e && (b-a) < e
 }
 
+func TestGetNestedArrays(t *testing.T) {
+	var m map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"locations": [{"shape": "FIRST"}, {"shape": "SECOND", "tags": ["a", "b"]}],
+		"matrix": [[1, 2], [3, 4]]
+	}`), &m)
+	expectations := map[string]interface{}{
+		"locations.0.shape":  "FIRST",
+		"locations.1.shape":  "SECOND",
+		"locations.1.tags.1": "b",
+		"matrix.1.0":         3.0,
+	}
+	for path, expected := range expectations {
+		v, found := GetNested(m, strings.Split(path, "."))
+		if !found {
+			t.Errorf("Couldn't find key: %s", path)
+		}
+		if v != expected {
+			t.Errorf("Invalid value for %s: %+v", path, v)
+		}
+	}
+	for _, path := range []string{"locations.2.shape", "locations.-1.shape", "locations.first.shape", "locations.0.shape.0"} {
+		if v, found := GetNested(m, strings.Split(path, ".")); found {
+			t.Errorf("Shouldn't have found anything for %s: %+v", path, v)
+		}
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	expectations := map[string]string{
+		"geometry":          "geometry",
+		"locations.0.shape": "locations.shape",
+		"matrix.1.0":        "matrix",
+	}
+	for path, expected := range expectations {
+		if actual := fieldPath(path); actual != expected {
+			t.Errorf("Invalid field path for %s: %s (expected = %s)", path, actual, expected)
+		}
+	}
+}
+
+func TestExtractGeometryFieldPaths(t *testing.T) {
+	point := func() map[string]interface{} {
+		return map[string]interface{}{"type": "Point", "coordinates": []interface{}{1.0, 2.0}}
+	}
+	sources := map[string]map[string]interface{}{
+		"location": {"location": point(), "name": "A"},
+		"a.b.location": {"a": map[string]interface{}{
+			"b": map[string]interface{}{"location": point(), "name": "A"},
+		}},
+	}
+	for geometryField, source := range sources {
+		e := &ElasticsearchSource{GeometryField: geometryField}
+		geom, err := e.extractGeometry(source)
+		if err != nil {
+			t.Fatalf("Failed to extract geometry at %s: %v", geometryField, err)
+		}
+		if p, isPoint := geom.(orb.Point); !isPoint || !p.Equal(orb.Point{1, 2}) {
+			t.Errorf("Invalid geometry at %s: %#v", geometryField, geom)
+		}
+		// The geometry is removed from the source, but its siblings are kept
+		parent, _, _ := e.geometryParent(source)
+		if m := parent.(map[string]interface{}); m["location"] != nil || m["name"] != "A" {
+			t.Errorf("Expected only the geometry to be removed at %s: %#v", geometryField, m)
+		}
+	}
+
+	e := &ElasticsearchSource{GeometryField: "a.b.location"}
+	if _, err := e.extractGeometry(map[string]interface{}{"a": "not an object"}); err == nil {
+		t.Errorf("Expected a missing nested geometry to fail")
+	}
+	for _, geometryField := range []string{".location", "location.", "a..location"} {
+		config := &ElasticsearchConfig{Index: "a", GeometryField: geometryField}
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected the geometryField %s to fail validation", geometryField)
+		}
+	}
+}
+
+func TestHitToFeatureArrayGeometry(t *testing.T) {
+	e := &ElasticsearchSource{
+		GeometryField: "locations.1.shape",
+		SourceFields:  map[string]string{"name": "locations.1.name"},
+	}
+	if fields := e.getSourceFields(); fields[0] != "locations.shape" || fields[1] != "locations.name" {
+		t.Errorf("Invalid source fields: %#v", fields)
+	}
+	feat, err := e.HitToFeature(newTestHit("1", `{"locations": [`+
+		`{"shape": {"type": "Point", "coordinates": [1, 2]}, "name": "A"},`+
+		`{"shape": {"type": "Point", "coordinates": [3, 4]}, "name": "B"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if point, isPoint := feat.Geometry.(orb.Point); !isPoint || !point.Equal(orb.Point{3, 4}) {
+		t.Errorf("Invalid geometry: %#v", feat.Geometry)
+	}
+	if feat.Properties["name"] != "B" {
+		t.Errorf("Invalid properties: %#v", feat.Properties)
+	}
+
+	// Geometries can also be array elements themselves
+	e = &ElasticsearchSource{GeometryField: "shapes.0"}
+	feat, err = e.HitToFeature(newTestHit("1", `{"shapes": [{"type": "Point", "coordinates": [5, 6]}]}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if point, isPoint := feat.Geometry.(orb.Point); !isPoint || !point.Equal(orb.Point{5, 6}) {
+		t.Errorf("Invalid geometry: %#v", feat.Geometry)
+	}
+}
+
 func TestGetBoundsFilter(t *testing.T) {
 	geometryField := "geometry"
 	tile := maptile.New(0, 0, 0)
@@ -67,3 +191,766 @@ func TestGetBoundsFilter(t *testing.T) {
 		t.Errorf("Invalid envelope: %#v", coords)
 	}
 }
+
+func TestGetBoundsFilterAntimeridianEdges(t *testing.T) {
+	geometryField := "geometry"
+	z := uint32(3)
+	for _, x := range []uint32{0, 1<<z - 1} {
+		tile := maptile.New(x, 2, maptile.Zoom(z))
+		filter := boundsFilter(geometryField, tile)
+		v, exists := GetNested(filter.Map(), []string{"geo_shape", geometryField, "shape", "coordinates"})
+		if !exists {
+			t.Fatalf("Edge tile %v should use a single envelope: %#v", tile, filter)
+		}
+		coords := v.([][]float64)
+		bound := tile.Bound()
+		if coords[0][0] != bound.Left() || coords[1][0] != bound.Right() {
+			t.Errorf("Invalid envelope for edge tile %v: %#v", tile, coords)
+		}
+		if coords[0][0] < -180.0 || coords[1][0] > 180.0 || coords[0][0] >= coords[1][0] {
+			t.Errorf("Degenerate envelope for edge tile %v: %#v", tile, coords)
+		}
+	}
+}
+
+func TestSplitAntimeridian(t *testing.T) {
+	// A bound straddling the antimeridian, e.g. the x=0 and x=2^z-1 tiles joined together
+	wrapped := orb.Bound{Min: orb.Point{170.0, -10.0}, Max: orb.Point{190.0, 10.0}}
+	bounds := splitAntimeridian(wrapped)
+	if len(bounds) != 2 {
+		t.Fatalf("Expected bound to be split in two, got: %#v", bounds)
+	}
+	if bounds[0].Left() != 170.0 || bounds[0].Right() != 180.0 {
+		t.Errorf("Invalid eastern bound: %#v", bounds[0])
+	}
+	if bounds[1].Left() != -180.0 || !floatEquals(bounds[1].Right(), -170.0) {
+		t.Errorf("Invalid western bound: %#v", bounds[1])
+	}
+
+	filter := boundsFilter("geometry", maptile.New(0, 0, 0))
+	if _, exists := filter.Map()["bool"]; exists {
+		t.Errorf("Whole-world tile should not be split: %#v", filter)
+	}
+}
+
+func TestSplitAntimeridianLeftGreaterThanRight(t *testing.T) {
+	bounds := splitAntimeridian(orb.Bound{Min: orb.Point{175.0, 0.0}, Max: orb.Point{-175.0, 5.0}})
+	if len(bounds) != 2 {
+		t.Fatalf("Expected bound to be split in two, got: %#v", bounds)
+	}
+	if bounds[0].Left() != 175.0 || bounds[1].Right() != -175.0 {
+		t.Errorf("Invalid split bounds: %#v", bounds)
+	}
+}
+
+func newTestHit(id string, source string) *elastic.SearchHit {
+	raw := json.RawMessage(source)
+	return &elastic.SearchHit{Id: id, Index: "test", Source: &raw}
+}
+
+func TestHitToFeatureLatLonFallback(t *testing.T) {
+	e := &ElasticsearchSource{
+		GeometryField: "geometry",
+		LatField:      "location.lat",
+		LonField:      "location.lon",
+	}
+	feat, err := e.HitToFeature(newTestHit("1", `{"location": {"lat": 10.5, "lon": "-20.25"}}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if point, isPoint := feat.Geometry.(orb.Point); !isPoint || point.Lon() != -20.25 || point.Lat() != 10.5 {
+		t.Errorf("Invalid fallback geometry: %#v", feat.Geometry)
+	}
+
+	feat, err = e.HitToFeature(newTestHit("2", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "location": {"lat": 10.5, "lon": -20.25}}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if point := feat.Geometry.(orb.Point); point.Lon() != 1 || point.Lat() != 2 {
+		t.Errorf("Geometry field should take precedence over lat/lon: %#v", feat.Geometry)
+	}
+}
+
+func TestHitToFeatureMissingGeometry(t *testing.T) {
+	e := &ElasticsearchSource{GeometryField: "geometry"}
+	_, err := e.HitToFeature(newTestHit("1", `{"location": {"lat": 10.5, "lon": -20.25}}`))
+	if err == nil {
+		t.Error("Expected to fail without a geometry or lat/lon fields")
+	}
+}
+
+func TestSearchSourceTrackTotalHits(t *testing.T) {
+	e := &ElasticsearchSource{GeometryField: "geometry"}
+	src, _ := e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	if _, exists := src.(map[string]interface{})["track_total_hits"]; exists {
+		t.Errorf("track_total_hits should not be set by default: %#v", src)
+	}
+
+	trackTotalHits := false
+	e.TrackTotalHits = &trackTotalHits
+	src, _ = e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	if v := src.(map[string]interface{})["track_total_hits"]; v != false {
+		t.Errorf("Invalid track_total_hits: %#v", v)
+	}
+}
+
+func TestSearchSourceQueryTimeout(t *testing.T) {
+	e := &ElasticsearchSource{GeometryField: "geometry"}
+	src, _ := e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	if _, exists := src.(map[string]interface{})["timeout"]; exists {
+		t.Errorf("timeout should not be set by default: %#v", src)
+	}
+
+	e.QueryTimeout = 1500 * time.Millisecond
+	src, _ = e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	if v := src.(map[string]interface{})["timeout"]; v != "1500ms" {
+		t.Errorf("Invalid timeout: %#v", v)
+	}
+}
+
+func TestMinzoomFilter(t *testing.T) {
+	src, err := minzoomFilter("label_minzoom", 12).Source()
+	if err != nil {
+		t.Fatalf("Failed to build minzoom filter: %v", err)
+	}
+	v, exists := GetNested(src, []string{"bool", "should"})
+	if !exists {
+		t.Fatalf("Invalid minzoom filter: %#v", src)
+	}
+	should := v.([]interface{})
+	lte, _ := GetNested(should[0], []string{"range", "label_minzoom", "to"})
+	if lte != 12 {
+		t.Errorf("Invalid minzoom range: %#v", should[0])
+	}
+}
+
+func TestHitToFeatureGeometryOnly(t *testing.T) {
+	e := &ElasticsearchSource{
+		GeometryField: "geometry",
+		SourceFields:  map[string]string{"name": "name"},
+		GeometryOnly:  true,
+	}
+	fields := e.getSourceFields()
+	if len(fields) != 1 || fields[0] != "geometry" {
+		t.Errorf("Geometry-only sources should only fetch the geometry: %#v", fields)
+	}
+	feat, err := e.HitToFeature(newTestHit("1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "name": "A"}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if len(feat.Properties) != 0 {
+		t.Errorf("Geometry-only features should not have properties: %#v", feat.Properties)
+	}
+}
+
+func TestHitToFeatureDocValueFields(t *testing.T) {
+	e := &ElasticsearchSource{
+		GeometryField:  "geometry",
+		SourceFields:   map[string]string{"height": "building.height", "tags": "tags"},
+		DocValueFields: true,
+	}
+	src, _ := e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	includes, _ := GetNested(src, []string{"_source", "includes"})
+	if fields, _ := includes.([]string); len(fields) != 1 || fields[0] != "geometry" {
+		t.Errorf("Only the geometry should be fetched from the document source: %#v", src)
+	}
+	if docvalues, _ := src.(map[string]interface{})["docvalue_fields"].([]interface{}); len(docvalues) != 2 {
+		t.Errorf("Source fields should be fetched as doc values: %#v", src)
+	}
+
+	hit := newTestHit("1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}}`)
+	hit.Fields = map[string]interface{}{
+		"building.height": []interface{}{12.5},
+		"tags":            []interface{}{"a", "b"},
+	}
+	feat, err := e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if feat.Properties["height"] != 12.5 {
+		t.Errorf("Invalid single doc value property: %#v", feat.Properties)
+	}
+	if tags, _ := feat.Properties["tags"].([]interface{}); len(tags) != 2 {
+		t.Errorf("Invalid multi doc value property: %#v", feat.Properties)
+	}
+}
+
+func TestLoadBaseQueryFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "base_query*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"query": {"term": {"status": "active"}}}`)
+	f.Close()
+
+	query, err := loadBaseQuery(context.Background(), nil, &ElasticsearchConfig{BaseQueryFile: f.Name()})
+	if err != nil {
+		t.Fatalf("Failed to load base query: %v", err)
+	}
+	src, _ := query.Source()
+	if src.(map[string]interface{})["term"] == nil {
+		t.Errorf("Invalid base query: %#v", src)
+	}
+
+	config := &ElasticsearchConfig{
+		Index:          "buildings",
+		GeometryField:  "geometry",
+		BaseQueryFile:  f.Name(),
+		SearchTemplate: &ElasticsearchSearchTemplateConfig{ID: "active"},
+	}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an error when configuring both a base query file and a search template")
+	}
+
+	if _, err := parseBaseQuery([]byte("not json")); err == nil {
+		t.Error("Expected an error for an invalid base query")
+	}
+}
+
+func TestLoadBaseQuerySearchTemplate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_render/template" {
+			t.Errorf("Unexpected request path: %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["id"] != "active" {
+			t.Errorf("Unexpected search template request: %#v", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"template_output": {"query": {"term": {"status": "active"}}}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := loadBaseQuery(context.Background(), es, &ElasticsearchConfig{
+		SearchTemplate: &ElasticsearchSearchTemplateConfig{
+			ID:     "active",
+			Params: map[string]interface{}{"status": "active"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to render search template: %v", err)
+	}
+	src, _ := query.Source()
+	if src.(map[string]interface{})["term"] == nil {
+		t.Errorf("Invalid rendered base query: %#v", src)
+	}
+}
+
+func TestElasticsearchGetFeaturesSince(t *testing.T) {
+	var search map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+			json.NewDecoder(r.Body).Decode(&search)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 0, "hits": []}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Index: "test", GeometryField: "geometry", TimeField: "updated_at"}
+
+	req := &TileRequest{Args: map[string][]string{SinceArg: []string{"2020-01-01T00:00:00Z"}}}
+	fc, err := source.doGetFeatures(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	if len(fc.Features) != 0 {
+		t.Errorf("Expected no features, got %d", len(fc.Features))
+	}
+	body, _ := json.Marshal(search)
+	if !strings.Contains(string(body), `{"range":{"updated_at":{"format":"epoch_millis","from":1577836800000,"include_lower":false`) {
+		t.Errorf("Missing since filter in search: %s", body)
+	}
+}
+
+func TestElasticsearchGetFeaturesTerms(t *testing.T) {
+	var search map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+			json.NewDecoder(r.Body).Decode(&search)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 0, "hits": []}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Index: "test", GeometryField: "geometry"}
+
+	req := &TileRequest{Terms: map[string]string{"tenant_id": "acme"}}
+	if _, err := source.doGetFeatures(context.Background(), req); err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	body, _ := json.Marshal(search)
+	if !strings.Contains(string(body), `{"term":{"tenant_id":"acme"}}`) {
+		t.Errorf("Missing term filter in search: %s", body)
+	}
+}
+
+func TestElasticsearchClearScroll(t *testing.T) {
+	var cleared []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "DELETE" && r.URL.Path == "/_search/scroll":
+			var body struct {
+				ScrollID []string `json:"scroll_id"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			cleared = append(cleared, body.ScrollID...)
+			w.Write([]byte(`{"succeeded": true, "num_freed": 1}`))
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 1, "hits": [
+				{"_id": "1", "_source": {"geometry": {"type": "Point", "coordinates": [1, 2]}}}
+			]}}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": {"type": "search_context_missing_exception"}}`))
+		}
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Index: "test", GeometryField: "geometry"}
+
+	// The scroll is cleared even when fetching one of its pages fails
+	if _, err := source.doGetFeatures(context.Background(), &TileRequest{}); err == nil {
+		t.Error("Expected an error for a failed scroll page")
+	}
+	if len(cleared) != 1 || cleared[0] != "scroll" {
+		t.Errorf("Expected the scroll to be cleared, got %#v", cleared)
+	}
+}
+
+func TestElasticsearchMetrics(t *testing.T) {
+	hits := `{"_id": "1", "_source": {"geometry": {"type": "Point", "coordinates": [1, 2]}}}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+			w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 2, "hits": [` + hits + `, ` + hits + `]}}`))
+			return
+		}
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 2, "hits": []}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Layer: "metrics", Index: "test", GeometryField: "geometry"}
+	if _, err := source.doGetFeatures(context.Background(), &TileRequest{}); err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	expected := map[string]string{
+		"elasticsearch_metrics_searches":       "1",
+		"elasticsearch_metrics_scrolls_active": "0",
+		"elasticsearch_metrics_scroll_pages":   "1",
+		"elasticsearch_metrics_hits":           "2",
+	}
+	for name, value := range expected {
+		if metric := Metrics.Get(name); metric == nil || metric.String() != value {
+			t.Errorf("Invalid %s metric: %v", name, metric)
+		}
+	}
+	if metric := Metrics.Get("elasticsearch_metrics_bytes"); metric == nil || metric.String() == "0" {
+		t.Errorf("Invalid bytes metric: %v", metric)
+	}
+}
+
+func TestElasticsearchGetFeaturesIndexedShape(t *testing.T) {
+	var search map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+			json.NewDecoder(r.Body).Decode(&search)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 0, "hits": []}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{
+		ES:            es,
+		Index:         "test",
+		GeometryField: "geometry",
+		IndexedShape:  &ElasticsearchIndexedShapeConfig{Index: "aois", Path: "area"},
+	}
+
+	req := &TileRequest{Args: map[string][]string{IndexedShapeArg: []string{"downtown"}}}
+	if _, err := source.doGetFeatures(context.Background(), req); err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	body, _ := json.Marshal(search)
+	if !strings.Contains(string(body), `{"geo_shape":{"geometry":{"indexed_shape":{"id":"downtown","index":"aois","path":"area"},"relation":"intersects"}}}`) {
+		t.Errorf("Missing indexed shape filter in search: %s", body)
+	}
+	if !strings.Contains(string(body), `"envelope"`) {
+		t.Errorf("The indexed shape filter should be combined with the tile bounds: %s", body)
+	}
+
+	// Sources without a configured indexed shape ignore the argument
+	source.IndexedShape = nil
+	if _, err := source.doGetFeatures(context.Background(), req); err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	if body, _ := json.Marshal(search); strings.Contains(string(body), "indexed_shape") {
+		t.Errorf("Unexpected indexed shape filter in search: %s", body)
+	}
+}
+
+func TestHitToFeatureIncludeScore(t *testing.T) {
+	e := &ElasticsearchSource{GeometryField: "geometry", IncludeScore: true}
+	score := 2.5
+	hit := newTestHit("1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}}`)
+	hit.Score = &score
+
+	feat, err := e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if _, exists := feat.Properties[ScoreProperty]; exists {
+		t.Errorf("Scores should not be included for the default filter-only query: %#v", feat.Properties)
+	}
+
+	e.BaseQuery = elastic.NewMatchQuery("name", "park")
+	feat, err = e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if feat.Properties[ScoreProperty] != 2.5 {
+		t.Errorf("Invalid score property: %#v", feat.Properties)
+	}
+}
+
+func TestElasticsearchGetFeaturesScoredQuery(t *testing.T) {
+	var search map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, "/_search") {
+			// End the scroll after the first page
+			w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 1, "hits": []}}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&search)
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 1, "hits": [` +
+			`{"_index": "test", "_id": "1", "_score": 1.5, "_source": {"geometry": {"type": "Point", "coordinates": [1, 2]}}}]}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Index: "test", GeometryField: "geometry", IncludeScore: true}
+
+	req := &TileRequest{Args: map[string][]string{"q": []string{"name:park"}}}
+	fc, err := source.doGetFeatures(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	body, _ := json.Marshal(search)
+	if !strings.Contains(string(body), `"must":{"query_string":{"query":"name:park"}}`) {
+		t.Errorf("Expected the q query to be a scoring clause: %s", body)
+	}
+	if len(fc.Features) != 1 || fc.Features[0].Properties[ScoreProperty] != 1.5 {
+		t.Errorf("Expected the score of the q query: %#v", fc.Features)
+	}
+
+	// Without a q query, the hits aren't scored
+	fc, err = source.doGetFeatures(context.Background(), &TileRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	if _, exists := fc.Features[0].Properties[ScoreProperty]; exists {
+		t.Errorf("Scores should not be included for the default filter-only query: %#v", fc.Features[0].Properties)
+	}
+}
+
+func TestSearchParams(t *testing.T) {
+	config := &ElasticsearchConfig{
+		Index:         "test",
+		GeometryField: "geometry",
+		SearchParams: map[string]interface{}{
+			"terminate_after": 1000,
+			"preference":      "_local",
+			"request_cache":   true,
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	params := supportedSearchParams(config.SearchParams)
+	if _, exists := params["request_cache"]; exists {
+		t.Errorf("Unsupported search parameters should be dropped: %#v", params)
+	}
+
+	var search map[string]interface{}
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+			query = r.URL.Query()
+			json.NewDecoder(r.Body).Decode(&search)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"_scroll_id": "scroll", "hits": {"total": 0, "hits": []}}`))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ElasticsearchSource{ES: es, Index: "test", GeometryField: "geometry", SearchParams: params}
+	if _, err := source.doGetFeatures(context.Background(), &TileRequest{}); err != nil {
+		t.Fatalf("Failed to get features: %v", err)
+	}
+	if v := search["terminate_after"]; v != 1000.0 {
+		t.Errorf("Invalid terminate_after: %#v", v)
+	}
+	if v := query.Get("preference"); v != "_local" {
+		t.Errorf("Invalid preference: %#v", v)
+	}
+
+	config.SearchParams = map[string]interface{}{"terminate_after": "lots"}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an error for an invalid search parameter value")
+	}
+}
+
+func TestSharedElasticsearchClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	created := 0
+	defer func(create func(string, ...elastic.ClientOptionFunc) (*elastic.Client, error)) {
+		newElasticsearchClient = create
+	}(newElasticsearchClient)
+	newElasticsearchClient = func(url string, options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+		created++
+		return elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	}
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	config := &ElasticsearchConfig{Host: u.Hostname(), Port: port, Index: "a", GeometryField: "geometry"}
+	a, err := NewElasticsearchSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Index = "b"
+	b, err := NewElasticsearchSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || a.(*ElasticsearchSource).ES != b.(*ElasticsearchSource).ES {
+		t.Errorf("Expected the sources of the same cluster to share a client (created = %d)", created)
+	}
+}
+
+func TestParseCloudID(t *testing.T) {
+	// "us-east-1.aws.found.io$abc123$def456" and "us-east-1.aws.found.io:9243$abc123$def456"
+	valid := map[string]string{
+		"deployment:dXMtZWFzdC0xLmF3cy5mb3VuZC5pbyRhYmMxMjMkZGVmNDU2":         "https://abc123.us-east-1.aws.found.io",
+		"deployment:dXMtZWFzdC0xLmF3cy5mb3VuZC5pbzo5MjQzJGFiYzEyMyRkZWY0NTY=": "https://abc123.us-east-1.aws.found.io:9243",
+	}
+	for cloudID, expected := range valid {
+		url, err := parseCloudID(cloudID)
+		if err != nil {
+			t.Errorf("Failed to parse cloud ID %s: %v", cloudID, err)
+		}
+		if url != expected {
+			t.Errorf("Expected cloud ID %s to be decoded to %s, got %s", cloudID, expected, url)
+		}
+	}
+	// "not-a-cloud-id" lacks the Elasticsearch UUID
+	for _, cloudID := range []string{"deployment:!!!", "deployment:bm90LWEtY2xvdWQtaWQ="} {
+		if _, err := parseCloudID(cloudID); err == nil {
+			t.Errorf("Expected an invalid cloud ID: %s", cloudID)
+		}
+	}
+	config := &ElasticsearchConfig{CloudID: "deployment:!!!", Index: "a", GeometryField: "geometry"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected the invalid cloud ID to fail validation")
+	}
+}
+
+func TestElasticsearchAPIKey(t *testing.T) {
+	if key := encodeAPIKey("id:secret"); key != "aWQ6c2VjcmV0" {
+		t.Errorf("Unexpected encoded API key: %s", key)
+	}
+	if key := encodeAPIKey("aWQ6c2VjcmV0"); key != "aWQ6c2VjcmV0" {
+		t.Errorf("Expected an encoded API key to be used as is: %s", key)
+	}
+
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	defer func(create func(string, ...elastic.ClientOptionFunc) (*elastic.Client, error)) {
+		newElasticsearchClient = create
+	}(newElasticsearchClient)
+	newElasticsearchClient = func(url string, options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+		return elastic.NewClient(append([]elastic.ClientOptionFunc{
+			elastic.SetURL(url), elastic.SetSniff(false), elastic.SetHealthcheck(false),
+		}, options...)...)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	config := &ElasticsearchConfig{Host: u.Hostname(), Port: port, APIKey: "id:secret", Index: "a", GeometryField: "geometry"}
+	es, err := sharedElasticsearchClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.PerformRequest(context.Background(), elastic.PerformRequestOptions{Method: "GET", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "ApiKey aWQ6c2VjcmV0" {
+		t.Errorf("Expected requests to be authorized with the API key, got: %s", authorization)
+	}
+	config.APIKey = "other:secret"
+	if other, _ := sharedElasticsearchClient(config); other == es {
+		t.Errorf("Expected sources with different API keys not to share a client")
+	}
+}
+
+func TestDetectGeometryField(t *testing.T) {
+	mappings := map[string]string{
+		"places": `{"places-v2": {"mappings": {"_doc": {"properties": {
+			"name": {"type": "keyword"},
+			"location": {"properties": {"shape": {"type": "geo_shape"}}}
+		}}}}}`,
+		"points": `{"points": {"mappings": {"properties": {"point": {"type": "geo_point"}}}}}`,
+		"multi": `{"multi": {"mappings": {"properties": {
+			"a": {"type": "geo_shape"},
+			"b": {"type": "geo_shape"}
+		}}}}`,
+		"none": `{"none": {"mappings": {"properties": {"name": {"type": "keyword"}}}}}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(mappings[strings.Split(r.URL.Path, "/")[1]]))
+	}))
+	defer ts.Close()
+	es, err := elastic.NewClient(elastic.SetURL(ts.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	field, err := detectGeometryField(context.Background(), es, "places")
+	if err != nil || field != "location.shape" {
+		t.Errorf("Expected to detect the nested geo_shape field: %s %v", field, err)
+	}
+
+	// Only a single geo_shape field can be detected
+	for _, index := range []string{"points", "multi", "none"} {
+		if _, err := detectGeometryField(context.Background(), es, index); err == nil {
+			t.Errorf("Expected an error detecting the geometry field of index %s", index)
+		}
+	}
+
+	if err := (&ElasticsearchConfig{Index: "places", AutoDetectGeometry: true}).Validate(); err != nil {
+		t.Errorf("Unexpected error without a geometryField to auto-detect: %v", err)
+	}
+	config := &ElasticsearchConfig{Index: "places", GeometryField: "shape", AutoDetectGeometry: true}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an error when configuring both geometryField and autoDetectGeometry")
+	}
+}
+
+func TestHitToFeaturePreciseIntegers(t *testing.T) {
+	hit := newTestHit("doc-1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "osm_id": 9007199254740993, "big": 18446744073709551615, "area": 1.5}`)
+	e := &ElasticsearchSource{
+		GeometryField:   "geometry",
+		SourceFields:    map[string]string{"osm_id": "osm_id", "big": "big", "area": "area"},
+		PreciseIntegers: true,
+	}
+	feat, err := e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if feat.Properties["osm_id"] != int64(9007199254740993) || feat.Properties["big"] != uint64(18446744073709551615) || feat.Properties["area"] != 1.5 {
+		t.Errorf("Expected exact integers: %#v", feat.Properties)
+	}
+	if geom, isPoint := feat.Geometry.(orb.Point); !isPoint || geom != (orb.Point{1, 2}) {
+		t.Errorf("Invalid geometry with exact integers: %#v", feat.Geometry)
+	}
+	body, _ := json.Marshal(feat)
+	if !strings.Contains(string(body), `"osm_id":9007199254740993`) {
+		t.Errorf("Expected the exact integer in the GeoJSON output: %s", body)
+	}
+
+	e.PreciseIntegers = false
+	feat, _ = e.HitToFeature(newTestHit("doc-1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "osm_id": 9007199254740993}`))
+	if _, isFloat := feat.Properties["osm_id"].(float64); !isFloat {
+		t.Errorf("Expected float64 numbers by default: %#v", feat.Properties)
+	}
+}
+
+func TestHitToFeatureIDProperty(t *testing.T) {
+	hit := newTestHit("doc-1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "external_id": "ext-1"}`)
+	e := &ElasticsearchSource{GeometryField: "geometry", SourceFields: map[string]string{"id": "external_id"}}
+	feat, err := e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if v := feat.Properties["id"]; v != "ext-1" {
+		t.Errorf("Mapped id property should not be overwritten by the document ID: %#v", v)
+	}
+
+	e.IDProperty = "_id"
+	feat, err = e.HitToFeature(hit)
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if feat.Properties["id"] != "ext-1" || feat.Properties["_id"] != "doc-1" {
+		t.Errorf("Invalid id properties: %#v", feat.Properties)
+	}
+}
+
+func TestSourceExcludes(t *testing.T) {
+	e := &ElasticsearchSource{GeometryField: "geometry", SourceExcludes: []string{"raw.0.blob"}}
+	src, _ := e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	body, _ := json.Marshal(src.(map[string]interface{})["_source"])
+	if string(body) != `{"excludes":["raw.blob"]}` {
+		t.Errorf("Invalid _source: %s", body)
+	}
+	feat, err := e.HitToFeature(newTestHit("1", `{"geometry": {"type": "Point", "coordinates": [1, 2]}, "name": "a", "height": 10}`))
+	if err != nil {
+		t.Fatalf("Failed to convert hit to feature: %v", err)
+	}
+	if len(feat.Properties) != 3 || feat.Properties["name"] != "a" || feat.Properties["height"] != 10.0 {
+		t.Errorf("Expected the non-geometry fields as properties: %#v", feat.Properties)
+	}
+
+	// With mapped source fields, only the mapped fields are fetched as properties
+	e.SourceFields = map[string]string{"name": "name"}
+	src, _ = e.newSearchSource(elastic.NewMatchAllQuery()).Source()
+	body, _ = json.Marshal(src.(map[string]interface{})["_source"])
+	if !strings.Contains(string(body), `"includes":["geometry","name"]`) {
+		t.Errorf("Invalid _source: %s", body)
+	}
+
+	config := &ElasticsearchConfig{Index: "test", GeometryField: "geometry", SourceExcludes: []string{"geometry"}}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected to fail excluding the geometry field")
+	}
+}
@@ -0,0 +1,107 @@
+package tilenol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// ParseFeatureIDs encodes numeric feature IDs (including numeric strings) as MVT feature
+	// IDs, and omits the MVT feature ID of all other features
+	ParseFeatureIDs = "parse"
+	// HashFeatureIDs is like ParseFeatureIDs, but encodes non-numeric string feature IDs as a
+	// stable 64-bit hash of the string
+	HashFeatureIDs = "hash"
+	// OmitFeatureIDs omits the MVT feature ID of all features
+	OmitFeatureIDs = "omit"
+	// SequentialFeatureIDs numbers the features of each tile in order, starting at 1. The IDs
+	// are deterministic for unchanged source data, but not unique across tiles.
+	SequentialFeatureIDs = "sequential"
+	// PropertyFeatureIDsPrefix is the prefix of the mode that reads the MVT feature ID from a
+	// numeric feature property (e.g. "property:osm_id"), omitting it for all other features
+	PropertyFeatureIDsPrefix = "property:"
+)
+
+// validateFeatureIDs checks that the MVT feature ID mode of a layer is supported
+func validateFeatureIDs(mode string) error {
+	switch mode {
+	case "", ParseFeatureIDs, HashFeatureIDs, OmitFeatureIDs, SequentialFeatureIDs:
+		return nil
+	}
+	if idProperty(mode) != "" {
+		return nil
+	}
+	return fmt.Errorf("Invalid featureIds mode: %s", mode)
+}
+
+// idProperty returns the name of the feature property holding the MVT feature ID for the
+// given mode, if any
+func idProperty(mode string) string {
+	if !strings.HasPrefix(mode, PropertyFeatureIDsPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(mode, PropertyFeatureIDsPrefix)
+}
+
+// featureID returns the value that encodes as the unsigned MVT feature ID of the i-th feature
+// of a tile using the given mode, where nil omits the ID
+func featureID(feature *geojson.Feature, i int, mode string) interface{} {
+	if mode == SequentialFeatureIDs {
+		return uint64(i + 1)
+	}
+	if property := idProperty(mode); property != "" {
+		return numericFeatureID(feature.Properties[property])
+	}
+	return mvtFeatureID(feature.ID, mode)
+}
+
+// numericFeatureID converts a non-negative integer property value (including numeric strings)
+// into an MVT feature ID, returning nil for all other values
+func numericFeatureID(v interface{}) interface{} {
+	if s, isString := v.(string); isString {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n
+		}
+		return nil
+	}
+	if n, isInt := intValue(v); isInt {
+		if n < 0 {
+			return nil
+		}
+		return uint64(n)
+	}
+	if n, isUint := v.(uint64); isUint {
+		return n
+	}
+	if f, isNumber := floatValue(v); isNumber && f >= 0 && f == math.Trunc(f) && f < math.MaxUint64 {
+		return uint64(f)
+	}
+	return nil
+}
+
+// mvtFeatureID converts a feature ID into a value that encodes as an unsigned MVT feature ID
+// using the given mode, where nil omits the ID
+func mvtFeatureID(id interface{}, mode string) interface{} {
+	if mode == OmitFeatureIDs {
+		return nil
+	}
+	s, isString := id.(string)
+	if !isString {
+		return id
+	}
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n
+	}
+	if mode == HashFeatureIDs {
+		// FNV-1a is stable across processes, so hashed IDs don't change between requests
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		return h.Sum64()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFeatureIDs(t *testing.T) {
+	for _, mode := range []string{"", ParseFeatureIDs, HashFeatureIDs, OmitFeatureIDs, SequentialFeatureIDs, "property:osm_id"} {
+		assert.Nil(t, validateFeatureIDs(mode), "Expected mode %q to be valid", mode)
+	}
+	assert.NotNil(t, validateFeatureIDs("cast"))
+	assert.NotNil(t, validateFeatureIDs(PropertyFeatureIDsPrefix))
+}
+
+func TestMVTFeatureID(t *testing.T) {
+	assert.Equal(t, uint64(18446744073709551615), mvtFeatureID("18446744073709551615", ParseFeatureIDs))
+	assert.Equal(t, 42, mvtFeatureID(42, ParseFeatureIDs))
+	assert.Nil(t, mvtFeatureID("abc123", ParseFeatureIDs))
+	assert.Nil(t, mvtFeatureID("abc123", ""))
+
+	hashed := mvtFeatureID("abc123", HashFeatureIDs)
+	assert.IsType(t, uint64(0), hashed)
+	assert.Equal(t, hashed, mvtFeatureID("abc123", HashFeatureIDs), "Hashed IDs should be stable")
+	assert.NotEqual(t, hashed, mvtFeatureID("abc124", HashFeatureIDs))
+	assert.Equal(t, uint64(7), mvtFeatureID("7", HashFeatureIDs))
+
+	assert.Nil(t, mvtFeatureID("7", OmitFeatureIDs))
+	assert.Nil(t, mvtFeatureID(7, OmitFeatureIDs))
+}
+
+func TestFeatureID(t *testing.T) {
+	feature := geojson.NewFeature(orb.Point{1, 1})
+	feature.ID = "abc123"
+	feature.Properties["osm_id"] = 42.0
+	feature.Properties["ref"] = "17"
+	feature.Properties["name"] = "Main St"
+	feature.Properties["offset"] = -3
+
+	assert.Nil(t, featureID(feature, 0, ParseFeatureIDs))
+	assert.Equal(t, mvtFeatureID("abc123", HashFeatureIDs), featureID(feature, 0, HashFeatureIDs))
+	assert.Equal(t, uint64(1), featureID(feature, 0, SequentialFeatureIDs))
+	assert.Equal(t, uint64(5), featureID(feature, 4, SequentialFeatureIDs))
+
+	assert.Equal(t, uint64(42), featureID(feature, 0, "property:osm_id"))
+	assert.Equal(t, uint64(17), featureID(feature, 0, "property:ref"))
+	assert.Nil(t, featureID(feature, 0, "property:name"))
+	assert.Nil(t, featureID(feature, 0, "property:offset"))
+	assert.Nil(t, featureID(feature, 0, "property:missing"))
+}
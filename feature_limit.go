@@ -0,0 +1,91 @@
+package tilenol
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	InvalidFeatureLimitConfig = errors.New("maxFeatures must be a number, a byZoom table or a base/baseZoom/max formula")
+)
+
+// FeatureLimitConfig is the YAML configuration for the maximum number of features returned per
+// tile. It is either a flat number (e.g. "maxFeatures: 1000"), or a limit that scales with the
+// zoom level, given as a per-zoom table or as the formula base * 2^(z - baseZoom).
+type FeatureLimitConfig struct {
+	// Limit is the flat maximum number of features across all zoom levels
+	Limit int `yaml:"-"`
+	// ByZoom maps zoom levels to the maximum number of features, where each limit applies
+	// until the next configured zoom level
+	ByZoom map[int]int `yaml:"byZoom"`
+	// Base is the maximum number of features at BaseZoom, which doubles with each zoom level
+	Base int `yaml:"base"`
+	// BaseZoom is the zoom level at which Base applies
+	BaseZoom int `yaml:"baseZoom"`
+	// Max optionally clamps the limit computed from Base
+	Max int `yaml:"max"`
+}
+
+// UnmarshalYAML decodes either a flat number or a mapping into the FeatureLimitConfig
+func (c *FeatureLimitConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&c.Limit)
+	}
+	type plain FeatureLimitConfig
+	return value.Decode((*plain)(c))
+}
+
+// Validate checks that the FeatureLimitConfig is well-formed
+func (c *FeatureLimitConfig) Validate() error {
+	if c.Limit < 0 || c.Base < 0 || c.Max < 0 {
+		return InvalidFeatureLimitConfig
+	}
+	if len(c.ByZoom) > 0 && c.Base > 0 {
+		return InvalidFeatureLimitConfig
+	}
+	for _, limit := range c.ByZoom {
+		if limit < 0 {
+			return InvalidFeatureLimitConfig
+		}
+	}
+	return nil
+}
+
+// scales returns whether or not the limit depends on the zoom level
+func (c *FeatureLimitConfig) scales() bool {
+	return len(c.ByZoom) > 0 || c.Base > 0
+}
+
+// ForZoom returns the maximum number of features at the given zoom level, where zero means
+// that there is no limit
+func (c *FeatureLimitConfig) ForZoom(z int) int {
+	if len(c.ByZoom) > 0 {
+		zooms := make([]int, 0, len(c.ByZoom))
+		for zoom := range c.ByZoom {
+			zooms = append(zooms, zoom)
+		}
+		sort.Ints(zooms)
+		// Zoom levels below the lowest configured one use its limit
+		limit := c.ByZoom[zooms[0]]
+		for _, zoom := range zooms {
+			if zoom <= z {
+				limit = c.ByZoom[zoom]
+			}
+		}
+		return limit
+	}
+	if c.Base > 0 {
+		limit := int(math.Round(float64(c.Base) * math.Pow(2, float64(z-c.BaseZoom))))
+		if limit < 1 {
+			limit = 1
+		}
+		if c.Max > 0 && limit > c.Max {
+			limit = c.Max
+		}
+		return limit
+	}
+	return c.Limit
+}
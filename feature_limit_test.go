@@ -0,0 +1,51 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestFeatureLimitConfigUnmarshal(t *testing.T) {
+	var flat FeatureLimitConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("1000"), &flat))
+	assert.Equal(t, 1000, flat.Limit)
+	assert.False(t, flat.scales())
+
+	var byZoom FeatureLimitConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("byZoom: {0: 100, 10: 1000}"), &byZoom))
+	assert.Equal(t, map[int]int{0: 100, 10: 1000}, byZoom.ByZoom)
+	assert.True(t, byZoom.scales())
+
+	var formula FeatureLimitConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("{base: 100, baseZoom: 10, max: 5000}"), &formula))
+	assert.Equal(t, FeatureLimitConfig{Base: 100, BaseZoom: 10, Max: 5000}, formula)
+}
+
+func TestFeatureLimitConfigValidate(t *testing.T) {
+	assert.Nil(t, (&FeatureLimitConfig{}).Validate())
+	assert.Nil(t, (&FeatureLimitConfig{Base: 100, Max: 1000}).Validate())
+	assert.NotNil(t, (&FeatureLimitConfig{Limit: -1}).Validate())
+	assert.NotNil(t, (&FeatureLimitConfig{ByZoom: map[int]int{0: -1}}).Validate())
+	assert.NotNil(t, (&FeatureLimitConfig{ByZoom: map[int]int{0: 1}, Base: 1}).Validate())
+}
+
+func TestFeatureLimitForZoom(t *testing.T) {
+	flat := &FeatureLimitConfig{Limit: 1000}
+	assert.Equal(t, 1000, flat.ForZoom(0))
+	assert.Equal(t, 1000, flat.ForZoom(22))
+
+	byZoom := &FeatureLimitConfig{ByZoom: map[int]int{4: 100, 10: 1000, 14: 0}}
+	assert.Equal(t, 100, byZoom.ForZoom(0))
+	assert.Equal(t, 100, byZoom.ForZoom(9))
+	assert.Equal(t, 1000, byZoom.ForZoom(10))
+	assert.Equal(t, 0, byZoom.ForZoom(16), "A limit of 0 disables the limit")
+
+	formula := &FeatureLimitConfig{Base: 100, BaseZoom: 10, Max: 1000}
+	assert.Equal(t, 100, formula.ForZoom(10))
+	assert.Equal(t, 400, formula.ForZoom(12))
+	assert.Equal(t, 1000, formula.ForZoom(14))
+	assert.Equal(t, 25, formula.ForZoom(8))
+	assert.Equal(t, 1, formula.ForZoom(0))
+}
@@ -0,0 +1,86 @@
+package tilenol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// SortByFeatureID sorts the features of each tile by their feature ID
+	SortByFeatureID = "id"
+	// SortByPropertyPrefix is the prefix of the sort order that sorts the features of each tile
+	// by a feature property (e.g. "property:name"), breaking ties by feature ID
+	SortByPropertyPrefix = "property:"
+)
+
+// validateSortBy checks that the feature sort order of a layer is supported
+func validateSortBy(sortBy string) error {
+	if sortBy == "" || sortBy == SortByFeatureID {
+		return nil
+	}
+	if strings.HasPrefix(sortBy, SortByPropertyPrefix) && sortBy != SortByPropertyPrefix {
+		return nil
+	}
+	return fmt.Errorf("Invalid sortBy, expected \"%s\" or \"%s<name>\": %s", SortByFeatureID, SortByPropertyPrefix, sortBy)
+}
+
+// sortFeatures sorts the features into a stable order, so that identical source data always
+// yields identical tiles regardless of the order the source returned it in
+func sortFeatures(fc *geojson.FeatureCollection, sortBy string) {
+	property := strings.TrimPrefix(sortBy, SortByPropertyPrefix)
+	byProperty := property != sortBy
+	sort.SliceStable(fc.Features, func(i, j int) bool {
+		a, b := fc.Features[i], fc.Features[j]
+		if byProperty {
+			if c := compareValues(a.Properties[property], b.Properties[property]); c != 0 {
+				return c < 0
+			}
+		}
+		return compareValues(a.ID, b.ID) < 0
+	})
+}
+
+// compareValues orders two feature IDs or property values: numbers (in numeric order) before
+// strings, strings before any other values (compared by their formatted value), and missing
+// values last
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		}
+		return -1
+	}
+	an, aNumber := floatValue(a)
+	bn, bNumber := floatValue(b)
+	switch {
+	case aNumber && bNumber:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aNumber:
+		return -1
+	case bNumber:
+		return 1
+	}
+	as, aString := a.(string)
+	bs, bString := b.(string)
+	switch {
+	case aString && bString:
+		return strings.Compare(as, bs)
+	case aString:
+		return -1
+	case bString:
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
@@ -0,0 +1,48 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortFeatures(t *testing.T) {
+	newFC := func() *geojson.FeatureCollection {
+		fc := geojson.NewFeatureCollection()
+		for _, f := range []struct {
+			id   interface{}
+			rank interface{}
+		}{{"b", 2}, {10, 1}, {nil, 1}, {2, nil}, {"a", 2.5}} {
+			feature := geojson.NewFeature(orb.Point{0, 0})
+			feature.ID = f.id
+			feature.Properties["rank"] = f.rank
+			if f.rank == nil {
+				delete(feature.Properties, "rank")
+			}
+			fc.Append(feature)
+		}
+		return fc
+	}
+	ids := func(fc *geojson.FeatureCollection) []interface{} {
+		var ids []interface{}
+		for _, feature := range fc.Features {
+			ids = append(ids, feature.ID)
+		}
+		return ids
+	}
+
+	fc := newFC()
+	sortFeatures(fc, SortByFeatureID)
+	assert.Equal(t, []interface{}{2, 10, "a", "b", nil}, ids(fc))
+
+	fc = newFC()
+	sortFeatures(fc, "property:rank")
+	assert.Equal(t, []interface{}{10, nil, "b", "a", 2}, ids(fc), "Ties are broken by ID, missing values last")
+
+	assert.Nil(t, validateSortBy(""))
+	assert.Nil(t, validateSortBy("property:rank"))
+	assert.NotNil(t, validateSortBy("rank"))
+	assert.NotNil(t, validateSortBy("property:"))
+}
@@ -0,0 +1,110 @@
+package tilenol
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// filterPattern matches a "field op value" feature filter expression
+var filterPattern = regexp.MustCompile(`^\s*([^\s=!<>]+)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*$`)
+
+// FeatureFilter is a predicate on a feature property, which is parsed from a "field op value"
+// expression (e.g. "area < 10" or "type == 'park'"), where op is one of ==, !=, <, <=, > or >=.
+// Values are numbers, or strings that are optionally quoted. Strings only support equality.
+type FeatureFilter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// ParseFeatureFilter parses a "field op value" feature filter expression
+func ParseFeatureFilter(expr string) (*FeatureFilter, error) {
+	match := filterPattern.FindStringSubmatch(expr)
+	if match == nil {
+		return nil, fmt.Errorf("Invalid filter, expected \"field op value\": %s", expr)
+	}
+	filter := &FeatureFilter{Field: match[1], Op: match[2]}
+	raw := match[3]
+	if len(raw) >= 2 && (raw[0] == '"' || raw[0] == '\'') && raw[len(raw)-1] == raw[0] {
+		filter.Value = raw[1 : len(raw)-1]
+	} else if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		filter.Value = f
+	} else {
+		filter.Value = raw
+	}
+	if _, isString := filter.Value.(string); isString && filter.Op != "==" && filter.Op != "!=" {
+		return nil, fmt.Errorf("Invalid filter, %s requires a numeric value: %s", filter.Op, expr)
+	}
+	return filter, nil
+}
+
+// parseFeatureFilters parses the configured feature filter expressions of a layer
+func parseFeatureFilters(exprs []string) ([]*FeatureFilter, error) {
+	var filters []*FeatureFilter
+	for _, expr := range exprs {
+		filter, err := ParseFeatureFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Match returns whether or not the properties satisfy the filter. Features without the
+// filtered property, or with a property of a different type than the value, never match.
+func (f *FeatureFilter) Match(properties geojson.Properties) bool {
+	property, exists := properties[f.Field]
+	if !exists || property == nil {
+		return false
+	}
+	switch value := f.Value.(type) {
+	case float64:
+		n, isNumber := floatValue(property)
+		if !isNumber {
+			return false
+		}
+		switch f.Op {
+		case "==":
+			return n == value
+		case "!=":
+			return n != value
+		case "<":
+			return n < value
+		case "<=":
+			return n <= value
+		case ">":
+			return n > value
+		case ">=":
+			return n >= value
+		}
+	case string:
+		s, isString := property.(string)
+		if !isString {
+			return false
+		}
+		return (s == value) == (f.Op == "==")
+	}
+	return false
+}
+
+// filterFeatures drops the features that don't match all of the filters
+func filterFeatures(fc *geojson.FeatureCollection, filters []*FeatureFilter) {
+	features := fc.Features[:0]
+	for _, feature := range fc.Features {
+		matches := true
+		for _, filter := range filters {
+			if !filter.Match(feature.Properties) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			features = append(features, feature)
+		}
+	}
+	fc.Features = features
+}
@@ -0,0 +1,66 @@
+package tilenol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFeatureFilter(t *testing.T) {
+	filter, err := ParseFeatureFilter("area < 10")
+	assert.Nil(t, err)
+	assert.Equal(t, &FeatureFilter{Field: "area", Op: "<", Value: 10.0}, filter)
+
+	filter, err = ParseFeatureFilter("type=='national park'")
+	assert.Nil(t, err)
+	assert.Equal(t, &FeatureFilter{Field: "type", Op: "==", Value: "national park"}, filter)
+
+	filter, err = ParseFeatureFilter("type != park")
+	assert.Nil(t, err)
+	assert.Equal(t, &FeatureFilter{Field: "type", Op: "!=", Value: "park"}, filter)
+
+	for _, expr := range []string{"", "area", "area ~ 10", "< 10", "type > park"} {
+		_, err = ParseFeatureFilter(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
+
+func TestFeatureFilterMatch(t *testing.T) {
+	properties := geojson.Properties{"area": 12, "type": "park", "rank": 2.5}
+	tests := map[string]bool{
+		"area > 10":      true,
+		"area <= 10":     false,
+		"area == 12":     true,
+		"rank >= 2.5":    true,
+		"rank != 2.5":    false,
+		"type == park":   true,
+		"type != 'park'": false,
+		"type == 1":      false,
+		"area == '12'":   false,
+		"missing != 1":   false,
+	}
+	for expr, expected := range tests {
+		filter, err := ParseFeatureFilter(expr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, filter.Match(properties), expr)
+	}
+}
+
+func TestLayerFilters(t *testing.T) {
+	filters, err := parseFeatureFilters([]string{"id != '1'"})
+	assert.Nil(t, err)
+	layer := &Layer{
+		Name:    "points",
+		Source:  newStaticSource(orb.Point{1, 1}, orb.Point{2, 2}, orb.Point{3, 3}),
+		Filters: filters,
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 2)
+	for _, feature := range fc.Features {
+		assert.NotEqual(t, "1", feature.ID)
+	}
+}
@@ -0,0 +1,197 @@
+package tilenol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// GeometryArg is the request parameter for clipping a layer to an arbitrary geometry
+	GeometryArg = "geometry"
+)
+
+// ParseGeometry parses a geometry given either as a GeoJSON geometry object or as WKT
+func ParseGeometry(s string) (orb.Geometry, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		geom, err := geojson.UnmarshalGeometry([]byte(s))
+		if err != nil {
+			return nil, err
+		}
+		return geom.Geometry(), nil
+	}
+	return ParseWKT(s)
+}
+
+// geometryArg parses the optional area-of-interest geometry request argument
+func (t *TileRequest) geometryArg() (orb.Geometry, error) {
+	values, exists := t.Args[GeometryArg]
+	if !exists || len(values) == 0 {
+		return nil, nil
+	}
+	geom, err := ParseGeometry(values[0])
+	if err != nil {
+		return nil, InvalidRequestError{fmt.Sprintf("Invalid geometry: %v", err)}
+	}
+	return geom, nil
+}
+
+// ParseWKT parses a well-known text (WKT) representation of a geometry. Only 2D (x y)
+// coordinates are supported.
+func ParseWKT(s string) (orb.Geometry, error) {
+	s = strings.TrimSpace(s)
+	open := strings.Index(s, "(")
+	if open < 0 {
+		return nil, fmt.Errorf("Invalid WKT: %s", s)
+	}
+	geomType := strings.ToUpper(strings.TrimSpace(s[:open]))
+	tree, rest, err := parseWKTList(s[open:])
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("Invalid WKT, unexpected trailing text: %s", rest)
+	}
+	switch geomType {
+	case "POINT":
+		points, err := wktPoints(tree)
+		if err != nil || len(points) != 1 {
+			return nil, fmt.Errorf("Invalid WKT point: %s", s)
+		}
+		return points[0], nil
+	case "LINESTRING":
+		points, err := wktPoints(tree)
+		return orb.LineString(points), err
+	case "POLYGON":
+		return wktPolygon(tree)
+	case "MULTIPOINT":
+		var mp orb.MultiPoint
+		for _, item := range tree {
+			// Both MULTIPOINT(1 2, 3 4) and MULTIPOINT((1 2), (3 4)) are valid
+			if sub, isList := item.([]interface{}); isList {
+				points, err := wktPoints(sub)
+				if err != nil {
+					return nil, err
+				}
+				mp = append(mp, points...)
+			} else {
+				points, err := wktPoints([]interface{}{item})
+				if err != nil {
+					return nil, err
+				}
+				mp = append(mp, points...)
+			}
+		}
+		return mp, nil
+	case "MULTILINESTRING":
+		var mls orb.MultiLineString
+		for _, item := range tree {
+			sub, isList := item.([]interface{})
+			if !isList {
+				return nil, fmt.Errorf("Invalid WKT multilinestring: %s", s)
+			}
+			points, err := wktPoints(sub)
+			if err != nil {
+				return nil, err
+			}
+			mls = append(mls, orb.LineString(points))
+		}
+		return mls, nil
+	case "MULTIPOLYGON":
+		var mp orb.MultiPolygon
+		for _, item := range tree {
+			sub, isList := item.([]interface{})
+			if !isList {
+				return nil, fmt.Errorf("Invalid WKT multipolygon: %s", s)
+			}
+			polygon, err := wktPolygon(sub)
+			if err != nil {
+				return nil, err
+			}
+			mp = append(mp, polygon)
+		}
+		return mp, nil
+	}
+	return nil, fmt.Errorf("Unsupported WKT geometry type: %s", geomType)
+}
+
+// parseWKTList recursively parses a parenthesized WKT coordinate list into a tree, where the
+// leaves are the raw coordinate strings (e.g. "1 2")
+func parseWKTList(s string) ([]interface{}, string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("Invalid WKT, expected '(' at: %s", s)
+	}
+	s = s[1:]
+	var items []interface{}
+	for {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, "(") {
+			sub, rest, err := parseWKTList(s)
+			if err != nil {
+				return nil, rest, err
+			}
+			items = append(items, sub)
+			s = rest
+		} else {
+			end := strings.IndexAny(s, ",)")
+			if end < 0 {
+				return nil, s, fmt.Errorf("Invalid WKT, unterminated list at: %s", s)
+			}
+			items = append(items, strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+			continue
+		}
+		if strings.HasPrefix(s, ")") {
+			return items, s[1:], nil
+		}
+		return nil, s, fmt.Errorf("Invalid WKT, expected ',' or ')' at: %s", s)
+	}
+}
+
+// wktPoints converts a flat list of WKT coordinate strings into points
+func wktPoints(items []interface{}) ([]orb.Point, error) {
+	var points []orb.Point
+	for _, item := range items {
+		coords, isString := item.(string)
+		if !isString {
+			return nil, fmt.Errorf("Invalid WKT coordinates: %v", item)
+		}
+		parts := strings.Fields(coords)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid WKT coordinates: %s", coords)
+		}
+		x, xErr := strconv.ParseFloat(parts[0], 64)
+		y, yErr := strconv.ParseFloat(parts[1], 64)
+		if xErr != nil || yErr != nil {
+			return nil, fmt.Errorf("Invalid WKT coordinates: %s", coords)
+		}
+		points = append(points, orb.Point{x, y})
+	}
+	return points, nil
+}
+
+// wktPolygon converts a list of WKT rings into a polygon
+func wktPolygon(items []interface{}) (orb.Polygon, error) {
+	var polygon orb.Polygon
+	for _, item := range items {
+		sub, isList := item.([]interface{})
+		if !isList {
+			return nil, fmt.Errorf("Invalid WKT polygon ring: %v", item)
+		}
+		points, err := wktPoints(sub)
+		if err != nil {
+			return nil, err
+		}
+		polygon = append(polygon, orb.Ring(points))
+	}
+	return polygon, nil
+}
@@ -0,0 +1,68 @@
+package tilenol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWKT(t *testing.T) {
+	expectations := map[string]orb.Geometry{
+		"POINT (1 2)":                   orb.Point{1, 2},
+		"LINESTRING(0 0, 1 1, 2 0.5)":   orb.LineString{{0, 0}, {1, 1}, {2, 0.5}},
+		"MULTIPOINT ((1 2), (3 4))":     orb.MultiPoint{{1, 2}, {3, 4}},
+		"MULTIPOINT (1 2, 3 4)":         orb.MultiPoint{{1, 2}, {3, 4}},
+		"MULTILINESTRING((0 0, 1 1))":   orb.MultiLineString{{{0, 0}, {1, 1}}},
+		"polygon((0 0, 1 0, 1 1, 0 0))": orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}},
+		"MULTIPOLYGON (((0 0, 1 0, 1 1, 0 0)), ((5 5, 6 5, 6 6, 5 5), (5.1 5.1, 5.2 5.1, 5.2 5.2, 5.1 5.1)))": orb.MultiPolygon{
+			{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}},
+			{{{5, 5}, {6, 5}, {6, 6}, {5, 5}}, {{5.1, 5.1}, {5.2, 5.1}, {5.2, 5.2}, {5.1, 5.1}}},
+		},
+	}
+	for wkt, expected := range expectations {
+		actual, err := ParseWKT(wkt)
+		assert.Nil(t, err, "Failed to parse WKT: %s", wkt)
+		assert.Equal(t, expected, actual, "Invalid WKT geometry: %s", wkt)
+	}
+}
+
+func TestParseWKTInvalid(t *testing.T) {
+	for _, wkt := range []string{
+		"",
+		"POINT",
+		"POINT (1)",
+		"POINT (1 2",
+		"POINT (1 2) trailing",
+		"POLYGON (0 0, 1 1)",
+		"CIRCLE (0 0)",
+	} {
+		_, err := ParseWKT(wkt)
+		assert.NotNil(t, err, "Expected to fail parsing WKT: %s", wkt)
+	}
+}
+
+func TestParseGeometryGeoJSON(t *testing.T) {
+	geom, err := ParseGeometry(`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0]]]}`)
+	assert.Nil(t, err, "Failed to parse GeoJSON geometry")
+	assert.Equal(t, orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}, geom)
+}
+
+func TestGeometryArg(t *testing.T) {
+	req := &TileRequest{Args: map[string][]string{GeometryArg: {"POINT (1 2)"}}}
+	geom, err := req.geometryArg()
+	assert.Nil(t, err)
+	assert.Equal(t, orb.Point{1, 2}, geom)
+
+	req = &TileRequest{Args: map[string][]string{GeometryArg: {"nope"}}}
+	_, err = req.geometryArg()
+	assert.IsType(t, InvalidRequestError{}, err, "Invalid geometries should be bad requests")
+
+	pgis := &PostGISSource{GeometryField: "geom", SRID: 3857}
+	filter, err := pgis.geometryFilter(orb.Point{1, 2})
+	assert.Nil(t, err)
+	ds, _ := (&PostGISConfig{Table: "t"}).Dataset()
+	sql, _, _ := ds.Where(filter).ToSQL()
+	assert.True(t, strings.Contains(sql, `ST_Intersects("geom", ST_Transform(ST_SetSRID(ST_GeomFromGeoJSON('{"type":"Point","coordinates":[1,2]}'), 4326), 3857))`), sql)
+}
@@ -21,6 +21,7 @@ require (
 	github.com/paulmach/orb v0.1.6
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/net v0.0.0-20201006153459-a7d1128ccaa0
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
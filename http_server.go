@@ -0,0 +1,165 @@
+package tilenol
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// DefaultReadTimeout is the default maximum duration for reading an entire request
+	DefaultReadTimeout = 15 * time.Second
+	// DefaultWriteTimeout is the default maximum duration for writing an entire response. Note
+	// that this bounds streamed responses too, so it should exceed the slowest source query.
+	DefaultWriteTimeout = 60 * time.Second
+	// DefaultIdleTimeout is the default maximum duration to keep an idle keep-alive connection
+	DefaultIdleTimeout = 120 * time.Second
+	// DefaultMaxConcurrentStreams is the default maximum number of concurrent HTTP/2 streams
+	// (i.e. parallel tile requests) per client connection
+	DefaultMaxConcurrentStreams = 250
+)
+
+// UnixSocketPrefix is the prefix of listen addresses that are Unix domain socket paths
+const UnixSocketPrefix = "unix:"
+
+// HTTPServerConfig is the YAML configuration for tuning the HTTP servers
+type HTTPServerConfig struct {
+	// Listen optionally overrides the listen address of the tile server, either as a TCP
+	// address (e.g. ":8080") or as a Unix domain socket path with the UnixSocketPrefix (e.g.
+	// "unix:/var/run/tilenol.sock"). Otherwise the tile server listens on its port.
+	Listen string `yaml:"listen"`
+	// ReadTimeout is the maximum duration for reading an entire request (defaults to
+	// DefaultReadTimeout)
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+	// WriteTimeout is the maximum duration for writing an entire response (defaults to
+	// DefaultWriteTimeout)
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// IdleTimeout is the maximum duration to keep an idle connection open (defaults to
+	// DefaultIdleTimeout)
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxConcurrentStreams is the maximum number of concurrent HTTP/2 streams per connection
+	// (defaults to DefaultMaxConcurrentStreams)
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams"`
+	// TLSCertFile is the optional path to a PEM certificate, which enables HTTP/2 over TLS.
+	// Otherwise the tile server supports HTTP/2 over cleartext (h2c) alongside HTTP/1.1.
+	TLSCertFile string `yaml:"tlsCertFile"`
+	// TLSKeyFile is the path to the PEM private key for TLSCertFile
+	TLSKeyFile string `yaml:"tlsKeyFile"`
+}
+
+// withDefaults returns a copy of the configuration with any unset values defaulted
+func (c *HTTPServerConfig) withDefaults() HTTPServerConfig {
+	var config HTTPServerConfig
+	if c != nil {
+		config = *c
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = DefaultReadTimeout
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.MaxConcurrentStreams == 0 {
+		config.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	return config
+}
+
+// validate checks that the TLS settings are either both set or both unset, and that a Unix
+// socket listen address has a path
+func (c HTTPServerConfig) validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("Both tlsCertFile and tlsKeyFile must be set to enable TLS")
+	}
+	if c.Listen == UnixSocketPrefix {
+		return fmt.Errorf("The listen address must include a Unix socket path")
+	}
+	return nil
+}
+
+// address returns the listen address of the server, defaulting to all interfaces on the port
+func (c HTTPServerConfig) address(port uint16) string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+// useTLS returns whether or not the tile server should be served over TLS
+func (c HTTPServerConfig) useTLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// newHTTPServer creates an http.Server for the handler with the configured timeouts and
+// HTTP/2 support
+func (c HTTPServerConfig) newHTTPServer(port uint16, handler http.Handler) (*http.Server, error) {
+	h2 := &http2.Server{
+		MaxConcurrentStreams: c.MaxConcurrentStreams,
+		IdleTimeout:          c.IdleTimeout,
+	}
+	if !c.useTLS() {
+		// Without TLS, HTTP/2 is negotiated via prior knowledge or an h2c upgrade
+		handler = h2c.NewHandler(handler, h2)
+	}
+	server := &http.Server{
+		Addr:         c.address(port),
+		Handler:      handler,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout:  c.IdleTimeout,
+	}
+	if c.useTLS() {
+		if err := http2.ConfigureServer(server, h2); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+// listen binds the listen address of a server, which is either a TCP address or a Unix socket
+// path with the UnixSocketPrefix
+func listen(addr string) (net.Listener, error) {
+	network, address := "tcp", addr
+	if strings.HasPrefix(address, UnixSocketPrefix) {
+		network, address = "unix", strings.TrimPrefix(address, UnixSocketPrefix)
+		if err := removeStaleSocket(address); err != nil {
+			return nil, fmt.Errorf("Could not remove stale socket %s: %v", address, err)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on %s: %v", addr, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes a leftover Unix socket file that no server is accepting
+// connections on anymore (e.g. after a crash). Anything else is left for net.Listen to report.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// serve serves the http.Server on the listener, using TLS if configured
+func (c HTTPServerConfig) serve(server *http.Server, listener net.Listener) error {
+	if c.useTLS() {
+		return server.ServeTLS(listener, c.TLSCertFile, c.TLSKeyFile)
+	}
+	return server.Serve(listener)
+}
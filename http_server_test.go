@@ -0,0 +1,96 @@
+package tilenol
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPServerConfigDefaults(t *testing.T) {
+	config := (*HTTPServerConfig)(nil).withDefaults()
+	assert.Equal(t, DefaultReadTimeout, config.ReadTimeout)
+	assert.Equal(t, DefaultWriteTimeout, config.WriteTimeout)
+	assert.Equal(t, DefaultIdleTimeout, config.IdleTimeout)
+	assert.Equal(t, uint32(DefaultMaxConcurrentStreams), config.MaxConcurrentStreams)
+	assert.False(t, config.useTLS())
+
+	config = (&HTTPServerConfig{WriteTimeout: 5 * time.Minute, MaxConcurrentStreams: 1000}).withDefaults()
+	assert.Equal(t, DefaultReadTimeout, config.ReadTimeout)
+	assert.Equal(t, 5*time.Minute, config.WriteTimeout)
+	assert.Equal(t, uint32(1000), config.MaxConcurrentStreams)
+}
+
+func TestHTTPServerConfigValidate(t *testing.T) {
+	assert.NoError(t, HTTPServerConfig{}.validate())
+	assert.NoError(t, HTTPServerConfig{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}.validate())
+	assert.Error(t, HTTPServerConfig{TLSCertFile: "cert.pem"}.validate())
+	assert.Error(t, HTTPServerConfig{TLSKeyFile: "key.pem"}.validate())
+
+	_, err := NewServer(func(s *Server) error {
+		s.HTTPConfig = &HTTPServerConfig{TLSCertFile: "cert.pem"}
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	config := (&HTTPServerConfig{ReadTimeout: time.Second}).withDefaults()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	server, err := config.newHTTPServer(3000, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, ":3000", server.Addr)
+	assert.Equal(t, time.Second, server.ReadTimeout)
+	assert.Equal(t, DefaultWriteTimeout, server.WriteTimeout)
+	assert.Equal(t, DefaultIdleTimeout, server.IdleTimeout)
+
+	// HTTP/1.1 clients are still served by the h2c handler
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "HTTP/1.1", w.Body.String())
+}
+
+func TestHTTPServerListen(t *testing.T) {
+	server, err := (&HTTPServerConfig{Listen: "127.0.0.1:0"}).withDefaults().newHTTPServer(3000, http.NotFoundHandler())
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:0", server.Addr)
+	listener, err := listen(server.Addr)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// Binding an address that's in use fails
+	_, err = listen(listener.Addr().String())
+	assert.Error(t, err)
+
+	assert.Error(t, HTTPServerConfig{Listen: UnixSocketPrefix}.validate())
+}
+
+func TestHTTPServerListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tilenol")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addr := UnixSocketPrefix + filepath.Join(dir, "tilenol.sock")
+
+	listener, err := listen(addr)
+	assert.NoError(t, err)
+	_, err = listen(addr)
+	assert.Error(t, err, "Expected to fail binding a socket that's in use")
+
+	// Stale sockets (e.g. after a crash) are replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listen(addr)
+	assert.NoError(t, err)
+	listener.Close()
+
+	_, err = listen(UnixSocketPrefix + filepath.Join(dir, "missing", "tilenol.sock"))
+	assert.Error(t, err)
+}
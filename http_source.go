@@ -0,0 +1,115 @@
+package tilenol
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// DefaultHTTPTimeout is the default maximum duration of an HTTPSource request
+	DefaultHTTPTimeout = 30 * time.Second
+)
+
+// HTTPSourceConfig is the YAML configuration structure for configuring a new HTTPSource
+type HTTPSourceConfig struct {
+	// URLTemplate is the URL used to fetch the GeoJSON feature data for a tile. The {z}, {x},
+	// {y}, {minx}, {miny}, {maxx}, {maxy} and {bbox} placeholders are substituted with the
+	// values of the requested tile, where {bbox} is formatted as "minx,miny,maxx,maxy"
+	URLTemplate string `yaml:"urlTemplate"`
+	// Headers are extra HTTP headers (e.g. for authorization) that are sent with each request
+	Headers map[string]string `yaml:"headers"`
+	// Timeout is the maximum duration of each request (defaults to DefaultHTTPTimeout)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// HTTPSource is a Source implementation that retrieves GeoJSON feature data from an HTTP
+// endpoint
+type HTTPSource struct {
+	// Client is the internal HTTP client
+	Client *http.Client
+	// URLTemplate is the URL template used to fetch the GeoJSON feature data for a tile
+	URLTemplate string
+	// Headers are extra HTTP headers that are sent with each request
+	Headers map[string]string
+}
+
+// Validate checks that the HTTPSourceConfig is well-formed
+func (c *HTTPSourceConfig) Validate() error {
+	if c.URLTemplate == "" {
+		return fmt.Errorf("HTTP sources must have a \"urlTemplate\" configured")
+	}
+	return nil
+}
+
+// NewHTTPSource creates a new Source that retrieves GeoJSON feature data from an HTTP endpoint
+func NewHTTPSource(config *HTTPSourceConfig) (Source, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	return &HTTPSource{
+		Client:      &http.Client{Timeout: timeout},
+		URLTemplate: config.URLTemplate,
+		Headers:     config.Headers,
+	}, nil
+}
+
+// tileURL substitutes the tile request parameters into the URL template
+func (h *HTTPSource) tileURL(req *TileRequest) string {
+	bounds := req.MapTile().Bound()
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	minx, miny := format(bounds.Min.X()), format(bounds.Min.Y())
+	maxx, maxy := format(bounds.Max.X()), format(bounds.Max.Y())
+	replacer := strings.NewReplacer(
+		"{z}", strconv.Itoa(req.Z),
+		"{x}", strconv.Itoa(req.X),
+		"{y}", strconv.Itoa(req.Y),
+		"{minx}", minx,
+		"{miny}", miny,
+		"{maxx}", maxx,
+		"{maxy}", maxy,
+		"{bbox}", strings.Join([]string{minx, miny, maxx, maxy}, ","),
+	)
+	return replacer.Replace(h.URLTemplate)
+}
+
+// GetFeatures implements the Source interface, to get feature data from an HTTP endpoint
+func (h *HTTPSource) GetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	url := h.tileURL(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/geo+json, application/json")
+	for k, v := range h.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	RequestLogger(ctx).Debugf("Fetching GeoJSON from: %s", url)
+	res, err := h.Client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP source request failed: %s (HTTP status %d)", url, res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeatureCollection(data)
+}
@@ -0,0 +1,48 @@
+package tilenol
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSourceTileURL(t *testing.T) {
+	h := &HTTPSource{URLTemplate: "http://example.com/features?z={z}&x={x}&y={y}&bbox={bbox}"}
+	url := h.tileURL(&TileRequest{X: 0, Y: 0, Z: 0})
+	assert.Equal(t, "http://example.com/features?z=0&x=0&y=0&bbox=-180,-85.05112877980659,180,85.05112877980659", url)
+}
+
+func TestHTTPSourceGetFeatures(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "id": "a", "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"name": "A"}}
+		]}`))
+	}))
+	defer backend.Close()
+
+	source, err := NewHTTPSource(&HTTPSourceConfig{
+		URLTemplate: backend.URL + "/{z}/{x}/{y}",
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+	})
+	assert.Nil(t, err, "Failed to create HTTPSource: %v", err)
+	fc, err := source.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 0})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, "A", fc.Features[0].Properties["name"])
+
+	unauthorized, _ := NewHTTPSource(&HTTPSourceConfig{URLTemplate: backend.URL})
+	_, err = unauthorized.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 0})
+	assert.NotNil(t, err, "Expected to fail on a non-2xx response")
+}
+
+func TestNewHTTPSourceNoURL(t *testing.T) {
+	_, err := NewHTTPSource(&HTTPSourceConfig{})
+	assert.NotNil(t, err, "Expected to fail without a URL template")
+}
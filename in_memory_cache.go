@@ -1,23 +1,32 @@
 package tilenol
 
+import "sync"
+
 // InMemoryCache implements the Cache interface backed by an in-memory map
 type InMemoryCache struct {
+	// mutex guards the internal map, since tiles may be cached in the background (e.g. when
+	// prefetching neighbor tiles)
+	mutex sync.RWMutex
 	cache map[string][]byte
 }
 
 // NewInMemoryCache allocates a new InMemoryCache
 func NewInMemoryCache() Cache {
-	return &InMemoryCache{make(map[string][]byte)}
+	return &InMemoryCache{cache: make(map[string][]byte)}
 }
 
 // Exists checks the internal map for the existence of the key
 func (i *InMemoryCache) Exists(key string) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	_, exists := i.cache[key]
 	return exists
 }
 
 // Get retrieves the value stored in the internal map
 func (i *InMemoryCache) Get(key string) ([]byte, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	v, exists := i.cache[key]
 	if !exists {
 		return nil, ErrNoValue
@@ -27,6 +36,13 @@ func (i *InMemoryCache) Get(key string) ([]byte, error) {
 
 // Put stores a new value in the internal map at a given key
 func (i *InMemoryCache) Put(key string, val []byte) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
 	i.cache[key] = val
 	return nil
 }
+
+// GetStale retrieves the value stored in the internal map, since values never expire
+func (i *InMemoryCache) GetStale(key string) ([]byte, error) {
+	return i.Get(key)
+}
@@ -0,0 +1,60 @@
+package tilenol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const (
+	// CallbackArg is the request parameter for wrapping JSON responses in a JSONP callback
+	CallbackArg = "callback"
+	// JSONPContentType is the content type of JSONP responses
+	JSONPContentType = "application/javascript"
+)
+
+// callbackPattern restricts JSONP callbacks to (dotted) JavaScript identifiers, so that the
+// callback can't inject arbitrary script
+var callbackPattern = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*(\.[A-Za-z_$][0-9A-Za-z_$]*)*$`)
+
+// jsonpCallback returns the JSONP callback of the request, or an empty string if JSONP is
+// disabled or not requested
+func (s *Server) jsonpCallback(r *http.Request) (string, error) {
+	callback := r.URL.Query().Get(CallbackArg)
+	if !s.EnableJSONP || callback == "" {
+		return "", nil
+	}
+	if len(callback) > 128 || !callbackPattern.MatchString(callback) {
+		return "", InvalidRequestError{fmt.Sprintf("Invalid JSONP callback: %s", callback)}
+	}
+	return callback, nil
+}
+
+// encodeJSON gzips the JSON encoding of the value, wrapped in the request's JSONP callback if
+// requested. It returns the encoded response along with its content type.
+func (s *Server) encodeJSON(r *http.Request, v interface{}, contentType string) ([]byte, string, error) {
+	callback, err := s.jsonpCallback(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var data bytes.Buffer
+	gw := gzip.NewWriter(&data)
+	if callback != "" {
+		// The comment guards against content sniffing attacks (e.g. Rosetta Flash)
+		fmt.Fprintf(gw, "/**/%s(", callback)
+		contentType = JSONPContentType
+	}
+	if err := json.NewEncoder(gw).Encode(v); err != nil {
+		return nil, "", err
+	}
+	if callback != "" {
+		gw.Write([]byte(");"))
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+	return data.Bytes(), contentType, nil
+}
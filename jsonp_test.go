@@ -0,0 +1,43 @@
+package tilenol
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONP(t *testing.T) {
+	server := &Server{Cache: &NilCache{}, EnableJSONP: true}
+	api, _ := server.setupRoutes()
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.topojson?callback=tiles.load", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, JSONPContentType, w.Header().Get("Content-Type"))
+	gr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "/**/tiles.load({"), "Unexpected JSONP body: %s", body)
+	assert.True(t, strings.HasSuffix(string(body), ");"), "Unexpected JSONP body: %s", body)
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.topojson?callback=alert(1)", nil))
+	assert.Equal(t, 400, w.Code)
+
+	// Binary formats ignore the callback
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt?callback=tiles.load", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, MVTContentType, w.Header().Get("Content-Type"))
+
+	// JSONP is opt-in
+	server.EnableJSONP = false
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.topojson?callback=tiles.load", nil))
+	assert.Equal(t, TopoJSONContentType, w.Header().Get("Content-Type"))
+}
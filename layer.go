@@ -2,10 +2,37 @@ package tilenol
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
 	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/simplify"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MVTFormat is the tile format for gzipped Mapbox Vector Tiles
+	MVTFormat = "mvt"
+	// MVTContentType is the content type of MVTFormat tiles
+	MVTContentType = "application/x-protobuf"
+	// GeoJSONFormat is the tile format for GeoJSON FeatureCollections
+	GeoJSONFormat = "geojson"
+	// GeoJSONContentType is the content type of GeoJSONFormat tiles
+	GeoJSONContentType = "application/geo+json"
+	// TopoJSONFormat is the tile format for TopoJSON topologies
+	TopoJSONFormat = "topojson"
+	// TopoJSONContentType is the content type of TopoJSONFormat tiles
+	TopoJSONContentType = "application/json"
 )
 
 var (
@@ -19,6 +46,86 @@ type SourceConfig struct {
 	Elasticsearch *ElasticsearchConfig `yaml:"elasticsearch"`
 	// PostGIS is an optional YAML key for configuring a PostGISConfig
 	PostGIS *PostGISConfig `yaml:"postgis"`
+	// HTTP is an optional YAML key for configuring an HTTPSourceConfig
+	HTTP *HTTPSourceConfig `yaml:"http"`
+	// Custom holds the YAML configuration blocks of any other source types, keyed by their
+	// name, which are created through the factories registered with RegisterSource
+	Custom map[string]*yaml.Node `yaml:"-"`
+}
+
+// numSources counts the number of configured sources
+func (c *SourceConfig) numSources() int {
+	var n int
+	if c.Elasticsearch != nil {
+		n++
+	}
+	if c.PostGIS != nil {
+		n++
+	}
+	if c.HTTP != nil {
+		n++
+	}
+	return n + len(c.Custom)
+}
+
+// Type returns the YAML key of the configured source (e.g. "postgis"), or an empty string if
+// there isn't exactly one source configured
+func (c *SourceConfig) Type() string {
+	if c.numSources() != 1 {
+		return ""
+	}
+	switch {
+	case c.Elasticsearch != nil:
+		return "elasticsearch"
+	case c.PostGIS != nil:
+		return "postgis"
+	case c.HTTP != nil:
+		return "http"
+	}
+	for name := range c.Custom {
+		return name
+	}
+	return ""
+}
+
+// Validate checks that the configured source is well-formed, without connecting to it
+func (c *SourceConfig) Validate() error {
+	if c.numSources() > 1 {
+		return MultipleSourcesErr
+	}
+	if c.numSources() == 0 {
+		return NoSourcesErr
+	}
+	switch {
+	case c.Elasticsearch != nil:
+		return c.Elasticsearch.Validate()
+	case c.PostGIS != nil:
+		return c.PostGIS.Validate()
+	case c.HTTP != nil:
+		return c.HTTP.Validate()
+	}
+	_, err := registeredSource(c.Type())
+	return err
+}
+
+// createSource creates the configured Source
+func (c *SourceConfig) createSource() (Source, error) {
+	switch {
+	case c.Elasticsearch != nil:
+		return NewElasticsearchSource(c.Elasticsearch)
+	case c.PostGIS != nil:
+		return NewPostGISSource(c.PostGIS)
+	case c.HTTP != nil:
+		return NewHTTPSource(c.HTTP)
+	}
+	for name, config := range c.Custom {
+		factory, err := registeredSource(name)
+		if err != nil {
+			return nil, err
+		}
+		return factory(config)
+	}
+	return nil, NoSourcesErr
 }
 
 // LayerConfig represents a general YAML layer configuration object
@@ -27,59 +134,739 @@ type LayerConfig struct {
 	Name string `yaml:"name"`
 	// Description is an optional short descriptor of the layer
 	Description string `yaml:"description"`
-	// Minzoom specifies the minimum z value for the layer
-	Minzoom int `yaml:"minzoom"`
-	// Maxzoom specifies the maximum z value for the layer
-	Maxzoom int `yaml:"maxzoom"`
+	// Attribution is an optional data attribution (e.g. a copyright notice), which is included
+	// in GeoJSON output
+	Attribution string `yaml:"attribution"`
+	// Minzoom specifies the minimum z value for the layer (defaults to MinZoom)
+	Minzoom *int `yaml:"minzoom"`
+	// Maxzoom specifies the maximum z value for the layer (defaults to MaxZoom)
+	Maxzoom *int `yaml:"maxzoom"`
+	// Overzoom configures whether or not tiles above the maxzoom are served (instead of being
+	// empty) by over-zooming the features of their ancestor tile at the maxzoom
+	Overzoom bool `yaml:"overzoom"`
+	// Optional configures whether or not the layer is left out of its tiles (instead of failing
+	// them) when its source is unavailable, e.g. for non-critical overlays
+	Optional bool `yaml:"optional"`
+	// CacheControl optionally overrides the Cache-Control max-age of the layer's tile
+	// responses, either as a duration (e.g. "30s", "24h") or as "no-cache"
+	CacheControl string `yaml:"cacheControl"`
+	// Properties optionally configures post-processing of the layer's feature properties
+	Properties *PropertiesConfig `yaml:"properties"`
+	// DistanceToCenter configures whether or not each feature is given a computed
+	// DistanceToCenterProperty, e.g. for ranking labels by centrality
+	DistanceToCenter bool `yaml:"distanceToCenter"`
+	// IncludeTileCoords configures whether or not each feature is given the coordinates of the
+	// tile that it was rendered in (see TileZProperty, TileXProperty and TileYProperty), e.g.
+	// for correlating client-side issues with specific tiles
+	IncludeTileCoords bool `yaml:"includeTileCoords"`
+	// IncludeGeometryType configures whether or not each feature is given a GeometryTypeProperty
+	// holding its GeoJSON geometry type (e.g. Point or Polygon), e.g. for branching on the
+	// geometry type in the styles of mixed layers
+	IncludeGeometryType bool `yaml:"includeGeometryType"`
+	// GeometryTypes optionally restricts the layer to features of the given GeoJSON geometry
+	// types (e.g. Polygon, MultiPolygon), dropping features of any other type
+	GeometryTypes []string `yaml:"geometryTypes"`
+	// OncePerTile configures whether or not each feature is only included in the tile that
+	// contains its centroid, instead of every tile that it intersects (e.g. so that labels
+	// aren't drawn once per tile)
+	OncePerTile bool `yaml:"oncePerTile"`
+	// DedupeByID configures whether or not only the first feature with each ID is kept, e.g.
+	// when a source returns the same feature more than once for a tile
+	DedupeByID bool `yaml:"dedupeById"`
+	// PointOnly configures whether or not each feature's geometry is replaced with a
+	// representative point (its centroid, or a point on its surface for polygons that don't
+	// contain their centroid), e.g. to drive label layers from polygon data
+	PointOnly bool `yaml:"pointOnly"`
+	// RepairGeometries configures whether or not feature geometries are repaired (e.g. ring
+	// orientation and repeated positions) before encoding, dropping the ones that remain
+	// invalid (e.g. self-intersecting polygons) instead of producing corrupt tiles
+	RepairGeometries bool `yaml:"repairGeometries"`
+	// Filter optionally drops the features whose properties don't match all of the given
+	// "field op value" expressions (e.g. "area >= 10"), for sources that can't filter natively
+	Filter []string `yaml:"filter"`
+	// Computed optionally maps new property names to arithmetic expressions over the other
+	// feature properties (e.g. "count / area"), which are evaluated after the features are
+	// retrieved. Features for which an expression fails don't get that property.
+	Computed map[string]string `yaml:"computed"`
+	// FeatureIDs configures how feature IDs are encoded as (unsigned integer) MVT feature IDs:
+	// "parse" (the default), "hash", "omit", "sequential" or "property:<name>"
+	FeatureIDs string `yaml:"featureIds"`
+	// SortBy optionally sorts the features of each tile into a stable order before encoding,
+	// either by feature ID ("id") or by a feature property ("property:<name>"), so that
+	// identical source data always yields byte-identical tiles
+	SortBy string `yaml:"sortBy"`
+	// Extent optionally overrides the size of the MVT coordinate grid that feature geometries
+	// are snapped to (defaults to 4096). Smaller extents yield smaller tiles with less detail.
+	Extent int `yaml:"extent"`
+	// AllowUnclipped configures whether or not clients may request the full (unclipped)
+	// geometries of the layer's MVT features with a "clip=false" ClipArg parameter, e.g. for
+	// measurement overlays that need complete shapes
+	AllowUnclipped bool `yaml:"allowUnclipped"`
+	// Raster optionally configures the minimal styling of the layer's features in PNG raster
+	// tiles (see DefaultRasterStyle), a fallback for clients that don't support vector tiles
+	Raster *RasterStyleConfig `yaml:"raster"`
+	// Scope optionally scopes the layer's features to a value of each request (e.g. a tenant
+	// header), which Elasticsearch and PostGIS sources apply as a mandatory term filter
+	Scope *RequestScopeConfig `yaml:"scope"`
+	// Presets optionally configures named fidelity presets, which clients select with the
+	// PresetArg request parameter
+	Presets map[string]*PresetConfig `yaml:"presets"`
+	// CircuitBreaker optionally short-circuits requests to the layer's Source after consecutive
+	// failures
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker"`
 	// Source configures the underlying Source for the layer
 	Source SourceConfig `yaml:"source"`
 }
 
+// ZoomRange returns the configured zoom range of the layer, where unset values default to the
+// full MinZoom to MaxZoom range. An explicit "maxzoom: 0" is distinguished from an unset maxzoom.
+func (c *LayerConfig) ZoomRange() (int, int) {
+	minzoom, maxzoom := MinZoom, MaxZoom
+	if c.Minzoom != nil {
+		minzoom = *c.Minzoom
+	}
+	if c.Maxzoom != nil {
+		maxzoom = *c.Maxzoom
+	}
+	return minzoom, maxzoom
+}
+
 // Source is a generic interface for all feature data sources
 type Source interface {
 	// GetFeatures retrieves the GeoJSON FeatureCollection for the given request
 	GetFeatures(context.Context, *TileRequest) (*geojson.FeatureCollection, error)
 }
 
+// LastModifiedSource is an optional interface for sources that can cheaply determine when the
+// features of a tile were last modified
+type LastModifiedSource interface {
+	// LastModified returns the latest modification time of the features for the given
+	// request, where a zero time means that it is unknown
+	LastModified(context.Context, *TileRequest) (time.Time, error)
+}
+
 // Layer is a configured, hydrated tile server layer
 type Layer struct {
 	Name        string
 	Description string
+	// Attribution is the optional data attribution included in GeoJSON output
+	Attribution string
 	Minzoom     int
 	Maxzoom     int
-	Source      Source
+	// Overzoom configures whether or not tiles above the Maxzoom are over-zoomed from their
+	// ancestor tile at the Maxzoom
+	Overzoom bool
+	// Optional configures whether or not the layer is left out of its tiles when its source is
+	// unavailable
+	Optional bool
+	// CacheMaxAge is the optional max-age for the layer's tile responses, where a zero
+	// duration disables caching altogether
+	CacheMaxAge *time.Duration
+	// Simplify configures whether or not the layer's feature geometries are simplified based
+	// on zoom level
+	Simplify bool
+	// Properties optionally configures post-processing of the layer's feature properties
+	Properties *PropertiesConfig
+	// DistanceToCenter configures whether or not each feature is given a computed
+	// DistanceToCenterProperty
+	DistanceToCenter bool
+	// IncludeTileCoords configures whether or not each feature is given the coordinates of the
+	// tile that it was rendered in
+	IncludeTileCoords bool
+	// IncludeGeometryType configures whether or not each feature is given a
+	// GeometryTypeProperty
+	IncludeGeometryType bool
+	// GeometryTypes optionally restricts the layer to features of the given GeoJSON geometry
+	// types
+	GeometryTypes []string
+	// OncePerTile configures whether or not each feature is only included in the tile that
+	// contains its centroid
+	OncePerTile bool
+	// DedupeByID configures whether or not only the first feature with each ID is kept
+	DedupeByID bool
+	// PointOnly configures whether or not feature geometries are replaced with representative
+	// points
+	PointOnly bool
+	// RepairGeometries configures whether or not feature geometries are repaired, dropping
+	// the ones that remain invalid
+	RepairGeometries bool
+	// Filters optionally drop the features whose properties don't match all of them
+	Filters []*FeatureFilter
+	// Computed optionally adds properties computed from the other properties of each feature
+	Computed []*ComputedProperty
+	// FeatureIDs configures how feature IDs are encoded as MVT feature IDs
+	FeatureIDs string
+	// SortBy optionally sorts the features of each tile by feature ID or by a feature property
+	SortBy string
+	// Extent is the size of the MVT coordinate grid, where zero means mvt.DefaultExtent
+	Extent uint32
+	// AllowUnclipped configures whether or not clients may request unclipped MVT geometries
+	AllowUnclipped bool
+	// Raster is the optional styling of the layer's features in raster tiles
+	Raster *RasterStyle
+	// Scope optionally scopes the layer's features to a value of each request
+	Scope *RequestScopeConfig
+	// Presets are the optional named fidelity presets of the layer
+	Presets map[string]*PresetConfig
+	Source  Source
+}
+
+const (
+	// DistanceToCenterProperty is the computed feature property holding the distance (in
+	// tile extent units) between the feature's centroid and the center of the requested tile
+	DistanceToCenterProperty = "_dist_to_center"
+	// TileZProperty is the feature property holding the zoom level of the rendered tile
+	TileZProperty = "_tile_z"
+	// TileXProperty is the feature property holding the x coordinate of the rendered tile
+	TileXProperty = "_tile_x"
+	// TileYProperty is the feature property holding the y coordinate of the rendered tile
+	TileYProperty = "_tile_y"
+	// GeometryTypeProperty is the feature property holding the GeoJSON geometry type of the
+	// feature
+	GeometryTypeProperty = "_geom_type"
+)
+
+// geometryTypes are the supported GeoJSON geometry type names for filtering layers
+var geometryTypes = []string{
+	orb.Point{}.GeoJSONType(),
+	orb.MultiPoint{}.GeoJSONType(),
+	orb.LineString{}.GeoJSONType(),
+	orb.MultiLineString{}.GeoJSONType(),
+	orb.Polygon{}.GeoJSONType(),
+	orb.MultiPolygon{}.GeoJSONType(),
+	orb.Collection{}.GeoJSONType(),
+}
+
+// parseGeometryTypes validates the configured geometry types, normalizing them to their
+// canonical GeoJSON type names
+func parseGeometryTypes(types []string) ([]string, error) {
+	var parsed []string
+	for _, t := range types {
+		var valid bool
+		for _, geometryType := range geometryTypes {
+			if strings.EqualFold(t, geometryType) {
+				parsed = append(parsed, geometryType)
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid geometry type: %s", t)
+		}
+	}
+	return parsed, nil
+}
+
+// NoCache is the special cacheControl value used to disable response caching for a layer
+const NoCache = "no-cache"
+
+// parseCacheControl converts a layer's cacheControl configuration into a max-age duration
+func parseCacheControl(cacheControl string) (*time.Duration, error) {
+	if cacheControl == "" {
+		return nil, nil
+	}
+	var maxAge time.Duration
+	if cacheControl != NoCache {
+		var err error
+		maxAge, err = time.ParseDuration(cacheControl)
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("Invalid cacheControl value: %s", cacheControl)
+		}
+	}
+	return &maxAge, nil
+}
+
+// Validate checks that the LayerConfig is well-formed, without connecting to its source
+func (c *LayerConfig) Validate() error {
+	if err := c.Source.Validate(); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return errors.New("Layers must have a name")
+	}
+	if minzoom, maxzoom := c.ZoomRange(); minzoom < MinZoom || maxzoom > MaxZoom || minzoom > maxzoom {
+		return fmt.Errorf("Invalid zoom range [%d, %d] for layer: %s", minzoom, maxzoom, c.Name)
+	}
+	if _, err := parseCacheControl(c.CacheControl); err != nil {
+		return err
+	}
+	if _, err := parseGeometryTypes(c.GeometryTypes); err != nil {
+		return err
+	}
+	if err := validateFeatureIDs(c.FeatureIDs); err != nil {
+		return err
+	}
+	if err := validateSortBy(c.SortBy); err != nil {
+		return err
+	}
+	if _, err := parseFeatureFilters(c.Filter); err != nil {
+		return err
+	}
+	if _, err := parseComputedProperties(c.Computed); err != nil {
+		return err
+	}
+	if c.Extent < 0 {
+		return fmt.Errorf("Invalid extent %d for layer: %s", c.Extent, c.Name)
+	}
+	if err := validatePresets(c.Presets); err != nil {
+		return err
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Raster != nil {
+		if _, err := c.Raster.Style(); err != nil {
+			return err
+		}
+	}
+	if c.Scope != nil {
+		if err := c.Scope.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Properties != nil {
+		return c.Properties.Validate()
+	}
+	return nil
 }
 
 // CreateLayer creates a new Layer given a LayerConfig
 func CreateLayer(layerConfig LayerConfig) (*Layer, error) {
+	if err := layerConfig.Validate(); err != nil {
+		return nil, err
+	}
+	minzoom, maxzoom := layerConfig.ZoomRange()
 	layer := &Layer{
 		Name:        layerConfig.Name,
 		Description: layerConfig.Description,
-		Minzoom:     layerConfig.Minzoom,
-		Maxzoom:     layerConfig.Maxzoom,
+		Attribution: layerConfig.Attribution,
+		Minzoom:     minzoom,
+		Maxzoom:     maxzoom,
+		Overzoom:    layerConfig.Overzoom,
+		Optional:    layerConfig.Optional,
+
+		DistanceToCenter:    layerConfig.DistanceToCenter,
+		OncePerTile:         layerConfig.OncePerTile,
+		DedupeByID:          layerConfig.DedupeByID,
+		PointOnly:           layerConfig.PointOnly,
+		RepairGeometries:    layerConfig.RepairGeometries,
+		IncludeTileCoords:   layerConfig.IncludeTileCoords,
+		IncludeGeometryType: layerConfig.IncludeGeometryType,
+		FeatureIDs:          layerConfig.FeatureIDs,
+		SortBy:              layerConfig.SortBy,
+		Extent:              uint32(layerConfig.Extent),
+		AllowUnclipped:      layerConfig.AllowUnclipped,
+		Presets:             layerConfig.Presets,
 	}
-	// TODO: How can we make this more generic?
-	if layerConfig.Source.Elasticsearch != nil && layerConfig.Source.PostGIS != nil {
-		return nil, MultipleSourcesErr
+	cacheMaxAge, err := parseCacheControl(layerConfig.CacheControl)
+	if err != nil {
+		return nil, err
 	}
-	if layerConfig.Source.Elasticsearch == nil && layerConfig.Source.PostGIS == nil {
-		return nil, NoSourcesErr
+	layer.CacheMaxAge = cacheMaxAge
+	geometryTypes, err := parseGeometryTypes(layerConfig.GeometryTypes)
+	if err != nil {
+		return nil, err
 	}
-	if layerConfig.Source.Elasticsearch != nil {
-		source, err := NewElasticsearchSource(layerConfig.Source.Elasticsearch)
-		if err != nil {
+	layer.GeometryTypes = geometryTypes
+	filters, err := parseFeatureFilters(layerConfig.Filter)
+	if err != nil {
+		return nil, err
+	}
+	layer.Filters = filters
+	computed, err := parseComputedProperties(layerConfig.Computed)
+	if err != nil {
+		return nil, err
+	}
+	layer.Computed = computed
+	if layerConfig.Raster != nil {
+		if layer.Raster, err = layerConfig.Raster.Style(); err != nil {
 			return nil, err
 		}
-		layer.Source = source
-		return layer, nil
 	}
-	if layerConfig.Source.PostGIS != nil {
-		source, err := NewPostGISSource(layerConfig.Source.PostGIS)
+	layer.Properties = layerConfig.Properties
+	if layer.Properties != nil && layer.Properties.KeyCase != "" {
+		// The feature ID and sort properties are read after the keys are normalized
+		if property := idProperty(layer.FeatureIDs); property != "" {
+			layer.FeatureIDs = PropertyFeatureIDsPrefix + normalizeKey(property, layer.Properties.KeyCase)
+		}
+		if strings.HasPrefix(layer.SortBy, SortByPropertyPrefix) {
+			property := strings.TrimPrefix(layer.SortBy, SortByPropertyPrefix)
+			layer.SortBy = SortByPropertyPrefix + normalizeKey(property, layer.Properties.KeyCase)
+		}
+	}
+	source, err := layerConfig.Source.createSource()
+	if err != nil {
+		return nil, err
+	}
+	if es, isES := source.(*ElasticsearchSource); isES {
+		es.Layer = layer.Name
+	}
+	if layerConfig.Scope != nil {
+		switch source.(type) {
+		case *ElasticsearchSource, *PostGISSource:
+			layer.Scope = layerConfig.Scope
+		default:
+			return nil, fmt.Errorf("Request scopes are only supported by Elasticsearch and PostGIS sources, for layer: %s", layer.Name)
+		}
+	}
+	if layerConfig.CircuitBreaker != nil {
+		source = NewCircuitBreakerSource(layer.Name, source, layerConfig.CircuitBreaker)
+	}
+	layer.Source = source
+	return layer, nil
+}
+
+// GetFeatures retrieves the layer's features from its Source, and applies any configured
+// post-processing steps to them
+func (l *Layer) GetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	sourceReq, err := l.scopedRequest(l.sourceRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	fc, err := l.Source.GetFeatures(ctx, sourceReq)
+	if err != nil {
+		return nil, err
+	}
+	if sourceReq.IsPartial() {
+		req.MarkPartial()
+	}
+	if l.DedupeByID {
+		if dropped := dedupeFeatures(fc); dropped > 0 {
+			Metrics.Add("duplicates_"+l.Name+"_dropped", int64(dropped))
+		}
+	}
+	if l.RepairGeometries {
+		if dropped := repairFeatures(fc); dropped > 0 {
+			RequestLogger(ctx).Warnf("Dropped %d invalid geometries from layer [%s]", dropped, l.Name)
+			Metrics.Add("invalid_"+l.Name+"_dropped", int64(dropped))
+		}
+	}
+	// Post-process the properties first, so that computed properties and filters see the
+	// normalized keys and coerced values
+	if l.Properties != nil {
+		l.Properties.Apply(fc)
+	}
+	if len(l.Computed) > 0 {
+		computeProperties(ctx, fc, l.Computed)
+	}
+	if len(l.Filters) > 0 {
+		filterFeatures(fc, l.Filters)
+	}
+	if len(l.GeometryTypes) > 0 {
+		filterGeometryTypes(fc, l.GeometryTypes)
+	}
+	if l.OncePerTile {
+		filterCentroidTile(req, fc)
+	}
+	if l.PointOnly {
+		convertToPoints(fc)
+	}
+	if l.DistanceToCenter {
+		addDistanceToCenter(req, fc)
+	}
+	if l.IncludeTileCoords {
+		addTileCoords(req, fc)
+	}
+	if l.IncludeGeometryType {
+		addGeometryTypes(fc)
+	}
+	if l.SortBy != "" {
+		sortFeatures(fc, l.SortBy)
+	}
+	if preset := l.preset(req); preset != nil {
+		preset.limitFeatures(fc)
+	}
+	return fc, nil
+}
+
+// skipFailure returns whether or not the error of retrieving the layer's features is skipped,
+// which is the case for source failures (including an open circuit breaker) of Optional
+// layers. Invalid and canceled requests still fail.
+func (l *Layer) skipFailure(ctx context.Context, err error) bool {
+	if !l.Optional || ctx.Err() != nil {
+		return false
+	}
+	switch err.(type) {
+	case InvalidRequestError, ForbiddenError:
+		return false
+	}
+	RequestLogger(ctx).Warnf("Leaving out optional layer [%s] after error: %v", l.Name, err)
+	Metrics.Add("optional_"+l.Name+"_skipped", 1)
+	return true
+}
+
+// dedupeFeatures drops the features whose ID was already seen, preserving the order of the
+// remaining features, and returns the number of dropped features. Features without an ID are
+// always kept.
+func dedupeFeatures(fc *geojson.FeatureCollection) int {
+	seen := make(map[interface{}]bool, len(fc.Features))
+	features := fc.Features[:0]
+	for _, feature := range fc.Features {
+		if feature.ID != nil {
+			key := dedupeKey(feature.ID)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		features = append(features, feature)
+	}
+	dropped := len(fc.Features) - len(features)
+	fc.Features = features
+	return dropped
+}
+
+// filterGeometryTypes drops the features whose geometry is not one of the given types
+func filterGeometryTypes(fc *geojson.FeatureCollection, types []string) {
+	features := fc.Features[:0]
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		for _, t := range types {
+			if feature.Geometry.GeoJSONType() == t {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	fc.Features = features
+}
+
+// formattedID is the dedupe key of a non-comparable feature ID, which is distinct from any
+// string ID of the same value
+type formattedID string
+
+// dedupeKey returns a comparable (map) key for a feature ID. Byte slices (e.g. PostGIS uuid or
+// numeric columns) are keyed by their string value, and other non-comparable IDs (e.g. GeoJSON
+// objects or arrays) by their formatted value.
+func dedupeKey(id interface{}) interface{} {
+	if b, isBytes := id.([]byte); isBytes {
+		return string(b)
+	}
+	if !reflect.TypeOf(id).Comparable() {
+		return formattedID(fmt.Sprint(id))
+	}
+	return id
+}
+
+// addTileCoords sets the TileZProperty, TileXProperty and TileYProperty of each feature to the
+// coordinates of the requested tile
+func addTileCoords(req *TileRequest, fc *geojson.FeatureCollection) {
+	for _, feature := range fc.Features {
+		if feature.Properties == nil {
+			feature.Properties = geojson.Properties{}
+		}
+		feature.Properties[TileZProperty] = req.Z
+		feature.Properties[TileXProperty] = req.X
+		feature.Properties[TileYProperty] = req.Y
+	}
+}
+
+// addGeometryTypes sets the GeometryTypeProperty of each feature to its GeoJSON geometry type,
+// skipping features without a geometry
+func addGeometryTypes(fc *geojson.FeatureCollection) {
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		if feature.Properties == nil {
+			feature.Properties = geojson.Properties{}
+		}
+		feature.Properties[GeometryTypeProperty] = feature.Geometry.GeoJSONType()
+	}
+}
+
+// filterCentroidTile drops the features whose centroid lies outside of the requested tile, so
+// that features spanning several tiles are only included once. The geometries of the kept
+// features are left intact.
+func filterCentroidTile(req *TileRequest, fc *geojson.FeatureCollection) {
+	tile := req.MapTile()
+	features := fc.Features[:0]
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		centroid, _ := planar.CentroidArea(feature.Geometry)
+		if maptile.At(centroid, tile.Z) == tile {
+			features = append(features, feature)
+		}
+	}
+	fc.Features = features
+}
+
+// LastModified returns the latest modification time of the layer's features for the given
+// request, or a zero time if the layer's Source can't determine it
+func (l *Layer) LastModified(ctx context.Context, req *TileRequest) (time.Time, error) {
+	source, ok := l.Source.(LastModifiedSource)
+	if !ok {
+		return time.Time{}, nil
+	}
+	sourceReq, err := l.scopedRequest(l.sourceRequest(req))
+	if _, forbidden := err.(ForbiddenError); forbidden {
+		// Leave it to the tile handler to reject the request
+		return time.Time{}, nil
+	}
+	return source.LastModified(ctx, sourceReq)
+}
+
+// sourceRequest returns the request for the layer's Source, which is the request of the
+// ancestor tile at the Maxzoom for over-zoomed tiles. The features of the ancestor tile are
+// clipped and scaled to the requested tile when encoded.
+func (l *Layer) sourceRequest(req *TileRequest) *TileRequest {
+	if !l.Overzoom || req.Z <= l.Maxzoom {
+		return req
+	}
+	shift := uint(req.Z - l.Maxzoom)
+	return &TileRequest{X: req.X >> shift, Y: req.Y >> shift, Z: l.Maxzoom, Args: req.Args, Header: req.Header, Terms: req.Terms}
+}
+
+// addDistanceToCenter sets the DistanceToCenterProperty of each feature with a geometry, based
+// on the feature centroid's position relative to the center of the requested tile
+func addDistanceToCenter(req *TileRequest, fc *geojson.FeatureCollection) {
+	tile := req.MapTile()
+	center := orb.Point{float64(tile.X) + 0.5, float64(tile.Y) + 0.5}
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		centroid, _ := planar.CentroidArea(feature.Geometry)
+		// Fraction projects the centroid into fractional tile coordinates at the tile's zoom
+		position := maptile.Fraction(centroid, tile.Z)
+		distance := planar.Distance(position, center) * mvt.DefaultExtent
+		if feature.Properties == nil {
+			feature.Properties = geojson.Properties{}
+		}
+		feature.Properties[DistanceToCenterProperty] = distance
+	}
+}
+
+// RenderTile fetches the layer's features for the given tile and encodes them in the requested
+// format (MVTFormat, GeoJSONFormat or TopoJSONFormat), returning the encoded tile along with its
+// content type. Note that MVTFormat tiles are gzipped. Scoped layers need the request headers
+// that carry the scope value, see RenderTileRequest.
+func (l *Layer) RenderTile(ctx context.Context, tile maptile.Tile, format string) ([]byte, string, error) {
+	req := &TileRequest{X: int(tile.X), Y: int(tile.Y), Z: int(tile.Z), Args: make(map[string][]string), Header: make(http.Header)}
+	return l.RenderTileRequest(ctx, req, format)
+}
+
+// RenderTileRequest is like RenderTile, for a tile request with arguments and headers (e.g. one
+// made with MakeTileRequest), using the same fetch and encode pipeline as the tile server's
+// endpoints. Whether the rendered tile is partial is reported by req.IsPartial.
+func (l *Layer) RenderTileRequest(ctx context.Context, req *TileRequest, format string) ([]byte, string, error) {
+	switch format {
+	case MVTFormat, GeoJSONFormat, TopoJSONFormat:
+	default:
+		return nil, "", fmt.Errorf("Unsupported tile format: %s", format)
+	}
+	layers := filterLayersByZoom([]Layer{*l}, req.Z)
+	fcs, err := fetchTileFeatures(ctx, req, layers, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	switch format {
+	case MVTFormat:
+		data, err := encodeVectorTile(ctx, nil, req, layers, fcs)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		return data, MVTContentType, nil
+	case GeoJSONFormat:
+		fc := geojson.NewFeatureCollection()
+		if len(fcs) > 0 {
+			fc = fcs[0]
+		}
+		data, err := json.Marshal(l.geoJSON(fc))
+		if err != nil {
+			return nil, "", err
+		}
+		return data, GeoJSONContentType, nil
+	}
+	data, err := json.Marshal(buildTopology(req, layers, fcs))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, TopoJSONContentType, nil
+}
+
+// attributedFeatureCollection is a GeoJSON FeatureCollection with a data attribution as a
+// foreign member
+type attributedFeatureCollection struct {
+	Type        string             `json:"type"`
+	BBox        geojson.BBox       `json:"bbox,omitempty"`
+	Features    []*geojson.Feature `json:"features"`
+	Attribution string             `json:"attribution"`
+}
+
+// geoJSON returns the value to encode as the layer's GeoJSON output, which carries the layer's
+// Attribution if configured
+func (l *Layer) geoJSON(fc *geojson.FeatureCollection) interface{} {
+	if l.Attribution == "" {
+		return fc
+	}
+	features := fc.Features
+	if features == nil {
+		features = []*geojson.Feature{}
+	}
+	return &attributedFeatureCollection{
+		Type:        "FeatureCollection",
+		BBox:        fc.BBox,
+		Features:    features,
+		Attribution: l.Attribution,
+	}
+}
+
+// ClipArg is the request parameter for requesting unclipped MVT geometries ("clip=false") from
+// the layers that allow it (see AllowUnclipped). Other layers are clipped as usual.
+const ClipArg = "clip"
+
+// clip returns whether or not the layer's MVT geometries are clipped for the request
+func (l *Layer) clip(req *TileRequest) bool {
+	values := req.Args[ClipArg]
+	if !l.AllowUnclipped || len(values) == 0 {
+		return true
+	}
+	clip, err := strconv.ParseBool(values[0])
+	return err != nil || clip
+}
+
+// encodeMVTLayer converts the features into a clipped (and optionally simplified) MVT layer
+// projected to the tile coordinates, which are snapped to the layer's extent grid
+func (l *Layer) encodeMVTLayer(req *TileRequest, fc *geojson.FeatureCollection) *mvt.Layer {
+	fcLayer := mvt.NewLayer(l.Name, fc)
+	fcLayer.Version = 2 // Set to tile spec v2
+	preset := l.preset(req)
+	if preset != nil && preset.Extent > 0 {
+		fcLayer.Extent = uint32(preset.Extent)
+	} else if l.Extent > 0 {
+		fcLayer.Extent = l.Extent
+	}
+	for i, feature := range fcLayer.Features {
+		feature.ID = featureID(feature, i, l.FeatureIDs)
+	}
+	fcLayer.ProjectToTile(req.MapTile())
+	if l.clip(req) {
+		// Like mapbox-gl, keep a buffer of a full tile around the tile's extent
+		extent := float64(fcLayer.Extent)
+		fcLayer.Clip(orb.Bound{Min: orb.Point{-extent, -extent}, Max: orb.Point{2*extent - 1, 2*extent - 1}})
+	}
+
+	if preset != nil && preset.Simplify > 0 {
+		fcLayer.Simplify(simplify.DouglasPeucker(preset.Simplify))
+		fcLayer.RemoveEmpty(1.0, 1.0)
+	} else if l.Simplify {
+		// Over-zoomed tiles are simplified like the tiles at the maxzoom
+		z := req.Z
+		if z > l.Maxzoom {
+			z = l.Maxzoom
 		}
-		layer.Source = source
-		return layer, nil
+		simplifyThreshold := calculateSimplificationThreshold(l.Minzoom, l.Maxzoom, z)
+		Logger.Debugf("Simplifying @ zoom [%d], epsilon [%f]", z, simplifyThreshold)
+		fcLayer.Simplify(simplify.DouglasPeucker(simplifyThreshold))
+		fcLayer.RemoveEmpty(1.0, 1.0)
 	}
-	return nil, fmt.Errorf("Invalid layer source config for layer: %s", layerConfig.Name)
+	snapFeatures(fcLayer)
+	return fcLayer
 }
@@ -1,8 +1,20 @@
 package tilenol
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,3 +36,382 @@ func TestCreateLayerNoSources(t *testing.T) {
 	_, err := CreateLayer(config)
 	assert.Equal(t, NoSourcesErr, err, "Expected to fail due to no sources for layer")
 }
+
+func TestLayerConfigValidate(t *testing.T) {
+	minzoom, maxzoom := 10, 5
+	config := LayerConfig{
+		Name: "test",
+		Source: SourceConfig{
+			PostGIS: &PostGISConfig{Table: "roads", GeometryField: "geom"},
+		},
+	}
+	assert.Nil(t, config.Validate())
+	assert.Equal(t, "postgis", config.Source.Type())
+
+	config.Minzoom, config.Maxzoom = &minzoom, &maxzoom
+	assert.NotNil(t, config.Validate(), "Expected to fail due to an invalid zoom range")
+	config.Minzoom, config.Maxzoom = nil, nil
+
+	config.Source.PostGIS.TableExpression = "SELECT * FROM roads"
+	assert.Equal(t, InvalidTableConfig, config.Validate())
+	config.Source.PostGIS.TableExpression = ""
+
+	config.CacheControl = "forever"
+	assert.NotNil(t, config.Validate(), "Expected to fail due to an invalid cacheControl")
+	config.CacheControl = ""
+
+	config.CircuitBreaker = &CircuitBreakerConfig{Cooldown: -time.Second}
+	assert.NotNil(t, config.Validate(), "Expected to fail due to a negative cooldown")
+	config.CircuitBreaker = nil
+
+	config.Name = ""
+	assert.NotNil(t, config.Validate(), "Expected to fail due to a missing name")
+}
+
+func TestParseCacheControl(t *testing.T) {
+	maxAge, err := parseCacheControl("30s")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, *maxAge)
+
+	maxAge, err = parseCacheControl(NoCache)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), *maxAge)
+
+	maxAge, err = parseCacheControl("")
+	assert.Nil(t, err)
+	assert.Nil(t, maxAge)
+
+	_, err = parseCacheControl("forever")
+	assert.NotNil(t, err, "Expected to fail parsing an invalid cacheControl value")
+}
+
+// staticSource is a fake Source that always returns a copy of the same features
+type staticSource struct {
+	features []*geojson.Feature
+}
+
+func (s *staticSource) GetFeatures(context.Context, *TileRequest) (*geojson.FeatureCollection, error) {
+	fc := geojson.NewFeatureCollection()
+	for _, f := range s.features {
+		feat := geojson.NewFeature(orb.Clone(f.Geometry))
+		feat.ID = f.ID
+		for k, v := range f.Properties {
+			feat.Properties[k] = v
+		}
+		fc.Append(feat)
+	}
+	return fc, nil
+}
+
+func newStaticSource(geoms ...orb.Geometry) *staticSource {
+	var features []*geojson.Feature
+	for i, geom := range geoms {
+		feat := geojson.NewFeature(geom)
+		feat.ID = fmt.Sprintf("%d", i)
+		feat.Properties["id"] = feat.ID
+		features = append(features, feat)
+	}
+	return &staticSource{features}
+}
+
+func TestRenderTile(t *testing.T) {
+	layer := &Layer{Name: "points", Source: newStaticSource(orb.Point{1, 1}, orb.Point{-1, -1})}
+	tile := maptile.New(0, 0, 0)
+
+	data, contentType, err := layer.RenderTile(context.Background(), tile, MVTFormat)
+	assert.Nil(t, err, "Failed to render MVT tile: %v", err)
+	assert.Equal(t, MVTContentType, contentType)
+	layers, err := mvt.UnmarshalGzipped(data)
+	assert.Nil(t, err, "Failed to decode MVT tile: %v", err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, "points", layers[0].Name)
+	assert.Len(t, layers[0].Features, 2)
+
+	data, contentType, err = layer.RenderTile(context.Background(), tile, GeoJSONFormat)
+	assert.Nil(t, err, "Failed to render GeoJSON tile: %v", err)
+	assert.Equal(t, GeoJSONContentType, contentType)
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	assert.Nil(t, err, "Failed to decode GeoJSON tile: %v", err)
+	assert.Len(t, fc.Features, 2)
+
+	layer.Attribution = "© Example Data"
+	data, _, err = layer.RenderTile(context.Background(), tile, GeoJSONFormat)
+	assert.Nil(t, err, "Failed to render GeoJSON tile: %v", err)
+	var attributed struct {
+		Type        string
+		Features    []interface{}
+		Attribution string
+	}
+	assert.Nil(t, json.Unmarshal(data, &attributed), "Failed to decode GeoJSON tile")
+	assert.Equal(t, "FeatureCollection", attributed.Type)
+	assert.Len(t, attributed.Features, 2)
+	assert.Equal(t, "© Example Data", attributed.Attribution)
+	layer.Attribution = ""
+
+	data, contentType, err = layer.RenderTile(context.Background(), tile, TopoJSONFormat)
+	assert.Nil(t, err, "Failed to render TopoJSON tile: %v", err)
+	assert.Equal(t, TopoJSONContentType, contentType)
+	var topology Topology
+	assert.Nil(t, json.Unmarshal(data, &topology), "Failed to decode TopoJSON tile")
+	assert.Contains(t, topology.Objects, "points")
+
+	_, _, err = layer.RenderTile(context.Background(), tile, "png")
+	assert.NotNil(t, err, "Expected to fail rendering an unsupported format")
+}
+
+func TestRenderTileMatchesServer(t *testing.T) {
+	layer := Layer{Name: "points", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1}, orb.Point{-1, -1})}
+	server := &Server{Cache: NewInMemoryCache(), Layers: []Layer{layer}}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/0/0/0.mvt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, _, err := layer.RenderTile(context.Background(), maptile.New(0, 0, 0), MVTFormat)
+	assert.Nil(t, err, "Failed to render MVT tile: %v", err)
+	assert.Equal(t, w.Body.Bytes(), data, "Expected the same tile as the server endpoint")
+}
+
+func TestRenderTileRequestScoped(t *testing.T) {
+	source := &termsSource{}
+	layer := &Layer{Name: "scoped", Maxzoom: MaxZoom, Source: source, Scope: &RequestScopeConfig{Header: "X-Tenant", Field: "tenant_id"}}
+	_, _, err := layer.RenderTile(context.Background(), maptile.New(0, 0, 0), MVTFormat)
+	assert.IsType(t, ForbiddenError{}, err)
+
+	r := httptest.NewRequest("GET", "/scoped/0/0/0.mvt", nil)
+	r.Header.Set("X-Tenant", "acme")
+	req, err := MakeTileRequest(r, 0, 0, 0)
+	assert.Nil(t, err)
+	_, contentType, err := layer.RenderTileRequest(context.Background(), req, MVTFormat)
+	assert.Nil(t, err, "Failed to render scoped MVT tile: %v", err)
+	assert.Equal(t, MVTContentType, contentType)
+	assert.Equal(t, []map[string]string{{"tenant_id": "acme"}}, source.terms)
+}
+
+func TestLayerConfigZoomRange(t *testing.T) {
+	minzoom, maxzoom := (&LayerConfig{}).ZoomRange()
+	assert.Equal(t, MinZoom, minzoom)
+	assert.Equal(t, MaxZoom, maxzoom)
+
+	zero, ten := 0, 10
+	minzoom, maxzoom = (&LayerConfig{Minzoom: &ten}).ZoomRange()
+	assert.Equal(t, 10, minzoom)
+	assert.Equal(t, MaxZoom, maxzoom)
+
+	minzoom, maxzoom = (&LayerConfig{Maxzoom: &zero}).ZoomRange()
+	assert.Equal(t, MinZoom, minzoom)
+	assert.Equal(t, 0, maxzoom, "An explicit maxzoom of 0 should not fall back to the default")
+}
+
+func TestLayerGetFeaturesPostProcessing(t *testing.T) {
+	layer := &Layer{
+		Name:       "points",
+		Source:     newStaticSource(orb.Point{1, 1}),
+		Properties: &PropertiesConfig{KeyCase: SnakeCase, StripPrefixes: []string{"id"}},
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features[0].Properties, 0, "Post-processing should have stripped the id property")
+}
+
+func TestLayerGetFeaturesSchemaBeforeFilters(t *testing.T) {
+	source := newStaticSource(orb.Point{1, 1}, orb.Point{2, 2})
+	source.features[0].Properties["buildingHeight"] = "12.5"
+	source.features[1].Properties["buildingHeight"] = "8"
+	filters, err := parseFeatureFilters([]string{"building_height > 10"})
+	assert.Nil(t, err)
+	layer := &Layer{
+		Name:    "buildings",
+		Source:  source,
+		Filters: filters,
+		Properties: &PropertiesConfig{
+			KeyCase: SnakeCase,
+			Schema:  map[string]string{"building_height": FloatType},
+		},
+	}
+	// The filter applies to the normalized key and the coerced value
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, 12.5, fc.Features[0].Properties["building_height"])
+}
+
+func TestLayerGetFeaturesDistanceToCenter(t *testing.T) {
+	layer := &Layer{
+		Name:             "points",
+		Source:           newStaticSource(orb.Point{0, 0}, orb.Point{90, 0}),
+		DistanceToCenter: true,
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 0})
+	assert.Nil(t, err)
+	assert.InDelta(t, 0, fc.Features[0].Properties[DistanceToCenterProperty], 1e-6)
+	assert.InDelta(t, mvt.DefaultExtent/4, fc.Features[1].Properties[DistanceToCenterProperty], 1e-6)
+}
+
+func TestLayerGetFeaturesTileCoords(t *testing.T) {
+	layer := &Layer{
+		Name:              "points",
+		Source:            newStaticSource(orb.Point{1, 1}),
+		IncludeTileCoords: true,
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{X: 2, Y: 1, Z: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fc.Features[0].Properties[TileZProperty])
+	assert.Equal(t, 2, fc.Features[0].Properties[TileXProperty])
+	assert.Equal(t, 1, fc.Features[0].Properties[TileYProperty])
+}
+
+func TestLayerGetFeaturesGeometryType(t *testing.T) {
+	layer := &Layer{
+		Name:                "mixed",
+		Source:              newStaticSource(orb.Point{1, 1}, orb.LineString{{0, 0}, {1, 1}}),
+		IncludeGeometryType: true,
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 0})
+	assert.Nil(t, err)
+	assert.Equal(t, "Point", fc.Features[0].Properties[GeometryTypeProperty])
+	assert.Equal(t, "LineString", fc.Features[1].Properties[GeometryTypeProperty])
+}
+
+func TestCreateLayerGeometryTypes(t *testing.T) {
+	types, err := parseGeometryTypes([]string{"polygon", "MultiPolygon"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Polygon", "MultiPolygon"}, types)
+
+	_, err = CreateLayer(LayerConfig{Name: "test", GeometryTypes: []string{"Circle"}})
+	assert.NotNil(t, err, "Expected to fail creating a layer with an invalid geometry type")
+}
+
+func TestCreateLayerNormalizesPropertyReferences(t *testing.T) {
+	layer, err := CreateLayer(LayerConfig{
+		Name:       "test",
+		FeatureIDs: "property:osm_id",
+		SortBy:     "property:building_height",
+		Properties: &PropertiesConfig{KeyCase: CamelCase},
+		Source:     SourceConfig{HTTP: &HTTPSourceConfig{URLTemplate: "http://localhost/{z}/{x}/{y}.json"}},
+	})
+	assert.Nil(t, err, "Failed to create layer: %v", err)
+	assert.Equal(t, "property:osmId", layer.FeatureIDs)
+	assert.Equal(t, "property:buildingHeight", layer.SortBy)
+}
+
+func TestLayerGetFeaturesGeometryTypes(t *testing.T) {
+	square := orb.Polygon{orb.Ring{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}
+	layer := &Layer{
+		Name:          "polygons",
+		Source:        newStaticSource(orb.Point{1, 1}, square, orb.LineString{{0, 0}, {1, 1}}),
+		GeometryTypes: []string{"Polygon", "MultiPolygon"},
+	}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, "Polygon", fc.Features[0].Geometry.GeoJSONType())
+}
+
+func TestLayerGetFeaturesOncePerTile(t *testing.T) {
+	// Both polygons span the x=0 and x=1 tiles at zoom 1, but only the first one's centroid
+	// lies in the x=1 tile
+	east := orb.Polygon{orb.Ring{{-10, 10}, {30, 10}, {30, 20}, {-10, 20}, {-10, 10}}}
+	west := orb.Polygon{orb.Ring{{-30, 10}, {10, 10}, {10, 20}, {-30, 20}, {-30, 10}}}
+	layer := &Layer{Name: "labels", Source: newStaticSource(east, west), OncePerTile: true}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{X: 1, Y: 0, Z: 1})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, east, fc.Features[0].Geometry)
+
+	fc, err = layer.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 1})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, west, fc.Features[0].Geometry)
+}
+
+func TestLayerGetFeaturesDedupeByID(t *testing.T) {
+	source := newStaticSource(orb.Point{1, 1}, orb.Point{2, 2}, orb.Point{3, 3}, orb.Point{4, 4})
+	source.features[2].ID = "0"
+	source.features[3].ID = nil
+	layer := &Layer{Name: "dupes", Source: source, DedupeByID: true}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 3)
+	assert.Equal(t, orb.Point{1, 1}, fc.Features[0].Geometry)
+	assert.Equal(t, orb.Point{2, 2}, fc.Features[1].Geometry)
+	assert.Equal(t, orb.Point{4, 4}, fc.Features[2].Geometry)
+	assert.Equal(t, "1", Metrics.Get("duplicates_dupes_dropped").String())
+}
+
+func TestDedupeFeaturesUnhashableIDs(t *testing.T) {
+	source := newStaticSource(orb.Point{1, 1}, orb.Point{2, 2}, orb.Point{3, 3}, orb.Point{4, 4}, orb.Point{5, 5})
+	// PostGIS uuid columns are scanned as byte slices, and GeoJSON IDs may be objects or arrays
+	source.features[0].ID = []byte("6f1c")
+	source.features[1].ID = []byte("6f1c")
+	source.features[2].ID = map[string]interface{}{"osm": 1.0}
+	source.features[3].ID = []interface{}{"way", 1.0}
+	source.features[4].ID = []interface{}{"way", 1.0}
+	layer := &Layer{Name: "unhashable", Source: source, DedupeByID: true}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 3)
+	assert.Equal(t, orb.Point{1, 1}, fc.Features[0].Geometry)
+	assert.Equal(t, orb.Point{3, 3}, fc.Features[1].Geometry)
+	assert.Equal(t, orb.Point{4, 4}, fc.Features[2].Geometry)
+}
+
+// recordingSource is a fake Source that records the tiles requested from it
+type recordingSource struct {
+	*staticSource
+	tiles []maptile.Tile
+}
+
+func (r *recordingSource) GetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	r.tiles = append(r.tiles, req.MapTile())
+	return r.staticSource.GetFeatures(ctx, req)
+}
+
+func TestLayerOverzoom(t *testing.T) {
+	source := &recordingSource{staticSource: newStaticSource(orb.Point{1, 1})}
+	layer := &Layer{Name: "points", Maxzoom: 10, Source: source}
+	tile := maptile.At(orb.Point{1, 1}, 12)
+	req := &TileRequest{X: int(tile.X), Y: int(tile.Y), Z: 12}
+	_, err := layer.GetFeatures(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, tile, source.tiles[0], "Expected the requested tile without overzoom")
+
+	layer.Overzoom = true
+	fc, err := layer.GetFeatures(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, tile.Parent().Parent(), source.tiles[1], "Expected the ancestor tile at the maxzoom")
+	assert.Len(t, filterLayersByZoom([]Layer{*layer}, 12), 1)
+
+	// The ancestor tile's features are scaled to the requested tile
+	encoded := layer.encodeMVTLayer(req, fc)
+	assert.Len(t, encoded.Features, 1)
+	point := encoded.Features[0].Geometry.(orb.Point)
+	expected := maptile.Fraction(orb.Point{1, 1}, 12)
+	assert.Equal(t, orb.Point{
+		math.Round((expected[0] - float64(tile.X)) * mvt.DefaultExtent),
+		math.Round((expected[1] - float64(tile.Y)) * mvt.DefaultExtent),
+	}, point)
+}
+
+func TestEncodeMVTLayerUnclipped(t *testing.T) {
+	tile := maptile.New(1, 1, 2)
+	// A line spanning the whole world, far beyond the tile's buffer
+	line := orb.LineString{{-170, 0}, {170, 0}}
+	encode := func(layer *Layer, args url.Values) orb.Bound {
+		fc := geojson.NewFeatureCollection()
+		fc.Append(geojson.NewFeature(line))
+		req := &TileRequest{X: int(tile.X), Y: int(tile.Y), Z: int(tile.Z), Args: args}
+		return layer.encodeMVTLayer(req, fc).Features[0].Geometry.Bound()
+	}
+	extent := float64(mvt.DefaultExtent)
+	unclipped := url.Values{ClipArg: []string{"false"}}
+
+	bound := encode(&Layer{Name: "test"}, unclipped)
+	assert.True(t, bound.Min[0] >= -extent && bound.Max[0] < 2*extent, "Layers are clipped unless they allow unclipped geometries")
+
+	layer := &Layer{Name: "test", AllowUnclipped: true}
+	bound = encode(layer, nil)
+	assert.True(t, bound.Min[0] >= -extent && bound.Max[0] < 2*extent, "Layers are clipped by default")
+	bound = encode(layer, unclipped)
+	assert.True(t, bound.Min[0] < -extent && bound.Max[0] > 2*extent, "Expected the full geometry: %v", bound)
+}
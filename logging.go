@@ -1,6 +1,9 @@
 package tilenol
 
 import (
+	"context"
+
+	"github.com/go-chi/chi/middleware"
 	"github.com/sirupsen/logrus"
 )
 
@@ -8,3 +11,12 @@ var (
 	// Logger is the global logging instance
 	Logger = logrus.New()
 )
+
+// RequestLogger returns a logger for the request of the given context, which annotates each
+// log line with the request ID (if any)
+func RequestLogger(ctx context.Context) *logrus.Entry {
+	if id := middleware.GetReqID(ctx); id != "" {
+		return Logger.WithField("request_id", id)
+	}
+	return logrus.NewEntry(Logger)
+}
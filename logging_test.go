@@ -0,0 +1,18 @@
+package tilenol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogger(t *testing.T) {
+	entry := RequestLogger(context.Background())
+	assert.NotContains(t, entry.Data, "request_id")
+
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "my-request")
+	entry = RequestLogger(ctx)
+	assert.Equal(t, "my-request", entry.Data["request_id"])
+}
@@ -0,0 +1,83 @@
+package tilenol
+
+import (
+	"context"
+	"expvar"
+)
+
+var (
+	// Metrics is the expvar map holding all of the tile server metrics, which are served by
+	// the internal /metrics endpoint
+	Metrics = expvar.NewMap("tilenol")
+)
+
+// newGauge creates a new integer metric with the given name in the Metrics map
+func newGauge(name string) *expvar.Int {
+	gauge := new(expvar.Int)
+	Metrics.Set(name, gauge)
+	return gauge
+}
+
+// WorkerPool bounds the number of CPU-bound tasks (e.g. tile encoding) that run concurrently
+type WorkerPool struct {
+	slots chan struct{}
+	// queueDepth is the number of tasks waiting for a free worker
+	queueDepth *expvar.Int
+	// active is the number of tasks currently running
+	active *expvar.Int
+}
+
+// NewWorkerPool creates a new WorkerPool with the given number of workers, and exposes its queue
+// depth and activity under the given metric name prefix
+func NewWorkerPool(size int, metricPrefix string) *WorkerPool {
+	pool := &WorkerPool{
+		slots:      make(chan struct{}, size),
+		queueDepth: newGauge(metricPrefix + "_queue_depth"),
+		active:     newGauge(metricPrefix + "_active"),
+	}
+	newGauge(metricPrefix + "_size").Set(int64(size))
+	return pool
+}
+
+// Do runs the task once a worker is available, or returns the context error if the context is
+// canceled while waiting. A nil WorkerPool runs the task immediately.
+func (p *WorkerPool) Do(ctx context.Context, task func() error) error {
+	if p == nil {
+		return task()
+	}
+	p.queueDepth.Add(1)
+	select {
+	case p.slots <- struct{}{}:
+		p.queueDepth.Add(-1)
+	case <-ctx.Done():
+		p.queueDepth.Add(-1)
+		return ctx.Err()
+	}
+	p.active.Add(1)
+	defer func() {
+		p.active.Add(-1)
+		<-p.slots
+	}()
+	return task()
+}
+
+// TryDo runs the task if a worker is available right away, and otherwise returns false
+// without running it. A nil WorkerPool runs the task immediately.
+func (p *WorkerPool) TryDo(task func()) bool {
+	if p == nil {
+		task()
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false
+	}
+	p.active.Add(1)
+	defer func() {
+		p.active.Add(-1)
+		<-p.slots
+	}()
+	task()
+	return true
+}
@@ -0,0 +1,87 @@
+package tilenol
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	pool := NewWorkerPool(2, "test_pool")
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.Do(context.Background(), func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	assert.True(t, maxRunning <= 2, "Too many concurrent tasks: %d", maxRunning)
+	assert.Equal(t, int64(0), pool.queueDepth.Value())
+	assert.Equal(t, int64(0), pool.active.Value())
+}
+
+func TestWorkerPoolCanceled(t *testing.T) {
+	pool := NewWorkerPool(1, "test_pool")
+	release := make(chan struct{})
+	go pool.Do(context.Background(), func() error {
+		<-release
+		return nil
+	})
+	defer close(release)
+	// Wait until the only worker is busy
+	for pool.active.Value() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := pool.Do(ctx, func() error {
+		t.Error("Task should not run after its context is done")
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNilWorkerPool(t *testing.T) {
+	var pool *WorkerPool
+	var ran bool
+	pool.Do(context.Background(), func() error {
+		ran = true
+		return nil
+	})
+	assert.True(t, ran, "A nil WorkerPool should run tasks immediately")
+}
+
+func TestWorkerPoolTryDo(t *testing.T) {
+	pool := NewWorkerPool(1, "test_try_pool")
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go pool.TryDo(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	ran := pool.TryDo(func() {})
+	assert.False(t, ran, "Tasks should be skipped while all workers are busy")
+	close(release)
+
+	var nilPool *WorkerPool
+	assert.True(t, nilPool.TryDo(func() {}))
+}
@@ -0,0 +1,118 @@
+package tilenol
+
+import (
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+)
+
+// convertToPoints replaces the geometry of each feature with a representative point, e.g. to
+// drive label layers from polygon data
+func convertToPoints(fc *geojson.FeatureCollection) {
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		if point, ok := representativePoint(feature.Geometry); ok {
+			feature.Geometry = point
+		}
+	}
+}
+
+// representativePoint returns a point representing the geometry: the centroid, unless the
+// geometry is a (multi)polygon whose centroid lies outside of it (e.g. a U-shaped polygon), in
+// which case a point on the surface of its largest polygon is used instead. Empty geometries
+// don't have a representative point.
+func representativePoint(g orb.Geometry) (orb.Point, bool) {
+	switch g := g.(type) {
+	case orb.Point:
+		return g, true
+	case orb.Ring:
+		return representativePoint(orb.Polygon{g})
+	case orb.Bound:
+		return g.Center(), true
+	case orb.Polygon:
+		if len(g) == 0 || len(g[0]) == 0 {
+			return orb.Point{}, false
+		}
+		centroid, _ := planar.CentroidArea(g)
+		if planar.PolygonContains(g, centroid) {
+			return centroid, true
+		}
+		return pointOnSurface(g), true
+	case orb.MultiPolygon:
+		var largest orb.Polygon
+		var largestArea float64
+		for _, polygon := range g {
+			if area := planar.Area(polygon); largest == nil || area > largestArea {
+				largest, largestArea = polygon, area
+			}
+		}
+		if largest == nil {
+			return orb.Point{}, false
+		}
+		centroid, _ := planar.CentroidArea(g)
+		if planar.MultiPolygonContains(g, centroid) {
+			return centroid, true
+		}
+		return representativePoint(largest)
+	}
+	if isEmptyGeometry(g) {
+		return orb.Point{}, false
+	}
+	centroid, _ := planar.CentroidArea(g)
+	return centroid, true
+}
+
+// isEmptyGeometry returns whether or not the geometry doesn't have any positions
+func isEmptyGeometry(g orb.Geometry) bool {
+	switch g := g.(type) {
+	case orb.MultiPoint:
+		return len(g) == 0
+	case orb.LineString:
+		return len(g) == 0
+	case orb.MultiLineString:
+		for _, ls := range g {
+			if len(ls) > 0 {
+				return false
+			}
+		}
+		return true
+	case orb.Collection:
+		for _, child := range g {
+			if !isEmptyGeometry(child) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// pointOnSurface returns a point inside the polygon, which is the middle of the widest span of
+// the polygon's interior along the horizontal line through the middle of its bound
+func pointOnSurface(polygon orb.Polygon) orb.Point {
+	bound := polygon.Bound()
+	y := (bound.Min[1] + bound.Max[1]) / 2
+	var xs []float64
+	for _, ring := range polygon {
+		for i := range ring {
+			// Rings aren't necessarily closed
+			a, b := ring[i], ring[(i+1)%len(ring)]
+			// Half-open crossings avoid counting the vertices on the line twice
+			if (a[1] > y) != (b[1] > y) {
+				xs = append(xs, a[0]+(y-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+			}
+		}
+	}
+	sort.Float64s(xs)
+	point, width := bound.Center(), -1.0
+	for i := 0; i+1 < len(xs); i += 2 {
+		if w := xs[i+1] - xs[i]; w > width {
+			point, width = orb.Point{(xs[i] + xs[i+1]) / 2, y}, w
+		}
+	}
+	return point
+}
@@ -0,0 +1,48 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepresentativePoint(t *testing.T) {
+	square := orb.Polygon{{{0, 0}, {2, 0}, {2, 2}, {0, 2}, {0, 0}}}
+	point, ok := representativePoint(square)
+	assert.True(t, ok)
+	assert.Equal(t, orb.Point{1, 1}, point)
+
+	// The centroid of a U-shaped polygon lies in its gap
+	u := orb.Polygon{{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}, {0, 0}}}
+	point, ok = representativePoint(u)
+	assert.True(t, ok)
+	assert.True(t, planar.PolygonContains(u, point), "Expected a point on the surface: %v", point)
+
+	multi := orb.MultiPolygon{{{{10, 10}, {11, 10}, {11, 11}, {10, 10}}}, u}
+	point, ok = representativePoint(multi)
+	assert.True(t, ok)
+	assert.True(t, planar.PolygonContains(u, point), "Expected a point on the largest polygon: %v", point)
+
+	point, ok = representativePoint(orb.LineString{{0, 0}, {2, 0}})
+	assert.True(t, ok)
+	assert.Equal(t, orb.Point{1, 0}, point)
+
+	_, ok = representativePoint(orb.Polygon{})
+	assert.False(t, ok)
+	_, ok = representativePoint(orb.MultiLineString{})
+	assert.False(t, ok)
+}
+
+func TestConvertToPoints(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(orb.Polygon{{{0, 0}, {2, 0}, {2, 2}, {0, 2}, {0, 0}}}))
+	fc.Append(geojson.NewFeature(orb.Point{5, 5}))
+	fc.Append(geojson.NewFeature(orb.MultiPoint{}))
+	convertToPoints(fc)
+	assert.Equal(t, orb.Point{1, 1}, fc.Features[0].Geometry)
+	assert.Equal(t, orb.Point{5, 5}, fc.Features[1].Geometry)
+	assert.Equal(t, orb.MultiPoint{}, fc.Features[2].Geometry, "Empty geometries are left as is")
+}
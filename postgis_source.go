@@ -3,15 +3,21 @@ package tilenol
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"regexp"
 	"strings"
 	"time"
 
 	// SQL deps
 	"github.com/doug-martin/goqu/v9"
 	_ "github.com/doug-martin/goqu/v9/dialect/postgres"
-	_ "github.com/lib/pq"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/lib/pq"
 	// Geo deps
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
@@ -19,39 +25,137 @@ import (
 
 const (
 	CTEName = "__tilenol__table"
+	// postGISFeaturesAlias is the alias of the feature subquery in GeoJSONMode queries
+	postGISFeaturesAlias = "__tilenol__features"
+	// WGS84SRID is the spatial reference ID used for tile bounds and output geometries
+	WGS84SRID = 4326
 	// TODO: Externalize this?
 	QueryTimeout = 30 * time.Second
 )
 
 var (
-	InvalidTableConfig = errors.New("Either \"tableExpression\" or \"table\" + \"schema\" can be set, not both.")
+	InvalidTableConfig    = errors.New("Either \"tableExpression\" or \"table\" + \"schema\" can be set, not both.")
+	InvalidSampleConfig   = errors.New("Sampling requires a \"table\", a \"percent\" between 0 and 100, and a \"method\" of SYSTEM or BERNOULLI.")
+	InvalidFunctionConfig = errors.New("A \"function\" can't be combined with a \"table\" or \"tableExpression\", and its \"functionArgs\" must be tile or bounds.")
 )
 
+const (
+	// TileFunctionArgs calls the Function of a PostGIS source with the z, x and y coordinates
+	// of the requested tile
+	TileFunctionArgs = "tile"
+	// BoundsFunctionArgs calls the Function of a PostGIS source with the WGS84 bounds (xmin,
+	// ymin, xmax, ymax) of the requested tile
+	BoundsFunctionArgs = "bounds"
+)
+
+// functionPattern matches an optionally schema-qualified SQL function name
+var functionPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// PostGISSampleConfig is the YAML configuration structure for TABLESAMPLE-based sampling of
+// the source table
+type PostGISSampleConfig struct {
+	// Percent is the percentage of the table to sample, between 0 and 100
+	Percent float64 `yaml:"percent"`
+	// Method is the TABLESAMPLE method to use, either SYSTEM (default) or BERNOULLI
+	Method string `yaml:"method"`
+	// Seed is the REPEATABLE seed, which keeps the sampled rows stable across requests
+	Seed int `yaml:"seed"`
+	// Maxzoom is the optional maximum zoom level at which sampling is applied
+	Maxzoom *int `yaml:"maxzoom"`
+}
+
 // PostGISConfig is the YAML configuration structure for configuring a new
 // PostGISSource
 type PostGISConfig struct {
 	// DSN is the "data source name" that specifies how to connect to the database server
 	DSN string `yaml:"dsn"`
+	// ReplicaDSN is the optional DSN of a read replica, which serves all tile reads in place
+	// of the primary DSN, falling back to the primary when the replica connection fails
+	ReplicaDSN string `yaml:"replicaDSN"`
 	// Schema is the table space to use for queries
 	Schema string `yaml:"schema"`
 	// Table is the name of the table to use for queries
 	Table string `yaml:"table"`
 	// TableExpression is a valid SQL query that is used as an alternative to Schema and Table
 	TableExpression string `yaml:"tableExpression"`
+	// Function is the optional (schema-qualified) name of a set-returning SQL function that is
+	// used as an alternative to Table and TableExpression, which is called for each tile
+	// (e.g. "SELECT * FROM get_features(z, x, y)")
+	Function string `yaml:"function"`
+	// FunctionArgs configures the arguments that the Function is called with: the tile
+	// coordinates (TileFunctionArgs, the default) or the tile bounds (BoundsFunctionArgs)
+	FunctionArgs string `yaml:"functionArgs"`
 	// GeometryField is the name of the column that holds the feature geometry
 	GeometryField string `yaml:"geometryField"`
+	// SRID is the spatial reference ID of the stored geometries (defaults to 4326)
+	SRID int `yaml:"srid"`
 	// SourceFields is a mapping from the feature property name to the source row
 	// column names
 	SourceFields map[string]string `yaml:"sourceFields"`
+	// MaxFeatures is the optional maximum number of features returned per tile, either as a
+	// flat number or scaling with the zoom level (see FeatureLimitConfig)
+	MaxFeatures FeatureLimitConfig `yaml:"maxFeatures"`
+	// PriorityField is the optional name of a numeric column ranking the importance of each
+	// feature, so that the highest-priority features of a tile are the ones kept by
+	// MaxFeatures (e.g. for label or POI layers)
+	PriorityField string `yaml:"priorityField"`
+	// Sample optionally configures sampling of the source table, e.g. for low zoom levels
+	Sample *PostGISSampleConfig `yaml:"sample"`
+	// FeatureMinzoomField is the optional name of a numeric column holding the minimum zoom
+	// level at which each feature is shown
+	FeatureMinzoomField string `yaml:"featureMinzoomField"`
+	// TimeField is the optional name of a timestamp column holding the last modification time
+	// of each row, used to compute the Last-Modified header of tiles and to filter features for
+	// SinceArg requests
+	TimeField string `yaml:"timeField"`
+	// GeoJSONMode configures the source to have PostGIS build the whole FeatureCollection as a
+	// single GeoJSON document (via json_build_object and ST_AsGeoJSON), rather than decoding
+	// the geometry of each row
+	GeoJSONMode bool `yaml:"geojsonMode"`
+}
+
+// GetSRID returns the configured SRID, falling back to WGS84 when unset
+func (c *PostGISConfig) GetSRID() int {
+	if c.SRID == 0 {
+		return WGS84SRID
+	}
+	return c.SRID
 }
 
 // Dataset constructs a CTE-based SelectDataset to be used as the source table for all request-time
 // queries
 func (c *PostGISConfig) Dataset() (*goqu.SelectDataset, error) {
+	return c.dataset(false)
+}
+
+// SampledDataset constructs a CTE-based SelectDataset like Dataset, but samples the source table
+// using TABLESAMPLE. If no sampling is configured, it returns nil.
+func (c *PostGISConfig) SampledDataset() (*goqu.SelectDataset, error) {
+	if c.Sample == nil {
+		return nil, nil
+	}
+	return c.dataset(true)
+}
+
+// dataset constructs a CTE-based SelectDataset, optionally sampling the source table. Function
+// sources don't have a static dataset, see functionDataset.
+func (c *PostGISConfig) dataset(sample bool) (*goqu.SelectDataset, error) {
 	// Ensure that table configuration makes sense
 	if c.TableExpression != "" && (c.Schema != "" || c.Table != "") {
 		return nil, InvalidTableConfig
 	}
+	if c.Function != "" {
+		if c.Table != "" || c.TableExpression != "" || !functionPattern.MatchString(c.Function) {
+			return nil, InvalidFunctionConfig
+		}
+		if c.FunctionArgs != "" && c.FunctionArgs != TileFunctionArgs && c.FunctionArgs != BoundsFunctionArgs {
+			return nil, InvalidFunctionConfig
+		}
+		if sample {
+			return nil, InvalidSampleConfig
+		}
+		return nil, nil
+	}
 
 	var table goqu.Expression
 	if c.Table != "" {
@@ -59,8 +163,19 @@ func (c *PostGISConfig) Dataset() (*goqu.SelectDataset, error) {
 		if c.Schema != "" {
 			relation = relation.Schema(c.Schema)
 		}
-		table = goqu.From(relation)
+		if sample {
+			sampled, err := c.Sample.tableSample(relation)
+			if err != nil {
+				return nil, err
+			}
+			table = goqu.From(sampled)
+		} else {
+			table = goqu.From(relation)
+		}
 	} else if c.TableExpression != "" {
+		if sample {
+			return nil, InvalidSampleConfig
+		}
 		var tableExp = strings.TrimSpace(c.TableExpression)
 		if !strings.HasPrefix(tableExp, "(") {
 			tableExp = fmt.Sprintf("(%s)", tableExp)
@@ -70,13 +185,67 @@ func (c *PostGISConfig) Dataset() (*goqu.SelectDataset, error) {
 	return goqu.From(CTEName).With(CTEName, table), nil
 }
 
+// functionDataset constructs a CTE-based SelectDataset like Dataset, whose source table is the
+// result of calling the Function for the requested tile
+func functionDataset(function, args string, req *TileRequest) *goqu.SelectDataset {
+	var call exp.SQLFunctionExpression
+	if args == BoundsFunctionArgs {
+		bound := req.MapTile().Bound()
+		call = goqu.Func(function, bound.Min.X(), bound.Min.Y(), bound.Max.X(), bound.Max.Y())
+	} else {
+		call = goqu.Func(function, req.Z, req.X, req.Y)
+	}
+	return goqu.From(CTEName).With(CTEName, goqu.From(call))
+}
+
+// tableSample creates a TABLESAMPLE expression for the given table
+func (s *PostGISSampleConfig) tableSample(relation exp.IdentifierExpression) (goqu.Expression, error) {
+	method := strings.ToUpper(s.Method)
+	if method == "" {
+		method = "SYSTEM"
+	}
+	if (method != "SYSTEM" && method != "BERNOULLI") || s.Percent <= 0 || s.Percent > 100 {
+		return nil, InvalidSampleConfig
+	}
+	return goqu.L(fmt.Sprintf("? TABLESAMPLE %s (?) REPEATABLE (?)", method), relation, s.Percent, s.Seed), nil
+}
+
+// appliesTo determines whether or not sampling should be used at the given zoom level
+func (s *PostGISSampleConfig) appliesTo(z int) bool {
+	return s.Maxzoom == nil || z <= *s.Maxzoom
+}
+
 // PostGISSource is a Source implementation that retrieves feature data from a
 // PostGIS server
 type PostGISSource struct {
 	DB            *goqu.Database
 	Dataset       *goqu.SelectDataset
 	GeometryField string
+	SRID          int
 	SourceFields  map[string]string
+	MaxFeatures   int
+	// FeatureLimit optionally overrides MaxFeatures with a zoom-dependent limit
+	FeatureLimit *FeatureLimitConfig
+	// PriorityField is the optional name of the column that features are sorted by (in
+	// descending order)
+	PriorityField string
+	// SampledDataset is the optional sampled variant of Dataset, used when Sample applies
+	SampledDataset *goqu.SelectDataset
+	Sample         *PostGISSampleConfig
+	// FeatureMinzoomField is the optional name of the column holding the per-feature minimum
+	// zoom level
+	FeatureMinzoomField string
+	// TimeField is the optional name of the column holding the row modification time
+	TimeField string
+	// GeoJSONMode configures the source to query the features as a single GeoJSON document
+	GeoJSONMode bool
+	// Function is the optional name of the SQL function whose result replaces the Dataset for
+	// each tile, called with FunctionArgs
+	Function     string
+	FunctionArgs string
+	// Replica is the optional read replica that queries are run against before falling back
+	// to the primary DB
+	Replica *goqu.Database
 }
 
 // CheckPing asserts that we can ping the connected database
@@ -101,9 +270,90 @@ func CheckReadOnly(db *sql.DB) error {
 	return nil
 }
 
+// CheckGeometryColumn asserts that the configured geometry column is registered in PostGIS'
+// geometry_columns (or geography_columns) view with the configured SRID. Table expressions
+// can't be checked this way, so they are skipped. Columns that aren't registered (e.g. of
+// some views) or that have no SRID constraint (SRID 0) can't be checked either, which is
+// logged as a warning.
+func CheckGeometryColumn(db *sql.DB, config *PostGISConfig) error {
+	if config.Table == "" {
+		return nil
+	}
+	srid, err := registeredSRID(db, config, "geometry_columns", "f_geometry_column")
+	if err == sql.ErrNoRows {
+		srid, err = registeredSRID(db, config, "geography_columns", "f_geography_column")
+	}
+	if err == sql.ErrNoRows {
+		Logger.Warnf("Can't check the SRID of geometry column \"%s\" of table \"%s\", which isn't registered in geometry_columns or geography_columns",
+			config.GeometryField, config.Table)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if srid == 0 {
+		Logger.Warnf("Can't check the SRID of geometry column \"%s\" of table \"%s\", which has no SRID constraint",
+			config.GeometryField, config.Table)
+		return nil
+	}
+	if srid != config.GetSRID() {
+		return fmt.Errorf("Geometry column \"%s\" has SRID %d, but SRID %d is configured",
+			config.GeometryField, srid, config.GetSRID())
+	}
+	return nil
+}
+
+// registeredSRID looks up the SRID of the configured geometry column in a PostGIS column
+// registry view, returning sql.ErrNoRows if the column isn't registered in it
+func registeredSRID(db *sql.DB, config *PostGISConfig, view, column string) (int, error) {
+	q := goqu.Dialect("postgres").
+		From(view).
+		Select("srid").
+		Where(goqu.Ex{
+			"f_table_name": config.Table,
+			column:         config.GeometryField,
+		})
+	if config.Schema != "" {
+		q = q.Where(goqu.Ex{"f_table_schema": config.Schema})
+	} else {
+		q = q.Where(goqu.C("f_table_schema").Eq(goqu.L("current_schema()")))
+	}
+	checkSQL, _, err := q.ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	var srid int
+	if err := db.QueryRow(checkSQL).Scan(&srid); err != nil {
+		return 0, err
+	}
+	return srid, nil
+}
+
+// Validate checks that the PostGISConfig is well-formed, without connecting to the database
+func (c *PostGISConfig) Validate() error {
+	if c.GeometryField == "" {
+		return errors.New("PostGIS sources must have a \"geometryField\" configured")
+	}
+	if _, err := c.Dataset(); err != nil {
+		return err
+	}
+	if _, err := c.SampledDataset(); err != nil {
+		return err
+	}
+	return c.MaxFeatures.Validate()
+}
+
 // NewPostGISSource creates a new Source that retrieves feature data from a
 // PostGIS server
 func NewPostGISSource(config *PostGISConfig) (Source, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var featureLimit *FeatureLimitConfig
+	if config.MaxFeatures.scales() {
+		featureLimit = &config.MaxFeatures
+	}
+
 	// Open the database connection
 	pgDB, pgErr := sql.Open("postgres", config.DSN)
 	if pgErr != nil {
@@ -120,17 +370,52 @@ func NewPostGISSource(config *PostGISConfig) (Source, error) {
 		return nil, err
 	}
 
+	// Make sure that the geometry column exists with the expected SRID
+	if err := CheckGeometryColumn(pgDB, config); err != nil {
+		return nil, err
+	}
+
+	// Connect to the read replica, which may be unavailable at startup since reads fall back to
+	// the primary anyway
+	var replica *goqu.Database
+	if config.ReplicaDSN != "" {
+		replicaDB, err := sql.Open("postgres", config.ReplicaDSN)
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckPing(replicaDB); err != nil {
+			Logger.Warnf("Failed to connect to the PostGIS read replica, falling back to the primary: %v", err)
+		}
+		replica = goqu.Dialect("postgres").DB(replicaDB)
+	}
+
 	// Create the base select dataset for request-time queries
 	dataset, err := config.Dataset()
 	if err != nil {
 		return nil, err
 	}
+	sampledDataset, err := config.SampledDataset()
+	if err != nil {
+		return nil, err
+	}
 
 	return &PostGISSource{
-		DB:            goqu.Dialect("postgres").DB(pgDB),
-		Dataset:       dataset,
-		GeometryField: config.GeometryField,
-		SourceFields:  config.SourceFields,
+		DB:                  goqu.Dialect("postgres").DB(pgDB),
+		Replica:             replica,
+		Dataset:             dataset,
+		GeometryField:       config.GeometryField,
+		SRID:                config.GetSRID(),
+		SourceFields:        config.SourceFields,
+		MaxFeatures:         config.MaxFeatures.Limit,
+		FeatureLimit:        featureLimit,
+		PriorityField:       config.PriorityField,
+		SampledDataset:      sampledDataset,
+		Sample:              config.Sample,
+		FeatureMinzoomField: config.FeatureMinzoomField,
+		TimeField:           config.TimeField,
+		GeoJSONMode:         config.GeoJSONMode,
+		Function:            config.Function,
+		FunctionArgs:        config.FunctionArgs,
 	}, nil
 }
 
@@ -144,22 +429,102 @@ func (p *PostGISSource) withExtraFields(extraFields map[string]string) *PostGISS
 	for k, v := range extraFields {
 		sourceFields[k] = v
 	}
-	return &PostGISSource{
-		DB:            p.DB,
-		Dataset:       p.Dataset,
-		GeometryField: p.GeometryField,
-		SourceFields:  sourceFields,
+	clone := *p
+	clone.SourceFields = sourceFields
+	return &clone
+}
+
+// forTile returns the source whose Dataset calls the Function for the requested tile, or the
+// source itself if it doesn't have a Function
+func (p *PostGISSource) forTile(req *TileRequest) *PostGISSource {
+	if p.Function == "" {
+		return p
 	}
+	clone := *p
+	clone.Dataset = functionDataset(p.Function, p.FunctionArgs, req)
+	return &clone
+}
+
+// needsTransform determines whether or not the stored geometries need to be transformed
+// to/from WGS84
+func (p *PostGISSource) needsTransform() bool {
+	return p.SRID != 0 && p.SRID != WGS84SRID
+}
+
+// geometryFilter creates an ST_Intersects expression for an arbitrary WGS84 geometry
+func (p *PostGISSource) geometryFilter(geom orb.Geometry) (goqu.Expression, error) {
+	gj, err := json.Marshal(geojson.NewGeometry(geom))
+	if err != nil {
+		return nil, err
+	}
+	var shape interface{} = goqu.Func("ST_SetSRID", goqu.Func("ST_GeomFromGeoJSON", string(gj)), WGS84SRID)
+	if p.needsTransform() {
+		shape = goqu.Func("ST_Transform", shape, p.SRID)
+	}
+	return goqu.Func("ST_Intersects", goqu.I(p.GeometryField), shape), nil
 }
 
 // Constructs a raw SQL statement from the tile request parameters
 func (p *PostGISSource) buildSQL(bounds orb.Bound, extraFilters ...goqu.Expression) (string, error) {
+	// Select the geometries as WKB, which is decoded for each row
+	q := p.buildDataset(goqu.Func("ST_AsBinary", p.geometryColumn()), bounds, extraFilters...)
+
+	// Lastly, compile and return the results
+	sql, _, err := q.ToSQL()
+	if err != nil {
+		return "", err
+	}
+	return sql, nil
+}
+
+// buildGeoJSONSQL constructs a raw SQL statement that returns the features for the tile request
+// parameters as a single GeoJSON FeatureCollection document (see GeoJSONMode)
+func (p *PostGISSource) buildGeoJSONSQL(bounds orb.Bound, extraFilters ...goqu.Expression) (string, error) {
+	features := p.buildDataset(goqu.L("ST_AsGeoJSON(?)::json", p.geometryColumn()), bounds, extraFilters...)
+
+	// The properties are all of the selected source fields, apart from the geometry
+	var id interface{}
+	if _, exists := p.SourceFields["id"]; exists {
+		id = goqu.I(postGISFeaturesAlias + ".id")
+	}
+	feature := goqu.L(
+		"json_build_object('type', 'Feature', 'id', ?, 'geometry', ?, 'properties', jsonb_strip_nulls(to_jsonb(?) - ?))",
+		id,
+		goqu.I(postGISFeaturesAlias+"."+p.GeometryField),
+		goqu.I(postGISFeaturesAlias),
+		p.GeometryField,
+	)
+	q := goqu.From(features.As(postGISFeaturesAlias)).Select(goqu.L(
+		"json_build_object('type', 'FeatureCollection', 'features', COALESCE(json_agg(?), '[]'::json))",
+		feature,
+	))
+
+	sql, _, err := q.ToSQL()
+	if err != nil {
+		return "", err
+	}
+	return sql, nil
+}
+
+// geometryColumn returns the geometry column expression, making sure that the geometry is
+// output in WGS84
+func (p *PostGISSource) geometryColumn() interface{} {
+	var geometry interface{} = goqu.I(p.GeometryField)
+	if p.needsTransform() {
+		geometry = goqu.Func("ST_Transform", geometry, WGS84SRID)
+	}
+	return geometry
+}
+
+// buildDataset creates the feature query for the tile request parameters, selecting the given
+// geometry expression along with the source fields
+func (p *PostGISSource) buildDataset(geometry interface{}, bounds orb.Bound, extraFilters ...goqu.Expression) *goqu.SelectDataset {
 	// Create the base query from the provided table or table expression
 	var q = p.Dataset.Clone().(*goqu.SelectDataset)
 
 	// Add the columns we want to select out of the table
 	var selectColumns = []interface{}{
-		goqu.Func("ST_AsBinary", goqu.I(p.GeometryField)).As(p.GeometryField),
+		goqu.L("?", geometry).As(p.GeometryField),
 	}
 	for dst, src := range p.SourceFields {
 		sourceColExpression := goqu.L(src).As(dst)
@@ -167,21 +532,54 @@ func (p *PostGISSource) buildSQL(bounds orb.Bound, extraFilters ...goqu.Expressi
 	}
 	q = q.Select(selectColumns...)
 
-	// Create an envelope expression from the tile bounds
-	envelope := goqu.Func("ST_MakeEnvelope",
+	// Add a geo-bounds WHERE clause to the query
+	q = q.Where(p.boundsFilter(bounds))
+
+	// Add any extra request-time filter expressions to the WHERE clause of the query
+	q = q.Where(extraFilters...)
+
+	// Return the highest-priority features first, so that they're the ones within the cap
+	if p.PriorityField != "" {
+		q = q.Order(goqu.I(p.PriorityField).Desc().NullsLast())
+	}
+
+	// Cap the number of returned features
+	if p.MaxFeatures > 0 {
+		q = q.Limit(uint(p.MaxFeatures))
+	}
+	return q
+}
+
+// boundsFilter creates an intersection filter expression for the given WGS84 bounds, in the
+// SRID of the stored geometries
+func (p *PostGISSource) boundsFilter(bounds orb.Bound) goqu.Expression {
+	var envelope interface{} = goqu.Func("ST_MakeEnvelope",
 		bounds.Min.X(),
 		bounds.Min.Y(),
 		bounds.Max.X(),
 		bounds.Max.Y(),
-		4326)
-	// Add a geo-bounds WHERE clause to the query
-	geoBoundsExpression := goqu.Func("ST_Intersects", goqu.I(p.GeometryField), envelope)
-	q = q.Where(geoBoundsExpression)
+		WGS84SRID)
+	if p.needsTransform() {
+		envelope = goqu.Func("ST_Transform", envelope, p.SRID)
+	}
+	return goqu.Func("ST_Intersects", goqu.I(p.GeometryField), envelope)
+}
 
-	// Add any extra request-time filter expressions to the WHERE clause of the query
-	q = q.Where(extraFilters...)
+// termFilters creates the filter expressions of the mandatory term filters of the request
+func termFilters(req *TileRequest) []goqu.Expression {
+	var filters []goqu.Expression
+	for _, field := range req.termFields() {
+		filters = append(filters, goqu.I(field).Eq(req.Terms[field]))
+	}
+	return filters
+}
 
-	// Lastly, compile and return the results
+// buildLastModifiedSQL creates the SQL query for the latest TimeField value within the bounds
+func (p *PostGISSource) buildLastModifiedSQL(bounds orb.Bound, extraFilters ...goqu.Expression) (string, error) {
+	q := p.Dataset.Clone().(*goqu.SelectDataset).
+		Select(goqu.MAX(p.TimeField)).
+		Where(p.boundsFilter(bounds)).
+		Where(extraFilters...)
 	sql, _, err := q.ToSQL()
 	if err != nil {
 		return "", err
@@ -189,37 +587,177 @@ func (p *PostGISSource) buildSQL(bounds orb.Bound, extraFilters ...goqu.Expressi
 	return sql, nil
 }
 
-// Actually runs the compiled SQL query, and returns a list of mapped records upon success
+// LastModified implements the LastModifiedSource interface, returning the latest TimeField
+// value of the rows within the tile bounds (or a zero time when TimeField isn't configured)
+func (p *PostGISSource) LastModified(ctx context.Context, req *TileRequest) (time.Time, error) {
+	if p.TimeField == "" {
+		return time.Time{}, nil
+	}
+	q, err := p.forTile(req).buildLastModifiedSQL(req.MapTile().Bound(), termFilters(req)...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var lastModified sql.NullTime
+	err = p.readOnly(ctx, func(qCtx context.Context, tx *goqu.TxDatabase) error {
+		RequestLogger(qCtx).Debugf("Executing SQL: %s\n", q)
+		return tx.QueryRowContext(qCtx, q).Scan(&lastModified)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !lastModified.Valid {
+		return time.Time{}, nil
+	}
+	return lastModified.Time, nil
+}
+
+// Actually runs the compiled SQL query, and returns a list of mapped records upon success. If
+// the query fails due to a stale or broken connection (e.g. after a database restart), the
+// query is retried once on a freshly established connection. Connections aren't pinged on
+// checkout: database/sql already discards a pooled connection and transparently retries on
+// another one when the driver reports driver.ErrBadConn before the query was sent, so only
+// connections that break mid-query need this retry. Timed out queries are never retried.
 func (p *PostGISSource) runQuery(ctx context.Context, q string) ([]map[string]interface{}, error) {
+	records, err := p.doRunQuery(ctx, q)
+	if err != nil && isConnectionError(err) && ctx.Err() == nil {
+		RequestLogger(ctx).Warnf("Retrying SQL query after connection error: %v", err)
+		records, err = p.doRunQuery(ctx, q)
+	}
+	return records, err
+}
+
+// doRunQuery executes a single attempt of the compiled SQL query
+func (p *PostGISSource) doRunQuery(ctx context.Context, q string) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	err := p.readOnly(ctx, func(qCtx context.Context, tx *goqu.TxDatabase) error {
+		// Actually execute the query
+		RequestLogger(qCtx).Debugf("Executing SQL: %s\n", q)
+		rows, err := tx.QueryContext(qCtx, q)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		// Re-map the row objects to a list of map-like records
+		records, err = RowsToMaps(rows, p.GeometryField)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// runGeoJSONQuery runs the compiled GeoJSON SQL query (see GeoJSONMode), and returns the
+// resulting FeatureCollection document. Like runQuery, it is retried once after a connection
+// error.
+func (p *PostGISSource) runGeoJSONQuery(ctx context.Context, q string) ([]byte, error) {
+	data, err := p.doRunGeoJSONQuery(ctx, q)
+	if err != nil && isConnectionError(err) && ctx.Err() == nil {
+		RequestLogger(ctx).Warnf("Retrying SQL query after connection error: %v", err)
+		data, err = p.doRunGeoJSONQuery(ctx, q)
+	}
+	return data, err
+}
+
+// doRunGeoJSONQuery executes a single attempt of the compiled GeoJSON SQL query
+func (p *PostGISSource) doRunGeoJSONQuery(ctx context.Context, q string) ([]byte, error) {
+	var data []byte
+	err := p.readOnly(ctx, func(qCtx context.Context, tx *goqu.TxDatabase) error {
+		RequestLogger(qCtx).Debugf("Executing SQL: %s\n", q)
+		return tx.QueryRowContext(qCtx, q).Scan(&data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readOnly runs the function within a read-only transaction that is bounded by QueryTimeout. If
+// a Replica is configured, the function is run against it first, and against the primary DB if
+// the replica connection fails.
+func (p *PostGISSource) readOnly(ctx context.Context, fn func(context.Context, *goqu.TxDatabase) error) error {
+	if p.Replica != nil {
+		err := runReadOnly(ctx, p.Replica, fn)
+		if err == nil || !isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+		RequestLogger(ctx).Warnf("Falling back to the primary database after replica connection error: %v", err)
+	}
+	return runReadOnly(ctx, p.DB, fn)
+}
+
+// runReadOnly runs the function within a read-only transaction of the database
+func runReadOnly(ctx context.Context, db *goqu.Database, fn func(context.Context, *goqu.TxDatabase) error) error {
 	// Create a cancellable context using a timeout
 	qCtx, qCancel := context.WithTimeout(ctx, QueryTimeout)
 	defer qCancel()
 
 	// Use a read-only transaction to ensure that we can't execute write operations to the database
 	txOps := &sql.TxOptions{ReadOnly: true}
-	tx, err := p.DB.BeginTx(qCtx, txOps)
+	tx, err := db.BeginTx(qCtx, txOps)
+	if err != nil {
+		return err
+	}
 	// "Roll back" the transaction here just to ensure that any writes are not committed
 	defer tx.Rollback()
 
-	// Actually execute the query
-	Logger.Debugf("Executing SQL: %s\n", q)
-	rows, err := tx.Query(q)
-	if err != nil {
-		return nil, err
+	err = fn(qCtx, tx)
+	if err != nil && errors.Is(qCtx.Err(), context.DeadlineExceeded) {
+		return queryTimeoutError{err}
 	}
-	defer rows.Close()
+	return err
+}
 
-	// Re-map the row objects to a list of map-like records
-	records, err := RowsToMaps(rows, p.GeometryField)
-	if err != nil {
-		return nil, err
+// queryTimeoutError is returned for SQL queries that exceeded the QueryTimeout, whatever error
+// the driver reported for the canceled query
+type queryTimeoutError struct {
+	err error
+}
+
+func (e queryTimeoutError) Error() string {
+	return fmt.Sprintf("SQL query timed out after %s: %v", QueryTimeout, e.err)
+}
+
+// Unwrap makes query timeouts match context.DeadlineExceeded
+func (e queryTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// isConnectionError determines whether or not an error was caused by a broken database
+// connection, rather than by the query itself
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
 	}
-	return records, err
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// Don't retry timeouts, since the query itself is likely to blame
+		return !netErr.Timeout()
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is "Connection Exception", and the 57P0x codes are server shutdowns (unlike
+		// 57014 query_canceled, which is returned for timed out queries)
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P0")
+	}
+	return false
 }
 
 // GetFeatures implements the Source interface, to get feature data from an
 // PostGIS server
 func (p *PostGISSource) GetFeatures(ctx context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	// The raw SQL of the extra fields and source filtering parameters could escape the scope's
+	// term filters (e.g. q=true OR true), so they are refused for scoped requests
+	if len(req.Terms) > 0 {
+		for _, arg := range []string{"s", "q"} {
+			if _, exists := req.Args[arg]; exists {
+				return nil, ForbiddenError{fmt.Sprintf("The %s parameter is not allowed for scoped PostGIS layers", arg)}
+			}
+		}
+	}
+
 	// Check for extra fields specifications. They must have the form of <property_name>:<SQL column expression>,
 	// eg: height_times_two:height*2.
 	if inc_args, exists := req.Args["s"]; exists {
@@ -240,6 +778,69 @@ func (p *PostGISSource) GetFeatures(ctx context.Context, req *TileRequest) (*geo
 		}
 	}
 
+	// Only include the features of the request's scope
+	extraFilters = append(extraFilters, termFilters(req)...)
+
+	// Only include features that are visible at the requested zoom level
+	if p.FeatureMinzoomField != "" {
+		minzoom := goqu.I(p.FeatureMinzoomField)
+		extraFilters = append(extraFilters, goqu.Or(minzoom.IsNull(), minzoom.Lte(req.Z)))
+	}
+
+	// Check for an optional area-of-interest geometry to clip the layer to
+	geom, err := req.geometryArg()
+	if err != nil {
+		return nil, err
+	}
+	if geom != nil {
+		geomFilter, err := p.geometryFilter(geom)
+		if err != nil {
+			return nil, err
+		}
+		extraFilters = append(extraFilters, geomFilter)
+	}
+
+	// Only include features that changed after the optional since argument
+	if p.TimeField != "" {
+		since, err := req.sinceArg()
+		if err != nil {
+			return nil, err
+		}
+		if !since.IsZero() {
+			extraFilters = append(extraFilters, goqu.I(p.TimeField).Gt(since))
+		}
+	}
+
+	// Call the source function for the requested tile, if configured
+	p = p.forTile(req)
+
+	// Use the sampled source table if sampling applies at the requested zoom level
+	if p.SampledDataset != nil && p.Sample.appliesTo(req.Z) {
+		sampled := *p
+		sampled.Dataset = p.SampledDataset
+		p = &sampled
+	}
+
+	// Apply the zoom-dependent feature limit, if configured
+	if p.FeatureLimit != nil {
+		limited := *p
+		limited.MaxFeatures = p.FeatureLimit.ForZoom(req.Z)
+		p = &limited
+	}
+
+	// Let PostGIS build the whole FeatureCollection, if configured
+	if p.GeoJSONMode {
+		q, err := p.buildGeoJSONSQL(req.MapTile().Bound(), extraFilters...)
+		if err != nil {
+			return nil, err
+		}
+		data, err := p.runGeoJSONQuery(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		return geojson.UnmarshalFeatureCollection(data)
+	}
+
 	// Create the final SQL query
 	q, err := p.buildSQL(req.MapTile().Bound(), extraFilters...)
 	if err != nil {
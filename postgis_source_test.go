@@ -1,10 +1,21 @@
 package tilenol
 
 import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/lib/pq"
 	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConfigTableAndSchemaDataset(t *testing.T) {
@@ -96,3 +107,403 @@ func TestSQLConstruction(t *testing.T) {
 		t.Errorf("Constructed SQL lacks intersection query: %v", sql)
 	}
 }
+
+func TestIsConnectionError(t *testing.T) {
+	connErrs := []error{
+		driver.ErrBadConn,
+		io.EOF,
+		fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF),
+		&net.OpError{Op: "read", Err: errors.New("connection reset by peer")},
+		&pq.Error{Code: "57P01"},
+		&pq.Error{Code: "08006"},
+	}
+	for _, err := range connErrs {
+		if !isConnectionError(err) {
+			t.Errorf("Expected a connection error: %v", err)
+		}
+	}
+	queryErrs := []error{
+		errors.New("oops"),
+		&pq.Error{Code: "42P01"},
+		&pq.Error{Code: "57014"},
+		context.DeadlineExceeded,
+		queryTimeoutError{driver.ErrBadConn},
+	}
+	for _, err := range queryErrs {
+		if isConnectionError(err) {
+			t.Errorf("Expected a non-connection error: %v", err)
+		}
+	}
+}
+
+func TestSQLConstructionWithSRID(t *testing.T) {
+	ds, err := (&PostGISConfig{Table: "my_locations"}).Dataset()
+	if err != nil {
+		t.Errorf("Couldn't create dataset from config: %v", err)
+	}
+	pgis := &PostGISSource{
+		Dataset:       ds,
+		GeometryField: "geom",
+		SRID:          3857,
+	}
+	tile := orb.Bound{Min: orb.Point{0.0, 0.0}, Max: orb.Point{1.0, 1.0}}
+	sql, err := pgis.buildSQL(tile)
+	if err != nil {
+		t.Errorf("Failed to construct SQL: %v", err)
+	}
+	if !strings.Contains(sql, "ST_AsBinary(ST_Transform(\"geom\", 4326))") {
+		t.Errorf("Constructed SQL doesn't output WGS84 geometries: %v", sql)
+	}
+	if !strings.Contains(sql, "ST_Transform(ST_MakeEnvelope(0, 0, 1, 1, 4326), 3857)") {
+		t.Errorf("Constructed SQL doesn't transform the envelope: %v", sql)
+	}
+
+	pgis.SRID = WGS84SRID
+	sql, _ = pgis.buildSQL(tile)
+	if strings.Contains(sql, "ST_Transform") {
+		t.Errorf("Constructed SQL shouldn't transform WGS84 geometries: %v", sql)
+	}
+}
+
+func TestCheckGeometryColumn(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	config := &PostGISConfig{Schema: "my_schema", Table: "my_locations", GeometryField: "geom", SRID: 3857}
+
+	mock.ExpectQuery("geometry_columns").WillReturnRows(mock.NewRows([]string{"srid"}).AddRow(3857))
+	assert.Nil(t, CheckGeometryColumn(db, config), "Expected matching SRID to pass")
+
+	mock.ExpectQuery("geometry_columns").WillReturnRows(mock.NewRows([]string{"srid"}).AddRow(4326))
+	assert.NotNil(t, CheckGeometryColumn(db, config), "Expected mismatched SRID to fail")
+
+	// Untyped geometry columns have no SRID to check
+	mock.ExpectQuery("geometry_columns").WillReturnRows(mock.NewRows([]string{"srid"}).AddRow(0))
+	assert.Nil(t, CheckGeometryColumn(db, config), "Expected unknown SRID to pass")
+
+	// Geography columns are registered in geography_columns
+	mock.ExpectQuery("geometry_columns").WillReturnRows(mock.NewRows([]string{"srid"}))
+	mock.ExpectQuery(`"geography_columns".*"f_geography_column" = 'geom'`).WillReturnRows(mock.NewRows([]string{"srid"}).AddRow(4326))
+	assert.NotNil(t, CheckGeometryColumn(db, config), "Expected mismatched geography SRID to fail")
+
+	// Columns that aren't registered at all can't be checked
+	mock.ExpectQuery("geometry_columns").WillReturnRows(mock.NewRows([]string{"srid"}))
+	mock.ExpectQuery("geography_columns").WillReturnRows(mock.NewRows([]string{"srid"}))
+	assert.Nil(t, CheckGeometryColumn(db, config), "Expected unregistered geometry column to pass")
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	assert.Nil(t, CheckGeometryColumn(db, &PostGISConfig{TableExpression: "SELECT 1"}))
+}
+
+func TestSampledDataset(t *testing.T) {
+	maxzoom := 8
+	config := &PostGISConfig{
+		Schema: "my_schema",
+		Table:  "my_locations",
+		Sample: &PostGISSampleConfig{Percent: 10, Seed: 42, Maxzoom: &maxzoom},
+	}
+	ds, err := config.SampledDataset()
+	if err != nil {
+		t.Fatalf("Couldn't create sampled dataset from config: %v", err)
+	}
+	sql, _, err := ds.ToSQL()
+	if err != nil {
+		t.Errorf("Couldn't create SQL from config: %v", err)
+	}
+	if !strings.Contains(sql, "FROM \"my_schema\".\"my_locations\" TABLESAMPLE SYSTEM (10) REPEATABLE (42)") {
+		t.Errorf("Invalid sampled SQL from config: %v", sql)
+	}
+	if !config.Sample.appliesTo(8) || config.Sample.appliesTo(9) {
+		t.Error("Sampling should only apply at or below the sample maxzoom")
+	}
+
+	config.Sample.Method = "nope"
+	if _, err := config.SampledDataset(); err != InvalidSampleConfig {
+		t.Error("PostGISConfig should not allow invalid sampling methods")
+	}
+
+	tableExp := &PostGISConfig{
+		TableExpression: "SELECT * FROM \"my_other_schema\".\"my_locations\"",
+		Sample:          &PostGISSampleConfig{Percent: 10},
+	}
+	if _, err := tableExp.SampledDataset(); err != InvalidSampleConfig {
+		t.Error("PostGISConfig should not allow sampling a tableExpression")
+	}
+}
+
+func TestFunctionDataset(t *testing.T) {
+	config := &PostGISConfig{Function: "tiles.get_features", GeometryField: "geom"}
+	assert.Nil(t, config.Validate())
+	req := &TileRequest{X: 1, Y: 2, Z: 3}
+	sql, _, err := functionDataset(config.Function, config.FunctionArgs, req).ToSQL()
+	assert.Nil(t, err)
+	assert.Contains(t, sql, "WITH __tilenol__table AS (SELECT * FROM tiles.get_features(3, 1, 2))")
+
+	sql, _, err = functionDataset(config.Function, BoundsFunctionArgs, &TileRequest{}).ToSQL()
+	assert.Nil(t, err)
+	assert.Contains(t, sql, "get_features(-180, -85.0511")
+
+	for _, invalid := range []*PostGISConfig{
+		&PostGISConfig{Function: "get_features", Table: "pois", GeometryField: "geom"},
+		&PostGISConfig{Function: "get_features(1); DROP TABLE pois", GeometryField: "geom"},
+		&PostGISConfig{Function: "get_features", FunctionArgs: "zxy", GeometryField: "geom"},
+	} {
+		assert.Equal(t, InvalidFunctionConfig, invalid.Validate())
+	}
+}
+
+func TestGetFeaturesFunction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		GeometryField: "geom",
+		Function:      "get_features",
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM get_features\(3, 1, 2\)`).
+		WillReturnRows(mock.NewRows([]string{"geom"}))
+	mock.ExpectRollback()
+	fc, err := pgis.GetFeatures(context.Background(), &TileRequest{X: 1, Y: 2, Z: 3})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Empty(t, fc.Features)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLConstructionWithMaxFeatures(t *testing.T) {
+	ds, _ := (&PostGISConfig{Table: "my_locations"}).Dataset()
+	pgis := &PostGISSource{Dataset: ds, GeometryField: "geom", MaxFeatures: 100}
+	sql, err := pgis.buildSQL(orb.Bound{Min: orb.Point{0.0, 0.0}, Max: orb.Point{1.0, 1.0}})
+	if err != nil {
+		t.Errorf("Failed to construct SQL: %v", err)
+	}
+	if !strings.HasSuffix(sql, "LIMIT 100") {
+		t.Errorf("Constructed SQL lacks feature limit: %v", sql)
+	}
+}
+
+func TestSQLConstructionWithPriorityField(t *testing.T) {
+	ds, _ := (&PostGISConfig{Table: "my_locations"}).Dataset()
+	pgis := &PostGISSource{Dataset: ds, GeometryField: "geom", MaxFeatures: 100, PriorityField: "rank"}
+	sql, err := pgis.buildSQL(orb.Bound{Min: orb.Point{0.0, 0.0}, Max: orb.Point{1.0, 1.0}})
+	if err != nil {
+		t.Errorf("Failed to construct SQL: %v", err)
+	}
+	if !strings.HasSuffix(sql, `ORDER BY "rank" DESC NULLS LAST LIMIT 100`) {
+		t.Errorf("Constructed SQL lacks priority ordering: %v", sql)
+	}
+}
+
+func TestGetFeaturesMinzoomField(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:                  goqu.Dialect("postgres").DB(db),
+		Dataset:             ds,
+		GeometryField:       "geom",
+		FeatureMinzoomField: "label_minzoom",
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`\("label_minzoom" IS NULL\) OR \("label_minzoom" <= 12\)`).
+		WillReturnRows(mock.NewRows([]string{"geom"}))
+	mock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 12})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+		TimeField:     "updated_at",
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`\("updated_at" > '2020-01-01T00:00:00Z'\)`).
+		WillReturnRows(mock.NewRows([]string{"geom"}))
+	mock.ExpectRollback()
+	req := &TileRequest{Args: map[string][]string{SinceArg: []string{"2020-01-01T00:00:00Z"}}}
+	fc, err := pgis.GetFeatures(context.Background(), req)
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Empty(t, fc.Features)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	req.Args[SinceArg] = []string{"yesterday"}
+	_, err = pgis.GetFeatures(context.Background(), req)
+	assert.IsType(t, InvalidRequestError{}, err)
+}
+
+func TestGetFeaturesTerms(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`\("tenant_id" = 'acme'\)`).
+		WillReturnRows(mock.NewRows([]string{"geom"}))
+	mock.ExpectRollback()
+	req := &TileRequest{Terms: map[string]string{"tenant_id": "acme"}}
+	_, err = pgis.GetFeatures(context.Background(), req)
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesTermsRawSQL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+	// Raw SQL that would bypass the scope's term filter is refused before any query is run
+	bypasses := []map[string][]string{
+		{"q": {"true OR true"}},
+		{"s": {"x:(SELECT json_agg(t) FROM pois t)"}},
+	}
+	for _, args := range bypasses {
+		req := &TileRequest{Args: args, Terms: map[string]string{"tenant_id": "acme"}}
+		_, err = pgis.GetFeatures(context.Background(), req)
+		assert.IsType(t, ForbiddenError{}, err, "Expected scoped request to be forbidden: %v", args)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesCanceledQueryNotRetried(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+	// A server-side statement_timeout isn't retried like a connection error
+	canceled := &pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM "pois"`).WillReturnError(canceled)
+	mock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{})
+	assert.Equal(t, canceled, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesReplica(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	replica, replicaMock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(primary),
+		Replica:       goqu.Dialect("postgres").DB(replica),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+
+	// Reads are served by the replica
+	replicaMock.ExpectBegin()
+	replicaMock.ExpectQuery(`FROM "pois"`).WillReturnRows(replicaMock.NewRows([]string{"geom"}))
+	replicaMock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, replicaMock.ExpectationsWereMet())
+	assert.Nil(t, primaryMock.ExpectationsWereMet())
+
+	// Replica connection errors fall back to the primary
+	replicaMock.ExpectBegin().WillReturnError(&pq.Error{Code: "08006"})
+	primaryMock.ExpectBegin()
+	primaryMock.ExpectQuery(`FROM "pois"`).WillReturnRows(primaryMock.NewRows([]string{"geom"}))
+	primaryMock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, replicaMock.ExpectationsWereMet())
+	assert.Nil(t, primaryMock.ExpectationsWereMet())
+
+	// Query errors don't
+	replicaMock.ExpectBegin()
+	replicaMock.ExpectQuery(`FROM "pois"`).WillReturnError(&pq.Error{Code: "42P01"})
+	replicaMock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{})
+	assert.NotNil(t, err)
+	assert.Nil(t, replicaMock.ExpectationsWereMet())
+	assert.Nil(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestPostGISLastModified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+	}
+	modified, err := pgis.LastModified(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.True(t, modified.IsZero(), "Last modified time should be unknown without a timeField")
+
+	pgis.TimeField = "updated_at"
+	expected := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT MAX\("updated_at"\) FROM "__tilenol__table" WHERE ST_Intersects\("geom"`).
+		WillReturnRows(mock.NewRows([]string{"max"}).AddRow(expected))
+	mock.ExpectRollback()
+	modified, err = pgis.LastModified(context.Background(), &TileRequest{})
+	assert.Nil(t, err, "Failed to get last modified time: %v", err)
+	assert.Equal(t, expected, modified)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesFeatureLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+		MaxFeatures:   100,
+		FeatureLimit:  &FeatureLimitConfig{Base: 100, BaseZoom: 10},
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`LIMIT 400$`).WillReturnRows(mock.NewRows([]string{"geom"}))
+	mock.ExpectRollback()
+	_, err = pgis.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 12})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetFeaturesGeoJSONMode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err, "Failed to create mock DB: %s", err)
+	ds, _ := (&PostGISConfig{Table: "pois"}).Dataset()
+	pgis := &PostGISSource{
+		DB:            goqu.Dialect("postgres").DB(db),
+		Dataset:       ds,
+		GeometryField: "geom",
+		SourceFields:  map[string]string{"id": "id", "name": "name"},
+		GeoJSONMode:   true,
+	}
+	fcJSON := `{"type": "FeatureCollection", "features": [` +
+		`{"type": "Feature", "id": 1, "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"id": 1, "name": "A"}}]}`
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT json_build_object\('type', 'FeatureCollection'.* FROM \(WITH .* SELECT ST_AsGeoJSON\("geom"\)::json AS "geom"`).
+		WillReturnRows(mock.NewRows([]string{"json_build_object"}).AddRow([]byte(fcJSON)))
+	mock.ExpectRollback()
+	fc, err := pgis.GetFeatures(context.Background(), &TileRequest{X: 0, Y: 0, Z: 0})
+	assert.Nil(t, err, "Failed to get features: %v", err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, orb.Point{1, 2}, fc.Features[0].Geometry)
+	assert.Equal(t, "A", fc.Features[0].Properties["name"])
+}
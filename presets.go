@@ -0,0 +1,62 @@
+package tilenol
+
+import (
+	"fmt"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// PresetArg is the request parameter for selecting one of a layer's named presets
+const PresetArg = "preset"
+
+// PresetConfig is the YAML configuration for a named fidelity preset of a layer, which clients
+// select with the PresetArg request parameter (e.g. lighter tiles for mobile clients)
+type PresetConfig struct {
+	// Simplify is the optional Douglas-Peucker simplification tolerance (in tile extent units),
+	// which overrides the zoom-based simplification of the layer
+	Simplify float64 `yaml:"simplify"`
+	// MaxFeatures optionally limits the number of features per tile
+	MaxFeatures int `yaml:"maxFeatures"`
+	// Extent optionally overrides the size of the MVT coordinate grid (i.e. the coordinate
+	// precision) of the layer
+	Extent int `yaml:"extent"`
+}
+
+// Validate checks that none of the preset's values are negative
+func (c *PresetConfig) Validate() error {
+	if c.Simplify < 0 || c.MaxFeatures < 0 || c.Extent < 0 {
+		return fmt.Errorf("Preset simplify, maxFeatures and extent can't be negative")
+	}
+	return nil
+}
+
+// validatePresets checks that the named presets of a layer are well-formed
+func validatePresets(presets map[string]*PresetConfig) error {
+	for name, preset := range presets {
+		if name == "" || preset == nil {
+			return fmt.Errorf("Invalid preset: \"%s\"", name)
+		}
+		if err := preset.Validate(); err != nil {
+			return fmt.Errorf("Invalid preset \"%s\": %v", name, err)
+		}
+	}
+	return nil
+}
+
+// preset returns the layer's preset selected by the request, if any. Layers without the
+// requested preset are rendered as usual, so that a preset can be requested for several
+// layers at once.
+func (l *Layer) preset(req *TileRequest) *PresetConfig {
+	values, exists := req.Args[PresetArg]
+	if !exists || len(values) == 0 {
+		return nil
+	}
+	return l.Presets[values[0]]
+}
+
+// limitFeatures truncates the features to the preset's MaxFeatures
+func (c *PresetConfig) limitFeatures(fc *geojson.FeatureCollection) {
+	if c.MaxFeatures > 0 && len(fc.Features) > c.MaxFeatures {
+		fc.Features = fc.Features[:c.MaxFeatures]
+	}
+}
@@ -0,0 +1,41 @@
+package tilenol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerPresets(t *testing.T) {
+	layer := &Layer{
+		Name:    "points",
+		Source:  newStaticSource(orb.Point{1, 1}, orb.Point{2, 2}, orb.Point{3, 3}),
+		Presets: map[string]*PresetConfig{"fast": &PresetConfig{MaxFeatures: 2, Extent: 512}},
+	}
+	req := &TileRequest{Args: map[string][]string{}}
+	fc, err := layer.GetFeatures(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 3)
+	assert.Equal(t, uint32(mvt.DefaultExtent), layer.encodeMVTLayer(req, fc).Extent)
+
+	req.Args[PresetArg] = []string{"fast"}
+	fc, err = layer.GetFeatures(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 2)
+	assert.Equal(t, uint32(512), layer.encodeMVTLayer(req, fc).Extent)
+
+	// Layers without the requested preset are rendered as usual
+	req.Args[PresetArg] = []string{"detailed"}
+	fc, err = layer.GetFeatures(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 3)
+}
+
+func TestValidatePresets(t *testing.T) {
+	assert.Nil(t, validatePresets(map[string]*PresetConfig{"fast": &PresetConfig{Simplify: 2}}))
+	assert.NotNil(t, validatePresets(map[string]*PresetConfig{"fast": &PresetConfig{MaxFeatures: -1}}))
+	assert.NotNil(t, validatePresets(map[string]*PresetConfig{"fast": nil}))
+}
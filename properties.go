@@ -0,0 +1,285 @@
+package tilenol
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// SnakeCase normalizes property keys to snake_case
+	SnakeCase = "snake"
+	// CamelCase normalizes property keys to camelCase
+	CamelCase = "camel"
+	// LowerCase normalizes property keys to lowercase
+	LowerCase = "lower"
+
+	// IntType coerces property values to integers
+	IntType = "int"
+	// FloatType coerces property values to floating point numbers
+	FloatType = "float"
+	// StringType coerces property values to strings
+	StringType = "string"
+	// BoolType coerces property values to booleans
+	BoolType = "bool"
+)
+
+// PropertiesConfig is the YAML configuration for post-processing the feature properties of a
+// layer, regardless of its source
+type PropertiesConfig struct {
+	// KeyCase optionally normalizes all property keys to a case convention: "snake", "camel"
+	// or "lower"
+	KeyCase string `yaml:"keyCase"`
+	// StripPrefixes is an optional list of key prefixes, where properties whose keys start
+	// with any of the prefixes are removed
+	StripPrefixes []string `yaml:"stripPrefixes"`
+	// Precision optionally rounds floating point property values to a number of decimals
+	Precision *int `yaml:"precision"`
+	// Schema optionally maps (normalized) property keys to a type ("int", "float", "string" or
+	// "bool") that the property values are coerced to, where values that can't be coerced
+	// are dropped
+	Schema map[string]string `yaml:"schema"`
+}
+
+// Validate checks that the PropertiesConfig is well-formed
+func (c *PropertiesConfig) Validate() error {
+	switch c.KeyCase {
+	case "", SnakeCase, CamelCase, LowerCase:
+	default:
+		return fmt.Errorf("Invalid property keyCase: %s", c.KeyCase)
+	}
+	if c.Precision != nil && *c.Precision < 0 {
+		return fmt.Errorf("Invalid property precision: %d", *c.Precision)
+	}
+	for key, valueType := range c.Schema {
+		switch valueType {
+		case IntType, FloatType, StringType, BoolType:
+		default:
+			return fmt.Errorf("Invalid property schema type for [%s]: %s", key, valueType)
+		}
+	}
+	return nil
+}
+
+// Apply post-processes the properties of each feature in the collection. When several keys
+// normalize to the same key (e.g. "fooBar" and "foo_bar"), the one that is already normalized
+// is kept, or else the first one in sorted order, so that tiles are deterministic.
+func (c *PropertiesConfig) Apply(fc *geojson.FeatureCollection) {
+	for _, feat := range fc.Features {
+		keys := make([]string, 0, len(feat.Properties))
+		for k := range feat.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		props := make(geojson.Properties, len(feat.Properties))
+		sources := make(map[string]string, len(feat.Properties))
+		for _, k := range keys {
+			v := feat.Properties[k]
+			if c.stripped(k) {
+				continue
+			}
+			key := normalizeKey(k, c.KeyCase)
+			if source, exists := sources[key]; exists {
+				if source == key || k != key {
+					Logger.Warnf("Dropping property [%s] of feature [%v], which collides with [%s] as [%s]", k, feat.ID, source, key)
+					continue
+				}
+				Logger.Warnf("Dropping property [%s] of feature [%v], which collides with [%s] as [%s]", source, feat.ID, k, key)
+			}
+			sources[key] = k
+			if valueType, exists := c.Schema[key]; exists && v != nil {
+				coerced, ok := coerceValue(v, valueType)
+				if !ok {
+					Logger.Warnf("Dropping property [%s] of feature [%v], %#v can't be coerced to %s", key, feat.ID, v, valueType)
+					continue
+				}
+				v = coerced
+			}
+			if c.Precision != nil {
+				v = roundValue(v, *c.Precision)
+			}
+			props[key] = v
+		}
+		feat.Properties = props
+	}
+}
+
+// stripped determines whether or not a property key matches any of the strip prefixes
+func (c *PropertiesConfig) stripped(key string) bool {
+	for _, prefix := range c.StripPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// coerceValue converts a property value to the given schema type, returning false if the
+// value can't be represented as that type
+func coerceValue(v interface{}, valueType string) (interface{}, bool) {
+	if str, isString := v.(string); isString && valueType != StringType {
+		return parseValue(strings.TrimSpace(str), valueType)
+	}
+	switch valueType {
+	case IntType:
+		if i, isInt := intValue(v); isInt {
+			return i, true
+		}
+		f, isNumber := floatValue(v)
+		if !isNumber || f != math.Trunc(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return int64(f), true
+	case FloatType:
+		return floatValue(v)
+	case StringType:
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, false
+		}
+		return fmt.Sprint(v), true
+	case BoolType:
+		if b, isBool := v.(bool); isBool {
+			return b, true
+		}
+		// Only 0 and 1 are unambiguous booleans
+		f, isNumber := floatValue(v)
+		if !isNumber || (f != 0 && f != 1) {
+			return nil, false
+		}
+		return f == 1, true
+	}
+	return v, true
+}
+
+// parseValue parses a string property value as the given schema type
+func parseValue(s string, valueType string) (interface{}, bool) {
+	switch valueType {
+	case IntType:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+		// Also accept integral floating point strings, e.g. "3.0"
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f != math.Trunc(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return int64(f), true
+	case FloatType:
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	case BoolType:
+		b, err := strconv.ParseBool(s)
+		return b, err == nil
+	}
+	return s, true
+}
+
+// intValue converts any integer property value to an int64
+func intValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// floatValue converts any numeric property value to a float64
+func floatValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	if i, isInt := intValue(v); isInt {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// roundValue rounds floating point values to the given number of decimals
+func roundValue(v interface{}, precision int) interface{} {
+	scale := math.Pow(10, float64(precision))
+	switch f := v.(type) {
+	case float64:
+		return math.Round(f*scale) / scale
+	case float32:
+		return float32(math.Round(float64(f)*scale) / scale)
+	}
+	return v
+}
+
+// splitKeyWords splits a property key into its lowercase words, using case changes and any
+// non-alphanumeric characters as word boundaries (e.g. "buildingHeight.ft" => building,
+// height, ft)
+func splitKeyWords(key string) []string {
+	var words []string
+	var current []rune
+	runes := []rune(key)
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, strings.ToLower(string(current)))
+			current = nil
+		}
+	}
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && len(current) > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			// Break on "aB" as well as on the last capital of an acronym, e.g. "HTTPServer"
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				flush()
+			}
+		}
+		current = append(current, r)
+	}
+	flush()
+	return words
+}
+
+// normalizeKey converts a property key to the given case convention
+func normalizeKey(key string, keyCase string) string {
+	switch keyCase {
+	case SnakeCase:
+		return strings.Join(splitKeyWords(key), "_")
+	case CamelCase:
+		words := splitKeyWords(key)
+		for i := 1; i < len(words); i++ {
+			r, size := utf8.DecodeRuneInString(words[i])
+			words[i] = string(unicode.ToUpper(r)) + words[i][size:]
+		}
+		return strings.Join(words, "")
+	case LowerCase:
+		return strings.ToLower(key)
+	}
+	return key
+}
@@ -0,0 +1,139 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	expectations := map[string]string{
+		"buildingHeight": "building_height",
+		"area_sqft":      "area_sqft",
+		"HTTPServer":     "http_server",
+		"height.ft":      "height_ft",
+		"Floor Count 2":  "floor_count_2",
+		"level2Name":     "level2_name",
+	}
+	for key, expected := range expectations {
+		assert.Equal(t, expected, normalizeKey(key, SnakeCase), "Invalid snake_case key for: %s", key)
+	}
+	assert.Equal(t, "buildingHeightFt", normalizeKey("building_height.ft", CamelCase))
+	assert.Equal(t, "buildingheight", normalizeKey("buildingHeight", LowerCase))
+	assert.Equal(t, "buildingHeight", normalizeKey("buildingHeight", ""))
+	assert.Equal(t, "straßeÜberFührung", normalizeKey("straße_über_führung", CamelCase))
+}
+
+func TestPropertiesConfigApplyCollisions(t *testing.T) {
+	for keyCase, expected := range map[string]geojson.Properties{
+		SnakeCase: {"foo_bar": "snake"},
+		CamelCase: {"fooBar": "camel"},
+	} {
+		// The already normalized key wins, or else the first key in sorted order
+		for i := 0; i < 10; i++ {
+			fc := geojson.NewFeatureCollection()
+			feat := geojson.NewFeature(orb.Point{0, 0})
+			feat.Properties = geojson.Properties{"fooBar": "camel", "foo_bar": "snake"}
+			fc.Append(feat)
+			(&PropertiesConfig{KeyCase: keyCase}).Apply(fc)
+			assert.Equal(t, expected, fc.Features[0].Properties, "Unexpected %s case collision winner", keyCase)
+		}
+	}
+}
+
+func TestPropertiesConfigApply(t *testing.T) {
+	precision := 2
+	config := &PropertiesConfig{
+		KeyCase:       SnakeCase,
+		StripPrefixes: []string{"_internal"},
+		Precision:     &precision,
+	}
+	assert.Nil(t, config.Validate())
+	fc := geojson.NewFeatureCollection()
+	feat := geojson.NewFeature(orb.Point{0, 0})
+	feat.Properties = geojson.Properties{
+		"heightFt":       12.3456,
+		"_internalScore": 1.0,
+		"name":           "A",
+		"floors":         3,
+	}
+	fc.Append(feat)
+	config.Apply(fc)
+	assert.Equal(t, geojson.Properties{
+		"height_ft": 12.35,
+		"name":      "A",
+		"floors":    3,
+	}, fc.Features[0].Properties)
+}
+
+func TestPropertiesConfigValidate(t *testing.T) {
+	assert.NotNil(t, (&PropertiesConfig{KeyCase: "kebab"}).Validate())
+	negative := -1
+	assert.NotNil(t, (&PropertiesConfig{Precision: &negative}).Validate())
+}
+
+func TestPropertiesConfigSchema(t *testing.T) {
+	config := &PropertiesConfig{
+		KeyCase: SnakeCase,
+		Schema: map[string]string{
+			"floors":    IntType,
+			"height_ft": FloatType,
+			"zip":       StringType,
+			"active":    BoolType,
+			"rank":      IntType,
+		},
+	}
+	assert.Nil(t, config.Validate())
+	fc := geojson.NewFeatureCollection()
+	for _, props := range []geojson.Properties{
+		{"floors": "3", "heightFt": "12.5", "zip": 2139.0, "active": "true", "rank": 1.5},
+		{"floors": 4.0, "heightFt": 10, "zip": "02139", "active": 0.0, "rank": "first"},
+	} {
+		feat := geojson.NewFeature(orb.Point{0, 0})
+		feat.Properties = props
+		fc.Append(feat)
+	}
+	config.Apply(fc)
+	assert.Equal(t, geojson.Properties{
+		"floors":    int64(3),
+		"height_ft": 12.5,
+		"zip":       "2139",
+		"active":    true,
+	}, fc.Features[0].Properties, "Non-integral ranks should have been dropped")
+	assert.Equal(t, geojson.Properties{
+		"floors":    int64(4),
+		"height_ft": 10.0,
+		"zip":       "02139",
+		"active":    false,
+	}, fc.Features[1].Properties, "Non-numeric ranks should have been dropped")
+
+	assert.NotNil(t, (&PropertiesConfig{Schema: map[string]string{"floors": "integer"}}).Validate())
+}
+
+func TestCoerceValue(t *testing.T) {
+	expectations := []struct {
+		value     interface{}
+		valueType string
+		expected  interface{}
+		ok        bool
+	}{
+		{int32(7), IntType, int64(7), true},
+		{"3.0", IntType, int64(3), true},
+		{true, IntType, nil, false},
+		{"abc", FloatType, nil, false},
+		{uint64(5), FloatType, 5.0, true},
+		{true, StringType, "true", true},
+		{[]interface{}{1}, StringType, nil, false},
+		{2.0, BoolType, nil, false},
+		{"F", BoolType, false, true},
+	}
+	for _, e := range expectations {
+		actual, ok := coerceValue(e.value, e.valueType)
+		assert.Equal(t, e.ok, ok, "Unexpected coercion result for %#v to %s", e.value, e.valueType)
+		if e.ok {
+			assert.Equal(t, e.expected, actual)
+		}
+	}
+}
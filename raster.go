@@ -0,0 +1,363 @@
+package tilenol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	// PNGContentType is the content type of raster tiles
+	PNGContentType = "image/png"
+	// RasterTileSize is the width and height of raster tiles, in pixels
+	RasterTileSize = 256
+)
+
+// RasterStyleConfig is the YAML configuration for the minimal styling of a layer's features in
+// raster tiles, where colors are given as "#rgb", "#rrggbb" or "#rrggbbaa"
+type RasterStyleConfig struct {
+	// Fill is the color of polygon interiors
+	Fill string `yaml:"fill"`
+	// Stroke is the color of lines, polygon outlines and points
+	Stroke string `yaml:"stroke"`
+	// StrokeWidth is the width of lines and polygon outlines in pixels (defaults to 1)
+	StrokeWidth float64 `yaml:"strokeWidth"`
+	// PointRadius is the radius of points in pixels (defaults to 3)
+	PointRadius float64 `yaml:"pointRadius"`
+}
+
+// RasterStyle is the parsed styling of a layer's features in raster tiles
+type RasterStyle struct {
+	Fill        color.NRGBA
+	Stroke      color.NRGBA
+	StrokeWidth float64
+	PointRadius float64
+}
+
+// DefaultRasterStyle is the styling of layers without a configured RasterStyleConfig
+var DefaultRasterStyle = RasterStyle{
+	Fill:        color.NRGBA{R: 0x33, G: 0x88, B: 0xff, A: 0x66},
+	Stroke:      color.NRGBA{R: 0x33, G: 0x88, B: 0xff, A: 0xff},
+	StrokeWidth: 1,
+	PointRadius: 3,
+}
+
+// Style parses the configured raster style, where unset values fall back to the
+// DefaultRasterStyle
+func (c *RasterStyleConfig) Style() (*RasterStyle, error) {
+	style := DefaultRasterStyle
+	var err error
+	if c.Fill != "" {
+		if style.Fill, err = parseColor(c.Fill); err != nil {
+			return nil, err
+		}
+	}
+	if c.Stroke != "" {
+		if style.Stroke, err = parseColor(c.Stroke); err != nil {
+			return nil, err
+		}
+	}
+	if c.StrokeWidth < 0 || c.PointRadius < 0 {
+		return nil, fmt.Errorf("Raster stroke widths and point radii can't be negative")
+	}
+	if c.StrokeWidth > 0 {
+		style.StrokeWidth = c.StrokeWidth
+	}
+	if c.PointRadius > 0 {
+		style.PointRadius = c.PointRadius
+	}
+	return &style, nil
+}
+
+// parseColor parses a "#rgb", "#rrggbb" or "#rrggbbaa" hex color
+func parseColor(s string) (color.NRGBA, error) {
+	invalid := fmt.Errorf("Invalid color, expected \"#rrggbb\" or \"#rrggbbaa\": %s", s)
+	if !strings.HasPrefix(s, "#") {
+		return color.NRGBA{}, invalid
+	}
+	hex := s[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, invalid
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// rasterStyle returns the raster style of the layer, or the DefaultRasterStyle
+func (l *Layer) rasterStyle() *RasterStyle {
+	if l.Raster != nil {
+		return l.Raster
+	}
+	return &DefaultRasterStyle
+}
+
+// rasterTile draws the features of the layers of a tile into an image
+type rasterTile struct {
+	tile maptile.Tile
+	img  *image.RGBA
+}
+
+func newRasterTile(tile maptile.Tile) *rasterTile {
+	return &rasterTile{tile: tile, img: image.NewRGBA(image.Rect(0, 0, RasterTileSize, RasterTileSize))}
+}
+
+// pixel projects a WGS84 point into the pixel coordinates of the tile
+func (r *rasterTile) pixel(p orb.Point) orb.Point {
+	f := maptile.Fraction(p, r.tile.Z)
+	return orb.Point{(f[0] - float64(r.tile.X)) * RasterTileSize, (f[1] - float64(r.tile.Y)) * RasterTileSize}
+}
+
+// pixels projects the WGS84 points into the pixel coordinates of the tile
+func (r *rasterTile) pixels(points []orb.Point) []orb.Point {
+	projected := make([]orb.Point, len(points))
+	for i, p := range points {
+		projected[i] = r.pixel(p)
+	}
+	return projected
+}
+
+// drawLayer draws the features of a layer onto the tile, with the polygon fills beneath the
+// strokes. Overlapping features of the same layer are drawn as their union, so that
+// translucent colors don't stack up.
+func (r *rasterTile) drawLayer(fc *geojson.FeatureCollection, style *RasterStyle) {
+	fill := image.NewAlpha(r.img.Bounds())
+	stroke := image.NewAlpha(r.img.Bounds())
+	for _, feature := range fc.Features {
+		r.addGeometry(fill, stroke, feature.Geometry, style)
+	}
+	draw.DrawMask(r.img, r.img.Bounds(), image.NewUniform(style.Fill), image.Point{}, fill, image.Point{}, draw.Over)
+	draw.DrawMask(r.img, r.img.Bounds(), image.NewUniform(style.Stroke), image.Point{}, stroke, image.Point{}, draw.Over)
+}
+
+// addGeometry adds the pixels covered by the geometry to the fill and stroke masks
+func (r *rasterTile) addGeometry(fill, stroke *image.Alpha, g orb.Geometry, style *RasterStyle) {
+	switch g := g.(type) {
+	case orb.Point:
+		disc(stroke, r.pixel(g), style.PointRadius)
+	case orb.MultiPoint:
+		for _, p := range g {
+			disc(stroke, r.pixel(p), style.PointRadius)
+		}
+	case orb.LineString:
+		addLine(stroke, r.pixels(g), false, style.StrokeWidth)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			addLine(stroke, r.pixels(ls), false, style.StrokeWidth)
+		}
+	case orb.Ring:
+		r.addGeometry(fill, stroke, orb.Polygon{g}, style)
+	case orb.Bound:
+		r.addGeometry(fill, stroke, g.ToPolygon(), style)
+	case orb.Polygon:
+		rings := make([][]orb.Point, len(g))
+		for i, ring := range g {
+			rings[i] = r.pixels(ring)
+			addLine(stroke, rings[i], true, style.StrokeWidth)
+		}
+		fillRings(fill, rings)
+	case orb.MultiPolygon:
+		for _, polygon := range g {
+			r.addGeometry(fill, stroke, polygon, style)
+		}
+	case orb.Collection:
+		for _, child := range g {
+			r.addGeometry(fill, stroke, child, style)
+		}
+	}
+}
+
+// addLine adds the pixels covered by the (optionally closed) line, in pixel coordinates, to the
+// mask
+func addLine(mask *image.Alpha, points []orb.Point, closed bool, width float64) {
+	n := len(points)
+	if !closed {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		segment(mask, points[i], points[(i+1)%len(points)], width/2)
+	}
+}
+
+// fillRings adds the interior of the rings (in pixel coordinates) to the mask, following the
+// even-odd rule so that holes are left out. The pixels whose centers lie inside are covered.
+func fillRings(mask *image.Alpha, rings [][]orb.Point) {
+	bounds := mask.Bounds()
+	var xs []float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cy := float64(y) + 0.5
+		xs = xs[:0]
+		for _, ring := range rings {
+			for i := range ring {
+				// Rings aren't necessarily closed
+				a, b := ring[i], ring[(i+1)%len(ring)]
+				if (a[1] > cy) != (b[1] > cy) {
+					xs = append(xs, a[0]+(cy-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+				}
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			x0 := clampInt(int(math.Ceil(xs[i]-0.5)), bounds.Min.X, bounds.Max.X)
+			x1 := clampInt(int(math.Ceil(xs[i+1]-0.5)), bounds.Min.X, bounds.Max.X)
+			for x := x0; x < x1; x++ {
+				mask.Pix[mask.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+}
+
+// segment adds the pixels within the radius of the segment (in pixel coordinates) to the mask,
+// after clipping it to the mask, so that long segments outside of the tile are cheap to draw
+func segment(mask *image.Alpha, a, b orb.Point, radius float64) {
+	bounds := mask.Bounds()
+	a, b, visible := clipSegment(a, b, float64(bounds.Min.X)-radius, float64(bounds.Max.X)+radius)
+	if !visible {
+		return
+	}
+	steps := int(math.Ceil(math.Max(math.Abs(b[0]-a[0]), math.Abs(b[1]-a[1]))))
+	for i := 0; i <= steps; i++ {
+		t := 1.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		disc(mask, orb.Point{a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t}, radius)
+	}
+}
+
+// clipSegment clips the segment to the square between min and max in both dimensions (using
+// the Liang-Barsky algorithm), returning false if the segment lies outside of it
+func clipSegment(a, b orb.Point, min, max float64) (orb.Point, orb.Point, bool) {
+	t0, t1 := 0.0, 1.0
+	d := orb.Point{b[0] - a[0], b[1] - a[1]}
+	for i := 0; i < 2; i++ {
+		for _, edge := range [2][2]float64{{-d[i], a[i] - min}, {d[i], max - a[i]}} {
+			p, q := edge[0], edge[1]
+			if p == 0 {
+				if q < 0 {
+					return a, b, false
+				}
+				continue
+			}
+			t := q / p
+			if p < 0 {
+				if t > t1 {
+					return a, b, false
+				}
+				t0 = math.Max(t0, t)
+			} else {
+				if t < t0 {
+					return a, b, false
+				}
+				t1 = math.Min(t1, t)
+			}
+		}
+	}
+	return orb.Point{a[0] + d[0]*t0, a[1] + d[1]*t0}, orb.Point{a[0] + d[0]*t1, a[1] + d[1]*t1}, true
+}
+
+// disc adds the pixel containing the point (in pixel coordinates), and the pixels whose centers
+// lie within the radius of it, to the mask
+func disc(mask *image.Alpha, p orb.Point, radius float64) {
+	bounds := mask.Bounds()
+	if pt := image.Pt(int(math.Floor(p[0])), int(math.Floor(p[1]))); pt.In(bounds) {
+		mask.Pix[mask.PixOffset(pt.X, pt.Y)] = 0xff
+	}
+	x0 := clampInt(int(math.Floor(p[0]-radius)), bounds.Min.X, bounds.Max.X)
+	x1 := clampInt(int(math.Ceil(p[0]+radius)), bounds.Min.X, bounds.Max.X)
+	y0 := clampInt(int(math.Floor(p[1]-radius)), bounds.Min.Y, bounds.Max.Y)
+	y1 := clampInt(int(math.Ceil(p[1]+radius)), bounds.Min.Y, bounds.Max.Y)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			dx, dy := float64(x)+0.5-p[0], float64(y)+0.5-p[1]
+			if dx*dx+dy*dy <= radius*radius {
+				mask.Pix[mask.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+}
+
+// clampInt restricts the value to the range between min and max
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// encodeRasterTile encodes the tile image as a gzipped PNG, where a nil image yields a blank
+// (transparent) 1x1 PNG
+func encodeRasterTile(img image.Image) ([]byte, error) {
+	if img == nil {
+		img = image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	}
+	var data bytes.Buffer
+	gw := gzip.NewWriter(&data)
+	if err := png.Encode(gw, img); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// getRasterTile computes a gzipped PNG tile response for the incoming request, which rasterizes
+// the features of the requested layers with their minimal raster styles, as a fallback for
+// raster-only clients. Tiles without any features are served as a blank 1x1 PNG.
+func (s *Server) getRasterTile(rctx context.Context, w io.Writer, r *http.Request) error {
+	start := time.Now()
+	req, layersToCompute, fcs, err := s.getTileFeatures(rctx, r)
+	if err != nil {
+		return err
+	}
+	fetched := time.Now()
+
+	var data []byte
+	err = s.encodePool.Do(rctx, func() error {
+		var img image.Image
+		if !isEmptyTile(fcs) {
+			raster := newRasterTile(req.MapTile())
+			for i, layer := range layersToCompute {
+				raster.drawLayer(fcs[i], layer.rasterStyle())
+			}
+			img = raster.img
+		}
+		var encodeErr error
+		data, encodeErr = encodeRasterTile(img)
+		return encodeErr
+	})
+	if err != nil {
+		return err
+	}
+	s.setServerTiming(w, fetched.Sub(start), time.Since(fetched))
+	setHeader(w, "Content-Type", PNGContentType)
+	setPartialHeaders(w, req)
+	setEmptyHeader(w, fcs)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,115 @@
+package tilenol
+
+import (
+	"compress/gzip"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColor(t *testing.T) {
+	valid := map[string]color.NRGBA{
+		"#f00":      {R: 0xff, A: 0xff},
+		"#3388ff":   {R: 0x33, G: 0x88, B: 0xff, A: 0xff},
+		"#3388ff66": {R: 0x33, G: 0x88, B: 0xff, A: 0x66},
+	}
+	for s, expected := range valid {
+		c, err := parseColor(s)
+		assert.Nil(t, err, "Failed to parse color %s: %v", s, err)
+		assert.Equal(t, expected, c)
+	}
+	for _, s := range []string{"", "red", "3388ff", "#3388f", "#3388zz"} {
+		_, err := parseColor(s)
+		assert.NotNil(t, err, "Expected an invalid color: %s", s)
+	}
+}
+
+func TestRasterStyleConfig(t *testing.T) {
+	style, err := (&RasterStyleConfig{Fill: "#ff0000", StrokeWidth: 2}).Style()
+	assert.Nil(t, err)
+	assert.Equal(t, color.NRGBA{R: 0xff, A: 0xff}, style.Fill)
+	assert.Equal(t, DefaultRasterStyle.Stroke, style.Stroke)
+	assert.Equal(t, 2.0, style.StrokeWidth)
+	assert.Equal(t, DefaultRasterStyle.PointRadius, style.PointRadius)
+
+	_, err = (&RasterStyleConfig{Stroke: "blue"}).Style()
+	assert.NotNil(t, err)
+	_, err = (&RasterStyleConfig{PointRadius: -1}).Style()
+	assert.NotNil(t, err)
+}
+
+func TestRasterTileDrawLayer(t *testing.T) {
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	blue := color.NRGBA{B: 0xff, A: 0xff}
+	style := &RasterStyle{Fill: red, Stroke: blue, StrokeWidth: 1, PointRadius: 3}
+	fc := geojson.NewFeatureCollection()
+	// The western hemisphere, with a hole around (-45, 0)
+	fc.Append(geojson.NewFeature(orb.Polygon{
+		{{-180, -80}, {0, -80}, {0, 80}, {-180, 80}, {-180, -80}},
+		{{-50, -5}, {-40, -5}, {-40, 5}, {-50, 5}, {-50, -5}},
+	}))
+	fc.Append(geojson.NewFeature(orb.Point{90, 0}))
+
+	raster := newRasterTile(maptile.New(0, 0, 0))
+	raster.drawLayer(fc, style)
+	at := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(raster.img.At(x, y)).(color.NRGBA)
+	}
+	assert.Equal(t, red, at(64, 128))
+	assert.Equal(t, blue, at(128, 100), "Expected the polygon outline")
+	assert.Equal(t, color.NRGBA{}, at(96, 128), "Expected the polygon hole")
+	assert.Equal(t, blue, at(192, 128), "Expected the point")
+	assert.Equal(t, color.NRGBA{}, at(160, 128))
+}
+
+func TestClipSegment(t *testing.T) {
+	a, b, visible := clipSegment(orb.Point{-100, 10}, orb.Point{100, 10}, 0, 20)
+	assert.True(t, visible)
+	assert.Equal(t, orb.Point{0, 10}, a)
+	assert.Equal(t, orb.Point{20, 10}, b)
+	_, _, visible = clipSegment(orb.Point{-100, 30}, orb.Point{100, 30}, 0, 20)
+	assert.False(t, visible)
+}
+
+func TestRasterTileEndpoint(t *testing.T) {
+	polygon := orb.Polygon{{{-180, -80}, {0, -80}, {0, 80}, {-180, 80}, {-180, -80}}}
+	server := &Server{
+		Cache: NewInMemoryCache(),
+		Layers: []Layer{
+			Layer{Name: "areas", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource(polygon)},
+			Layer{Name: "empty", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource()},
+		},
+	}
+	api, _ := server.setupRoutes()
+	decode := func(path string) image.Image {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, PNGContentType, w.Header().Get("Content-Type"))
+		gr, err := gzip.NewReader(w.Body)
+		assert.Nil(t, err)
+		img, err := png.Decode(gr)
+		assert.Nil(t, err, "Failed to decode PNG tile: %v", err)
+		return img
+	}
+
+	img := decode("/areas/0/0/0.png")
+	assert.Equal(t, image.Rect(0, 0, RasterTileSize, RasterTileSize), img.Bounds())
+	_, _, _, a := img.At(64, 128).RGBA()
+	assert.NotZero(t, a)
+	// Cached tiles are served with the same content type
+	decode("/areas/0/0/0.png")
+
+	// Tiles without any features are blank
+	img = decode("/empty/0/0/0.png")
+	assert.Equal(t, image.Rect(0, 0, 1, 1), img.Bounds())
+	_, _, _, a = img.At(0, 0).RGBA()
+	assert.Zero(t, a)
+}
@@ -15,6 +15,12 @@ type RedisConfig struct {
 	Port int `yaml:"port"`
 	// TTL is how long each cache entry should remain before refresh
 	TTL time.Duration `yaml:"ttl"`
+	// StaleTTL is how long a copy of each cache entry is retained for serving stale tiles
+	// (see CacheConfig.ServeStaleOnError), where zero disables stale copies
+	StaleTTL time.Duration `yaml:"staleTTL"`
+	// NegativeCacheTTL optionally overrides the TTL of empty tiles (without any features),
+	// e.g. to cache the mostly empty tiles of sparse datasets for longer
+	NegativeCacheTTL time.Duration `yaml:"negativeCacheTTL"`
 }
 
 // RedisCache is a Redis-backed Cache implementation
@@ -23,8 +29,15 @@ type RedisCache struct {
 	Client *redis.Client
 	// TTL is how long each cache entry should remain before refresh
 	TTL time.Duration
+	// StaleTTL is how long a copy of each cache entry is retained for serving stale tiles
+	StaleTTL time.Duration
+	// NegativeTTL is how long empty tiles remain before refresh, where zero means TTL
+	NegativeTTL time.Duration
 }
 
+// staleKeyPrefix is the key prefix of the retained stale copies of cache entries
+const staleKeyPrefix = "stale:"
+
 // NewRedisCache creates a new RedisCache given a RedisConfig
 func NewRedisCache(config *RedisConfig) (Cache, error) {
 	client := redis.NewClient(&redis.Options{
@@ -32,8 +45,10 @@ func NewRedisCache(config *RedisConfig) (Cache, error) {
 	})
 	// TODO: Try to ping the server on boot?
 	return &RedisCache{
-		Client: client,
-		TTL:    config.TTL,
+		Client:      client,
+		TTL:         config.TTL,
+		StaleTTL:    config.StaleTTL,
+		NegativeTTL: config.NegativeCacheTTL,
 	}, nil
 }
 
@@ -64,11 +79,40 @@ func (r *RedisCache) Get(key string) ([]byte, error) {
 
 // Put attempts to store a new value into Redis at a given key
 func (r *RedisCache) Put(key string, val []byte) error {
-	err := r.Client.Set(key, val, r.TTL).Err()
+	return r.put(key, val, r.TTL)
+}
+
+// PutEmpty attempts to store a new empty tile value into Redis at a given key, which expires
+// after the NegativeTTL (if set)
+func (r *RedisCache) PutEmpty(key string, val []byte) error {
+	if r.NegativeTTL > 0 {
+		return r.put(key, val, r.NegativeTTL)
+	}
+	return r.put(key, val, r.TTL)
+}
+
+// put stores a new value into Redis at a given key with the given TTL, along with its stale copy
+func (r *RedisCache) put(key string, val []byte, ttl time.Duration) error {
+	err := r.Client.Set(key, val, ttl).Err()
 	if err != nil {
 		// Log an error in case the key can't be stored in Redis, but continue
 		Logger.Errorf("Could not store key [%s] in Redis: %v", key, err)
 		return err
 	}
+	if r.StaleTTL > 0 {
+		err = r.Client.Set(staleKeyPrefix+key, val, r.StaleTTL).Err()
+		if err != nil {
+			Logger.Errorf("Could not store stale copy of key [%s] in Redis: %v", key, err)
+			return err
+		}
+	}
 	return nil
 }
+
+// GetStale retrieves the retained stale copy of the cached value for a given key
+func (r *RedisCache) GetStale(key string) ([]byte, error) {
+	if r.StaleTTL <= 0 {
+		return nil, ErrNoValue
+	}
+	return r.Get(staleKeyPrefix + key)
+}
@@ -0,0 +1,206 @@
+package tilenol
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// repairFeatures repairs the geometries of the features (see repairGeometry), dropping the
+// features whose geometries are still invalid, and returns the number of dropped features
+func repairFeatures(fc *geojson.FeatureCollection) int {
+	features := fc.Features[:0]
+	dropped := 0
+	for _, feature := range fc.Features {
+		if feature.Geometry != nil {
+			if feature.Geometry = repairGeometry(feature.Geometry); feature.Geometry == nil {
+				dropped++
+				continue
+			}
+		}
+		features = append(features, feature)
+	}
+	fc.Features = features
+	return dropped
+}
+
+// repairGeometry fixes the common defects of a geometry: repeated positions, unclosed rings
+// and ring orientations (exterior rings are counter-clockwise and holes clockwise, as per RFC
+// 7946). It returns nil if the geometry is still invalid, i.e. if it has non-finite
+// coordinates, too few positions or self-intersecting rings. Invalid parts of
+// multi-geometries and collections are dropped.
+func repairGeometry(g orb.Geometry) orb.Geometry {
+	switch g := g.(type) {
+	case orb.Point:
+		if !finitePoint(g) {
+			return nil
+		}
+		return g
+	case orb.MultiPoint:
+		var repaired orb.MultiPoint
+		for _, p := range g {
+			if finitePoint(p) {
+				repaired = append(repaired, p)
+			}
+		}
+		if len(repaired) == 0 {
+			return nil
+		}
+		return repaired
+	case orb.LineString:
+		points, ok := dedupePoints(g)
+		if !ok || len(points) < 2 {
+			return nil
+		}
+		return orb.LineString(points)
+	case orb.MultiLineString:
+		var repaired orb.MultiLineString
+		for _, ls := range g {
+			if line, ok := repairGeometry(ls).(orb.LineString); ok {
+				repaired = append(repaired, line)
+			}
+		}
+		if len(repaired) == 0 {
+			return nil
+		}
+		return repaired
+	case orb.Ring:
+		if polygon := repairPolygon(orb.Polygon{g}); polygon != nil {
+			return polygon[0]
+		}
+		return nil
+	case orb.Bound:
+		return g
+	case orb.Polygon:
+		if polygon := repairPolygon(g); polygon != nil {
+			return polygon
+		}
+		return nil
+	case orb.MultiPolygon:
+		var repaired orb.MultiPolygon
+		for _, polygon := range g {
+			if polygon = repairPolygon(polygon); polygon != nil {
+				repaired = append(repaired, polygon)
+			}
+		}
+		if len(repaired) == 0 {
+			return nil
+		}
+		return repaired
+	case orb.Collection:
+		var repaired orb.Collection
+		for _, child := range g {
+			if child = repairGeometry(child); child != nil {
+				repaired = append(repaired, child)
+			}
+		}
+		if len(repaired) == 0 {
+			return nil
+		}
+		return repaired
+	}
+	return nil
+}
+
+// repairPolygon repairs the rings of a polygon, returning nil if its exterior ring is invalid.
+// Invalid holes are dropped.
+func repairPolygon(polygon orb.Polygon) orb.Polygon {
+	var repaired orb.Polygon
+	for i, ring := range polygon {
+		orientation := orb.CW
+		if i == 0 {
+			orientation = orb.CCW
+		}
+		ring = repairRing(ring, orientation)
+		if ring == nil {
+			if i == 0 {
+				return nil
+			}
+			continue
+		}
+		repaired = append(repaired, ring)
+	}
+	return repaired
+}
+
+// repairRing closes the ring and winds it in the given orientation, returning nil if it has
+// too few positions, no area or self-intersections
+func repairRing(ring orb.Ring, orientation orb.Orientation) orb.Ring {
+	points, ok := dedupePoints(ring)
+	if !ok {
+		return nil
+	}
+	repaired := orb.Ring(points)
+	if len(repaired) > 0 && repaired[0] != repaired[len(repaired)-1] {
+		repaired = append(repaired, repaired[0])
+	}
+	if len(repaired) < 4 || repaired.Orientation() == 0 || selfIntersects(repaired) {
+		return nil
+	}
+	if repaired.Orientation() != orientation {
+		repaired.Reverse()
+	}
+	return repaired
+}
+
+// dedupePoints copies the points without consecutive duplicates, returning false if any of
+// them has non-finite coordinates
+func dedupePoints(points []orb.Point) ([]orb.Point, bool) {
+	deduped := make([]orb.Point, 0, len(points))
+	for _, p := range points {
+		if !finitePoint(p) {
+			return nil, false
+		}
+		if len(deduped) == 0 || deduped[len(deduped)-1] != p {
+			deduped = append(deduped, p)
+		}
+	}
+	return deduped, true
+}
+
+// finitePoint returns whether or not both coordinates of the point are finite
+func finitePoint(p orb.Point) bool {
+	return !math.IsNaN(p[0]) && !math.IsInf(p[0], 0) && !math.IsNaN(p[1]) && !math.IsInf(p[1], 0)
+}
+
+// selfIntersects returns whether or not any two non-adjacent edges of the closed ring
+// intersect
+func selfIntersects(ring orb.Ring) bool {
+	n := len(ring) - 1 // The number of edges
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				// The first and last edges share the closing position
+				continue
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect returns whether or not the segments ab and cd intersect (or touch)
+func segmentsIntersect(a, b, c, d orb.Point) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(c, d, a)) || (d2 == 0 && onSegment(c, d, b)) ||
+		(d3 == 0 && onSegment(a, b, c)) || (d4 == 0 && onSegment(a, b, d))
+}
+
+// cross returns the cross product of the vectors ab and ac, whose sign gives the side of ab
+// that c is on
+func cross(a, b, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment returns whether or not the point p, which is collinear with ab, lies on ab
+func onSegment(a, b, p orb.Point) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
@@ -0,0 +1,43 @@
+package tilenol
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairGeometry(t *testing.T) {
+	// Clockwise exterior rings are rewound, and unclosed rings are closed
+	cw := orb.Polygon{{{0, 0}, {0, 1}, {1, 1}, {1, 0}}}
+	assert.Equal(t, orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}, repairGeometry(cw))
+
+	// Holes are wound clockwise
+	polygon := orb.Polygon{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{2, 2}, {4, 2}, {4, 4}, {2, 4}, {2, 2}},
+	}
+	repaired := repairGeometry(polygon).(orb.Polygon)
+	assert.Equal(t, orb.CCW, repaired[0].Orientation())
+	assert.Equal(t, orb.CW, repaired[1].Orientation())
+
+	assert.Equal(t, orb.LineString{{0, 0}, {1, 1}}, repairGeometry(orb.LineString{{0, 0}, {0, 0}, {1, 1}}))
+	assert.Nil(t, repairGeometry(orb.LineString{{0, 0}, {0, 0}}))
+	assert.Nil(t, repairGeometry(orb.Point{math.NaN(), 0}))
+
+	// Self-intersecting (bowtie) polygons can't be repaired
+	bowtie := orb.Polygon{{{0, 0}, {1, 1}, {1, 0}, {0, 1}, {0, 0}}}
+	assert.Nil(t, repairGeometry(bowtie))
+	assert.Equal(t, orb.MultiPolygon{polygon[:1]}, repairGeometry(orb.MultiPolygon{polygon[:1], bowtie}))
+}
+
+func TestLayerGetFeaturesRepairGeometries(t *testing.T) {
+	bowtie := orb.Polygon{{{0, 0}, {1, 1}, {1, 0}, {0, 1}, {0, 0}}}
+	layer := &Layer{Name: "repaired", Source: newStaticSource(orb.Point{1, 1}, bowtie), RepairGeometries: true}
+	fc, err := layer.GetFeatures(context.Background(), &TileRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, "1", Metrics.Get("invalid_repaired_dropped").String())
+}
@@ -0,0 +1,151 @@
+package tilenol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// Error type for HTTP Status code 403, returned for requests to a scoped layer that don't carry
+// the value it is scoped to
+type ForbiddenError struct {
+	s string
+}
+
+func (e ForbiddenError) Error() string {
+	return e.s
+}
+
+// RequestScopeConfig is the YAML configuration for scoping the features of a layer to a value
+// of each request (e.g. the tenant of a multi-tenant deployment), which is injected into the
+// source query as a mandatory term filter. Requests without the value are rejected with HTTP
+// 403.
+type RequestScopeConfig struct {
+	// Header is the name of the request header holding the scope value
+	Header string `yaml:"header"`
+	// Claim is the name of the claim of the bearer JWT (in the Authorization header) holding
+	// the scope value. The JWT signature is NOT verified, so claim scopes provide no isolation
+	// unless the token is verified upstream (e.g. by an API gateway).
+	Claim string `yaml:"claim"`
+	// Field is the document field (or column) that the features are filtered on
+	Field string `yaml:"field"`
+}
+
+// Validate checks that the scope reads its value from exactly one of a header and a claim
+func (c *RequestScopeConfig) Validate() error {
+	if (c.Header == "") == (c.Claim == "") {
+		return errors.New("Request scopes must have exactly one of a \"header\" and a \"claim\" configured")
+	}
+	if c.Field == "" {
+		return errors.New("Request scopes must have a \"field\" configured")
+	}
+	return nil
+}
+
+// key identifies where the scope value is read from, for keying the cache
+func (c *RequestScopeConfig) key() string {
+	if c.Header != "" {
+		return "header:" + http.CanonicalHeaderKey(c.Header)
+	}
+	return "claim:" + c.Claim
+}
+
+// value returns the scope value of the request headers, if any
+func (c *RequestScopeConfig) value(header http.Header) string {
+	if c.Header != "" {
+		return header.Get(c.Header)
+	}
+	return bearerClaim(header, c.Claim)
+}
+
+// bearerClaim returns the (string or numeric) value of a claim of the bearer JWT, without
+// verifying its signature
+func bearerClaim(header http.Header, claim string) string {
+	auth := header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	parts := strings.Split(auth[len(prefix):], ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// scopedRequest returns the request for the layer's Source with the layer's mandatory scope
+// term, or a ForbiddenError if the request doesn't carry the scope value
+func (l *Layer) scopedRequest(req *TileRequest) (*TileRequest, error) {
+	if l.Scope == nil {
+		return req, nil
+	}
+	value := l.Scope.value(req.Header)
+	if value == "" {
+		return nil, ForbiddenError{fmt.Sprintf("Missing the request scope of layer: %s", l.Name)}
+	}
+	scoped := &TileRequest{X: req.X, Y: req.Y, Z: req.Z, Args: req.Args, Header: req.Header, Terms: map[string]string{}}
+	for field, term := range req.Terms {
+		scoped.Terms[field] = term
+	}
+	scoped.Terms[l.Scope.Field] = value
+	return scoped, nil
+}
+
+// termFields returns the sorted fields of the mandatory term filters of the request, so that
+// sources build the same query for the same terms
+func (t *TileRequest) termFields() []string {
+	fields := make([]string, 0, len(t.Terms))
+	for field := range t.Terms {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// cacheKey returns the cache key of a tile request, which includes the scope values of the
+// requested scoped layers, so that differently scoped requests never share a cached tile
+func (s *Server) cacheKey(r *http.Request) string {
+	key := r.URL.RequestURI()
+	scopes := url.Values{}
+	for _, layer := range s.scopedLayers(r) {
+		scopes.Set(layer.Scope.key(), layer.Scope.value(r.Header))
+	}
+	if len(scopes) == 0 {
+		return key
+	}
+	return key + "#" + scopes.Encode()
+}
+
+// scopedLayers returns the requested layers that are scoped to a value of the request
+func (s *Server) scopedLayers(r *http.Request) []Layer {
+	var scoped []Layer
+	for _, layer := range s.requestedLayers(s.Layers, chi.URLParam(r, "layers")) {
+		if layer.Scope != nil {
+			scoped = append(scoped, layer)
+		}
+	}
+	return scoped
+}
@@ -0,0 +1,89 @@
+package tilenol
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+// termsSource is a fake Source that records the term filters of the requests
+type termsSource struct {
+	mu    sync.Mutex
+	terms []map[string]string
+}
+
+func (s *termsSource) GetFeatures(_ context.Context, req *TileRequest) (*geojson.FeatureCollection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terms = append(s.terms, req.Terms)
+	return geojson.NewFeatureCollection(), nil
+}
+
+func TestRequestScopeConfigValidate(t *testing.T) {
+	assert.Nil(t, (&RequestScopeConfig{Header: "X-Tenant", Field: "tenant"}).Validate())
+	assert.Nil(t, (&RequestScopeConfig{Claim: "tenant", Field: "tenant"}).Validate())
+	assert.NotNil(t, (&RequestScopeConfig{Field: "tenant"}).Validate())
+	assert.NotNil(t, (&RequestScopeConfig{Header: "X-Tenant", Claim: "tenant", Field: "tenant"}).Validate())
+	assert.NotNil(t, (&RequestScopeConfig{Header: "X-Tenant"}).Validate())
+
+	// Sources that can't filter on the scope are rejected
+	_, err := CreateLayer(LayerConfig{
+		Name:   "test",
+		Scope:  &RequestScopeConfig{Header: "X-Tenant", Field: "tenant"},
+		Source: SourceConfig{HTTP: &HTTPSourceConfig{URLTemplate: "http://localhost/{z}/{x}/{y}.json"}},
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Request scopes are only supported")
+	}
+}
+
+func TestBearerClaim(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tenant": "acme", "org": 42}`))
+	header := http.Header{"Authorization": []string{"Bearer header." + payload + ".signature"}}
+	assert.Equal(t, "acme", bearerClaim(header, "tenant"))
+	assert.Equal(t, "42", bearerClaim(header, "org"))
+	assert.Equal(t, "", bearerClaim(header, "missing"))
+	assert.Equal(t, "", bearerClaim(http.Header{"Authorization": []string{"Bearer opaque"}}, "tenant"))
+	assert.Equal(t, "", bearerClaim(http.Header{}, "tenant"))
+}
+
+func TestScopedLayer(t *testing.T) {
+	source := &termsSource{}
+	server := &Server{
+		Cache: NewInMemoryCache(),
+		Layers: []Layer{
+			Layer{Name: "scoped", Maxzoom: MaxZoom, Source: source, Scope: &RequestScopeConfig{Header: "X-Tenant", Field: "tenant_id"}},
+		},
+	}
+	api, _ := server.setupRoutes()
+	request := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, source.terms, "Unscoped requests never reach the source")
+
+	w = request("acme")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Cache-Control"), "private")
+	assert.Equal(t, []map[string]string{{"tenant_id": "acme"}}, source.terms)
+
+	// Tiles are cached per scope
+	request("acme")
+	assert.Len(t, source.terms, 1)
+	request("globex")
+	assert.Equal(t, []map[string]string{{"tenant_id": "acme"}, {"tenant_id": "globex"}}, source.terms)
+}
@@ -2,21 +2,28 @@ package tilenol
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/maptile"
-	"github.com/paulmach/orb/simplify"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -30,6 +37,18 @@ const (
 	MaxSimplify = 10.0
 	// AllLayers is the special request parameter for returning all source layers
 	AllLayers = "_all"
+	// DefaultCacheMaxAge is the Cache-Control max-age used when no layer overrides it
+	DefaultCacheMaxAge = 24 * time.Hour
+	// PrefetchTimeout is the maximum duration of rendering a prefetched neighbor tile
+	PrefetchTimeout = 30 * time.Second
+	// PartialTileHeader is the response header set when a tile may be missing features, e.g.
+	// because a source query timed out. Partial tiles are never cached.
+	PartialTileHeader = "X-Tilenol-Partial"
+	// StaleWarning is the Warning header value of stale tiles served in place of an error
+	StaleWarning = `111 tilenol "Revalidation Failed"`
+	// TileBoundsHeader is the response header holding the WGS84 bounds of the requested tile
+	// as "minx,miny,maxx,maxy", if enabled
+	TileBoundsHeader = "X-Tile-Bounds"
 )
 
 // TileRequest is an object containing the tile request context
@@ -38,6 +57,15 @@ type TileRequest struct {
 	Y    int
 	Z    int
 	Args map[string][]string
+	// Header holds the headers of the request, which the values of request-scoped layers are
+	// read from (see RequestScopeConfig)
+	Header http.Header
+	// Terms are the mandatory term filters that the source must apply, keyed by document field
+	// (or column), which are set by the scope of the layer
+	Terms map[string]string
+
+	// partial is atomically set when any source returns incomplete results for the request
+	partial int32
 }
 
 // Error type for HTTP Status code 400
@@ -67,7 +95,18 @@ func MakeTileRequest(req *http.Request, x int, y int, z int) (*TileRequest, erro
 		args[k] = values
 	}
 
-	return &TileRequest{x, y, z, args}, nil
+	return &TileRequest{X: x, Y: y, Z: z, Args: args, Header: req.Header}, nil
+}
+
+// MarkPartial flags the requested tile as possibly incomplete, e.g. because a source query
+// timed out. This is safe to call concurrently from the per-layer goroutines.
+func (t *TileRequest) MarkPartial() {
+	atomic.StoreInt32(&t.partial, 1)
+}
+
+// IsPartial returns whether or not any source flagged the requested tile as incomplete
+func (t *TileRequest) IsPartial() bool {
+	return atomic.LoadInt32(&t.partial) == 1
 }
 
 // MapTile creates a maptile.Tile object from the TileRequest
@@ -75,6 +114,23 @@ func (t *TileRequest) MapTile() maptile.Tile {
 	return maptile.New(uint32(t.X), uint32(t.Y), maptile.Zoom(t.Z))
 }
 
+// SinceArg is the request parameter for only returning the features that changed after an
+// RFC 3339 timestamp, for sources with a configured time field
+const SinceArg = "since"
+
+// sinceArg parses the optional SinceArg request argument, returning a zero time if unset
+func (t *TileRequest) sinceArg() (time.Time, error) {
+	values, exists := t.Args[SinceArg]
+	if !exists || len(values) == 0 {
+		return time.Time{}, nil
+	}
+	since, err := time.Parse(time.RFC3339, values[0])
+	if err != nil {
+		return time.Time{}, InvalidRequestError{fmt.Sprintf("Invalid since timestamp: %s", values[0])}
+	}
+	return since, nil
+}
+
 // Server is a tilenol server instance
 type Server struct {
 	// Port is the port number to bind the tile server
@@ -88,13 +144,74 @@ type Server struct {
 	Simplify bool
 	// Layers is the list of configured layers supported by the tile server
 	Layers []Layer
+	// Tilesets is the list of configured named groups of layers
+	Tilesets []Tileset
 	// Cache is an optional cache object that the server uses to cache responses
 	Cache Cache
+	// ServeStaleOnError configures whether or not the last cached tile is served (with a
+	// Warning header) instead of an error response when computing a tile fails. Note that
+	// this requires a Cache that implements StaleCache.
+	ServeStaleOnError bool
+	// Auth is the optional list of Authenticators used to guard the tile endpoints
+	Auth []Authenticator
+	// InternalAuth is the optional list of Authenticators used to guard the internal endpoints
+	InternalAuth []Authenticator
+	// EncodeWorkers is the maximum number of tiles that are encoded concurrently (defaults to
+	// the number of CPUs)
+	EncodeWorkers int
+	// HTTPConfig optionally tunes the timeouts, HTTP/2 and TLS settings of the HTTP servers
+	HTTPConfig *HTTPServerConfig
+	// PrefetchNeighbors configures whether or not rendering a tile also renders its (up to 8)
+	// neighbor tiles into the cache in the background, e.g. to speed up panning. At most
+	// EncodeWorkers neighbor tiles are prefetched at once, and the rest are skipped.
+	PrefetchNeighbors bool
+	// EnableJSONP configures whether or not JSON tile responses (e.g. TopoJSON) are wrapped in
+	// the JavaScript function named by the CallbackArg request parameter. Binary formats (e.g.
+	// MVT) ignore the callback.
+	EnableJSONP bool
+	// DefaultLayer is the optional name of the layer (or tileset) served at the tile paths
+	// without a layers segment (e.g. /{z}/{x}/{y}.mvt). With a single configured layer, that
+	// layer is the default.
+	DefaultLayer string
+	// ServerTiming configures whether or not rendered tiles are given a Server-Timing header,
+	// reporting the durations of the source fetch and of the encoding (including the wait for
+	// an encode worker) for client-side profiling
+	ServerTiming bool
+	// TileBounds configures whether or not tile responses are given a TileBoundsHeader, so
+	// that clients don't need to compute the bounds of the tiles themselves
+	TileBounds bool
+	// MaxLayerConcurrency is the maximum number of layers of a single tile request whose
+	// features are retrieved concurrently, where zero means all of them at once
+	MaxLayerConcurrency int
+
+	encodePool   *WorkerPool
+	prefetchPool *WorkerPool
+	// renders deduplicates the concurrent renders of the same uncached tile
+	renders singleflight.Group
 }
 
 // Handler is a type alias for a more functional HTTP request handler
 type Handler func(context.Context, io.Writer, *http.Request) error
 
+// responseBuffer buffers the response body written by a Handler, along with any response
+// headers that it sets
+type responseBuffer struct {
+	bytes.Buffer
+	header http.Header
+}
+
+// Header returns the response headers set by the Handler
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+// setHeader sets a response header from within a Handler, if the writer supports it
+func setHeader(w io.Writer, key, value string) {
+	if hw, ok := w.(interface{ Header() http.Header }); ok {
+		hw.Header().Set(key, value)
+	}
+}
+
 // NewServer creates a new server instance pre-configured with the given ConfigOption's
 func NewServer(configOpts ...ConfigOption) (*Server, error) {
 	s := &Server{}
@@ -104,6 +221,22 @@ func NewServer(configOpts ...ConfigOption) (*Server, error) {
 			return nil, err
 		}
 	}
+	// Propagate server-wide rendering options to each of the layers
+	for i := range s.Layers {
+		s.Layers[i].Simplify = s.Simplify
+	}
+	if s.EncodeWorkers < 1 {
+		s.EncodeWorkers = runtime.NumCPU()
+	}
+	s.encodePool = NewWorkerPool(s.EncodeWorkers, "encode_pool")
+	if s.PrefetchNeighbors {
+		s.prefetchPool = NewWorkerPool(s.EncodeWorkers, "prefetch_pool")
+	}
+	httpConfig := s.HTTPConfig.withDefaults()
+	if err := httpConfig.validate(); err != nil {
+		return nil, err
+	}
+	s.HTTPConfig = &httpConfig
 	return s, nil
 }
 
@@ -112,6 +245,7 @@ func (s *Server) setupRoutes() (*chi.Mux, *chi.Mux) {
 
 	//-- MIDDLEWARE
 	r.Use(middleware.RequestID)
+	r.Use(echoRequestID)
 	r.Use(middleware.RealIP)
 	logFormatter := &middleware.DefaultLogFormatter{Logger: Logger, NoColor: true}
 	r.Use(middleware.RequestLogger(logFormatter))
@@ -119,39 +253,116 @@ func (s *Server) setupRoutes() (*chi.Mux, *chi.Mux) {
 
 	if s.EnableCORS {
 		Logger.Infoln("Enabling CORS support")
+		var exposedHeaders []string
+		if s.TileBounds {
+			exposedHeaders = append(exposedHeaders, TileBoundsHeader)
+		}
 		cors := cors.New(cors.Options{
 			AllowedOrigins:   []string{"*"},
 			AllowedMethods:   []string{"GET", "OPTIONS"},
 			AllowedHeaders:   []string{"Accept", "Accept-Encoding", "Authorization", "Cache-Control"},
+			ExposedHeaders:   exposedHeaders,
 			AllowCredentials: true,
 		})
 		r.Use(cors.Handler)
+		if s.ServerTiming {
+			// Allow cross-origin clients to read the Server-Timing header
+			r.Use(middleware.SetHeader("Timing-Allow-Origin", "*"))
+		}
+	}
+
+	if len(s.Auth) > 0 {
+		Logger.Infoln("Enabling authentication for tile endpoints")
 	}
+	r.Use(RequireAuth(s.Auth))
 
 	//-- ROUTES
 	r.Get("/{layers}/{z}/{x}/{y}.mvt", s.cached(s.getVectorTile))
+	r.Get("/{layers}/{z}/{x}/{y}.pbf", s.cached(s.getVectorTile))
+	r.Get("/{layers}/{z}/{x}/{y}.topojson", s.cached(s.getTopoJSONTile))
+	r.Get("/{layers}/{z}/{x}/{y}/properties.json", s.cached(s.getTileProperties))
+	r.Get("/{layers}/{z}/{x}/{y}.png", s.cached(s.getRasterTile))
+	r.With(s.defaultLayers).Get("/{z}/{x}/{y}.mvt", s.cached(s.getVectorTile))
+	r.With(s.defaultLayers).Get("/{z}/{x}/{y}.pbf", s.cached(s.getVectorTile))
+	r.With(s.defaultLayers).Get("/{z}/{x}/{y}.topojson", s.cached(s.getTopoJSONTile))
+	r.With(s.defaultLayers).Get("/{z}/{x}/{y}/properties.json", s.cached(s.getTileProperties))
+	r.With(s.defaultLayers).Get("/{z}/{x}/{y}.png", s.cached(s.getRasterTile))
 
 	// TODO: Add GeoJSON endpoint?
 
 	i := chi.NewRouter()
+	i.Use(RequireAuth(s.InternalAuth))
 	i.Get("/healthcheck", s.healthCheck)
+	i.Get("/metrics", expvar.Handler().ServeHTTP)
 
 	return r, i
 }
 
+// defaultLayers is a middleware for the tile paths without a layers segment, which serves them
+// as requests for the default layer
+func (s *Server) defaultLayers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := s.DefaultLayer
+		if name == "" && len(s.Layers) == 1 {
+			name = s.Layers[0].Name
+		}
+		if name == "" {
+			s.handleError(newUnknownLayerError("No default layer is configured", s.Layers), w, r)
+			return
+		}
+		chi.RouteContext(r.Context()).URLParams.Add("layers", name)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// echoRequestID is a middleware that echoes the request ID (either read from the incoming
+// middleware.RequestIDHeader or generated by middleware.RequestID) back in the response headers
+func echoRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(middleware.RequestIDHeader, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Start actually starts the server instance. Note that this blocks until an interrupting signal
 func (s *Server) Start() {
 	r, i := s.setupRoutes()
 
+	httpConfig := s.HTTPConfig.withDefaults()
+	server, err := httpConfig.newHTTPServer(s.Port, r)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// The internal endpoints are never served over TLS, and always listen on the internal port
+	internalConfig := httpConfig
+	internalConfig.TLSCertFile, internalConfig.TLSKeyFile = "", ""
+	internalConfig.Listen = ""
+	internalServer, err := internalConfig.newHTTPServer(s.InternalPort, i)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Bind both servers up front, so that startup fails if an address is unavailable
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	internalListener, err := listen(internalServer.Addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	go func() {
-		log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", s.Port), r))
+		log.Fatalln(httpConfig.serve(server, listener))
 	}()
 
 	go func() {
-		log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", s.InternalPort), i))
+		log.Fatalln(internalConfig.serve(internalServer, internalListener))
 	}()
 
-	Logger.Infof("Tilenol server up and running @ 0.0.0.0:[%d,%d]", s.Port, s.InternalPort)
+	Logger.Infof("Tilenol server up and running @ [%s, %s]", server.Addr, internalServer.Addr)
 
 	select {}
 }
@@ -178,16 +389,27 @@ func (s *Server) cached(handler Handler) http.HandlerFunc {
 		ctx := r.Context()
 		defer func() {
 			if ctx.Err() == context.Canceled {
-				Logger.Debugf("Request canceled by client")
+				RequestLogger(ctx).Debugf("Request canceled by client")
 				w.WriteHeader(499)
 				return
 			}
 		}()
 
-		var buffer bytes.Buffer
-		key := r.URL.RequestURI()
+		// Allow caches to revalidate tiles for which the underlying data hasn't changed
+		lastModified := s.lastModified(ctx, r)
+		if !lastModified.IsZero() {
+			w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+			if notModifiedSince(r, lastModified) {
+				w.Header().Set("Cache-Control", s.cacheControl(r))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		buffer := &responseBuffer{header: make(http.Header)}
+		key := s.cacheKey(r)
 		if s.Cache.Exists(key) {
-			Logger.Debugf("Key [%s] found in cache", key)
+			RequestLogger(ctx).Debugf("Key [%s] found in cache", key)
 			val, err := s.Cache.Get(key)
 			if err != nil {
 				s.handleError(err.(error), w, r)
@@ -195,26 +417,339 @@ func (s *Server) cached(handler Handler) http.HandlerFunc {
 			}
 			buffer.Write(val)
 		} else {
-			Logger.Debugf("Key [%s] is not cached", key)
-			herr := handler(ctx, &buffer, r)
+			RequestLogger(ctx).Debugf("Key [%s] is not cached", key)
+			herr := s.render(ctx, key, handler, buffer, r)
 			if herr != nil {
-				s.handleError(herr.(error), w, r)
-				return
+				stale, found := s.staleTile(ctx, key, herr)
+				if !found {
+					s.handleError(herr.(error), w, r)
+					return
+				}
+				RequestLogger(ctx).Warnf("Serving stale tile for key [%s] after error: %v", key, herr)
+				buffer = &responseBuffer{header: make(http.Header)}
+				buffer.Write(stale)
+				buffer.Header().Set("Warning", StaleWarning)
+				buffer.Header().Set("Cache-Control", NoCache)
 			}
-			err := s.Cache.Put(key, buffer.Bytes())
+		}
+		// Set standard response headers
+		w.Header().Set("Cache-Control", s.cacheControl(r))
+		if s.TileBounds {
+			w.Header().Set(TileBoundsHeader, tileBounds(r))
+		}
+		// Tiles are rendered (and cached) gzipped, and only decompressed for the clients that
+		// don't accept gzipped responses
+		var body io.Reader = buffer
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			gr, err := gzip.NewReader(buffer)
 			if err != nil {
-				// Log an error in case the key can't be stored in cache, but continue
-				Logger.Warnf("Could not store key [%s] in cache: %v", key, err)
+				s.handleError(err, w, r)
+				return
 			}
+			defer gr.Close()
+			body = gr
 		}
-		// Set standard response headers
-		// TODO: Use the cache TTL to determine the Cache-Control
-		w.Header().Set("Cache-Control", "max-age=86400")
-		w.Header().Set("Content-Encoding", "gzip")
-		// TODO: Store the content type somehow in the cache?
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		io.Copy(w, &buffer)
+		w.Header().Set("Content-Type", s.tileContentType(r))
+		// Headers set by the handler take precedence over the standard ones
+		buffer.Header().Del(emptyTileHeader)
+		for k, v := range buffer.Header() {
+			w.Header()[k] = v
+		}
+		io.Copy(w, body)
+	}
+}
+
+// tileContentType returns the content type of a tile response, which is determined by its
+// route (and the JSONP callback of the JSON formats) rather than by the handler, since the
+// cache only stores the response body. Cached and stale tiles thus get the same content type as
+// freshly rendered ones.
+func (s *Server) tileContentType(r *http.Request) string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		path = rctx.RoutePattern()
+	}
+	var contentType string
+	switch {
+	case strings.HasSuffix(path, ".png"):
+		return PNGContentType
+	case strings.HasSuffix(path, ".topojson"):
+		contentType = TopoJSONContentType
+	case strings.HasSuffix(path, "/"+sidecarPathSuffix):
+		contentType = SidecarContentType
+	default:
+		return MVTContentType
+	}
+	if callback, err := s.jsonpCallback(r); err == nil && callback != "" {
+		return JSONPContentType
+	}
+	return contentType
+}
+
+// renderedTile is the response of a rendered tile, which is shared by the concurrent requests
+// for the same key
+type renderedTile struct {
+	body   []byte
+	header http.Header
+}
+
+// render renders the uncached tile for the key into the buffer, and stores it in the cache.
+// Concurrent requests for the same key share a single in-progress render (and its result),
+// instead of each of them querying the sources (i.e. a cache stampede).
+func (s *Server) render(ctx context.Context, key string, handler Handler, buffer *responseBuffer, r *http.Request) error {
+	v, err, shared := s.renders.Do(key, func() (interface{}, error) {
+		rendered := &responseBuffer{header: make(http.Header)}
+		if err := handler(ctx, rendered, r); err != nil {
+			return nil, err
+		}
+		if rendered.Header().Get(PartialTileHeader) != "" {
+			RequestLogger(ctx).Debugf("Not caching partial tile for key [%s]", key)
+		} else if err := s.putTile(key, rendered); err != nil {
+			// Log an error in case the key can't be stored in cache, but continue
+			RequestLogger(ctx).Warnf("Could not store key [%s] in cache: %v", key, err)
+		} else if s.PrefetchNeighbors {
+			s.prefetchNeighbors(handler, r)
+		}
+		return &renderedTile{body: rendered.Bytes(), header: rendered.Header()}, nil
+	})
+	if err != nil {
+		if shared && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			// The shared render was canceled along with the request that started it, so try
+			// again on behalf of this request
+			return s.render(ctx, key, handler, buffer, r)
+		}
+		return err
+	}
+	if shared {
+		RequestLogger(ctx).Debugf("Shared in-progress render for key [%s]", key)
+	}
+	tile := v.(*renderedTile)
+	// Each request gets its own copy of the response, which is read as it is written out
+	for k, v := range tile.header {
+		buffer.Header()[k] = append([]string(nil), v...)
+	}
+	buffer.Write(tile.body)
+	return nil
+}
+
+// prefetchNeighbors renders the uncached neighbors of the requested tile into the cache in the
+// background, without blocking the request. Neighbor tiles are skipped when all prefetch
+// workers are busy.
+func (s *Server) prefetchNeighbors(handler Handler, r *http.Request) {
+	if _, isNil := s.Cache.(*NilCache); isNil {
+		return
+	}
+	layers := chi.URLParam(r, "layers")
+	z, _ := strconv.Atoi(chi.URLParam(r, "z"))
+	x, _ := strconv.Atoi(chi.URLParam(r, "x"))
+	y, _ := strconv.Atoi(chi.URLParam(r, "y"))
+	pattern := chi.RouteContext(r.Context()).RoutePattern()
+	// Keep the request ID around for correlating the prefetch logs with the original request
+	baseCtx := context.WithValue(context.Background(), middleware.RequestIDKey, middleware.GetReqID(r.Context()))
+	for _, neighbor := range neighborTiles(x, y, z) {
+		nx, ny := neighbor[0], neighbor[1]
+		go s.prefetchPool.TryDo(func() {
+			ctx, cancel := context.WithTimeout(baseCtx, PrefetchTimeout)
+			defer cancel()
+
+			routeCtx := chi.NewRouteContext()
+			routeCtx.URLParams.Add("layers", layers)
+			routeCtx.URLParams.Add("z", strconv.Itoa(z))
+			routeCtx.URLParams.Add("x", strconv.Itoa(nx))
+			routeCtx.URLParams.Add("y", strconv.Itoa(ny))
+			nr := r.Clone(context.WithValue(ctx, chi.RouteCtxKey, routeCtx))
+			nr.URL.Path = strings.NewReplacer(
+				"{layers}", layers,
+				"{z}", strconv.Itoa(z),
+				"{x}", strconv.Itoa(nx),
+				"{y}", strconv.Itoa(ny),
+			).Replace(pattern)
+
+			key := s.cacheKey(nr)
+			if s.Cache.Exists(key) {
+				return
+			}
+			buffer := &responseBuffer{header: make(http.Header)}
+			if err := handler(nr.Context(), buffer, nr); err != nil {
+				RequestLogger(ctx).Warnf("Could not prefetch key [%s]: %v", key, err)
+				return
+			}
+			if buffer.Header().Get(PartialTileHeader) != "" {
+				return
+			}
+			if err := s.putTile(key, buffer); err != nil {
+				RequestLogger(ctx).Warnf("Could not store prefetched key [%s] in cache: %v", key, err)
+			}
+		})
+	}
+}
+
+// neighborTiles returns the distinct (x, y) coordinates of the tiles surrounding the given
+// tile, wrapping around the antimeridian
+func neighborTiles(x, y, z int) [][2]int {
+	n := 1 << uint32(z)
+	seen := map[[2]int]bool{{x, y}: true}
+	var neighbors [][2]int
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			ny := y + dy
+			if ny < 0 || ny >= n {
+				continue
+			}
+			neighbor := [2]int{((x+dx)%n + n) % n, ny}
+			if !seen[neighbor] {
+				seen[neighbor] = true
+				neighbors = append(neighbors, neighbor)
+			}
+		}
+	}
+	return neighbors
+}
+
+// staleTile retrieves the last cached tile for a key after the tile handler failed, if
+// ServeStaleOnError is enabled and the failure isn't caused by the request itself
+func (s *Server) staleTile(ctx context.Context, key string, err error) ([]byte, bool) {
+	if !s.ServeStaleOnError || ctx.Err() != nil {
+		return nil, false
+	}
+	if _, invalid := err.(InvalidRequestError); invalid {
+		return nil, false
+	}
+	cache, ok := s.Cache.(StaleCache)
+	if !ok {
+		return nil, false
+	}
+	val, err := cache.GetStale(key)
+	if err != nil {
+		return nil, false
+	}
+	return val, true
+}
+
+// lastModified determines the latest modification time of the features of the requested
+// tile across all of the requested layers. A zero time is returned if any of the layers
+// can't determine it, since the tile can't be revalidated then.
+func (s *Server) lastModified(ctx context.Context, r *http.Request) time.Time {
+	z, _ := strconv.Atoi(chi.URLParam(r, "z"))
+	x, _ := strconv.Atoi(chi.URLParam(r, "x"))
+	y, _ := strconv.Atoi(chi.URLParam(r, "y"))
+	req, err := MakeTileRequest(r, x, y, z)
+	if err != nil {
+		// Leave it to the tile handler to report invalid requests
+		return time.Time{}
+	}
+	param := chi.URLParam(r, "layers")
+	layers := s.requestedLayers(filterLayersByZoom(s.Layers, z), param)
+	if names, err := req.layersArg(s.requestedLayers(s.Layers, param)); err != nil {
+		return time.Time{}
+	} else if names != nil {
+		layers = filterLayersByNames(layers, names)
+	}
+	if len(layers) == 0 {
+		return time.Time{}
+	}
+	var lastModified time.Time
+	for _, layer := range layers {
+		layerModified, err := layer.LastModified(ctx, req)
+		if err != nil {
+			// Log an error in case the time can't be determined, but continue rendering
+			RequestLogger(ctx).Warnf("Could not determine last modification time for layer [%s]: %v", layer.Name, err)
+			return time.Time{}
+		}
+		if layerModified.IsZero() {
+			return time.Time{}
+		}
+		if layerModified.After(lastModified) {
+			lastModified = layerModified
+		}
+	}
+	return lastModified
+}
+
+// notModifiedSince checks whether the request's If-Modified-Since header is at or after the
+// given last modification time, using the header's one second resolution
+func notModifiedSince(r *http.Request, lastModified time.Time) bool {
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
 	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// cacheControl determines the Cache-Control header value for a request, based on the
+// most restrictive setting among the requested layers
+func (s *Server) cacheControl(r *http.Request) string {
+	layers := s.requestedLayers(s.Layers, chi.URLParam(r, "layers"))
+	maxAge := DefaultCacheMaxAge
+	for _, layer := range layers {
+		if layer.CacheMaxAge != nil && *layer.CacheMaxAge < maxAge {
+			maxAge = *layer.CacheMaxAge
+		}
+	}
+	if maxAge == 0 {
+		return NoCache
+	}
+	if len(s.scopedLayers(r)) > 0 {
+		// Scoped tiles must not be shared with other clients by intermediate caches
+		return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+	}
+	return fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+}
+
+// requestedLayers filters the given layers by the layers URL parameter of a request, which is
+// either the special AllLayers value, the name of a tileset, or a comma-separated list of
+// layer names
+func (s *Server) requestedLayers(inLayers []Layer, param string) []Layer {
+	if param == AllLayers {
+		return inLayers
+	}
+	for _, tileset := range s.Tilesets {
+		if tileset.Name == param {
+			return filterLayersByNames(inLayers, tileset.Layers)
+		}
+	}
+	return filterLayersByNames(inLayers, strings.Split(param, ","))
+}
+
+// LayersArg is the request parameter for composing a multi-layer tile out of a subset of the
+// requested layers, in the given order (e.g. /_all/{z}/{x}/{y}.mvt?layers=roads,pois)
+const LayersArg = "layers"
+
+// layersArg parses the optional LayersArg request argument, returning the names of the layers
+// to include, or nil if unset. Each name must be one of the available (requested) layers.
+func (t *TileRequest) layersArg(available []Layer) ([]string, error) {
+	values, exists := t.Args[LayersArg]
+	if !exists || len(values) == 0 {
+		return nil, nil
+	}
+	names := strings.Split(values[0], ",")
+	for _, name := range names {
+		if len(filterLayersByNames(available, []string{name})) == 0 {
+			return nil, InvalidRequestError{fmt.Sprintf("Unknown layer in %s parameter: [%s]", LayersArg, name)}
+		}
+	}
+	return names, nil
+}
+
+// checkLayers returns an UnknownLayerError if the layers URL parameter of a request names any
+// layer that isn't configured
+func (s *Server) checkLayers(param string) error {
+	if param == AllLayers {
+		return nil
+	}
+	for _, tileset := range s.Tilesets {
+		if tileset.Name == param {
+			return nil
+		}
+	}
+	for _, name := range strings.Split(param, ",") {
+		if len(filterLayersByNames(s.Layers, []string{name})) == 0 {
+			return newUnknownLayerError(fmt.Sprintf("Unknown layer [%s]", name), s.Layers)
+		}
+	}
+	return nil
 }
 
 // filterLayersByNames filters the tile server layers by the names of layers being
@@ -231,87 +766,243 @@ func filterLayersByNames(inLayers []Layer, names []string) []Layer {
 	return outLayers
 }
 
-// filterLayersByZoom filters the tile server layers by zoom level bounds
+// filterLayersByZoom filters the tile server layers by zoom level bounds. Both bounds are
+// inclusive; layers created without an explicit minzoom/maxzoom cover the full MinZoom to
+// MaxZoom range, whereas an explicit maxzoom of 0 restricts the layer to z = 0. Layers with
+// Overzoom enabled have no upper bound.
 func filterLayersByZoom(inLayers []Layer, z int) []Layer {
 	var outLayers []Layer
 	for _, layer := range inLayers {
-		if layer.Minzoom <= z && (layer.Maxzoom >= z || layer.Maxzoom == 0) {
+		if layer.Minzoom <= z && (layer.Maxzoom >= z || layer.Overzoom) {
 			outLayers = append(outLayers, layer)
 		}
 	}
 	return outLayers
 }
 
-// getVectorTile computes a vector tile response for the incoming request
-func (s *Server) getVectorTile(rctx context.Context, w io.Writer, r *http.Request) error {
+// getTileFeatures retrieves the features of each of the requested layers for the incoming request
+func (s *Server) getTileFeatures(rctx context.Context, r *http.Request) (*TileRequest, []Layer, []*geojson.FeatureCollection, error) {
 	z, _ := strconv.Atoi(chi.URLParam(r, "z"))
 	x, _ := strconv.Atoi(chi.URLParam(r, "x"))
 	y, _ := strconv.Atoi(chi.URLParam(r, "y"))
-	requestedLayers := chi.URLParam(r, "layers")
 	req, err := MakeTileRequest(r, x, y, z)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	var layersToCompute = filterLayersByZoom(s.Layers, z)
-	if requestedLayers != AllLayers {
-		layersToCompute = filterLayersByNames(layersToCompute, strings.Split(requestedLayers, ","))
+	param := chi.URLParam(r, "layers")
+	if err := s.checkLayers(param); err != nil {
+		return nil, nil, nil, err
+	}
+	layersToCompute := s.requestedLayers(filterLayersByZoom(s.Layers, z), param)
+	if names, err := req.layersArg(s.requestedLayers(s.Layers, param)); err != nil {
+		return nil, nil, nil, err
+	} else if names != nil {
+		layersToCompute = filterLayersByNames(layersToCompute, names)
 	}
 
+	fcs, err := fetchTileFeatures(rctx, req, layersToCompute, s.MaxLayerConcurrency)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return req, layersToCompute, fcs, nil
+}
+
+// fetchTileFeatures retrieves the features of each of the layers for the tile request, running
+// at most maxConcurrency (if positive) layer queries at once. The features of failed Optional
+// layers are left empty, marking the request as partial.
+func fetchTileFeatures(rctx context.Context, req *TileRequest, layers []Layer, maxConcurrency int) ([]*geojson.FeatureCollection, error) {
 	// Create an errgroup with the request context so that we can get cancellable,
 	// fork-join parallelism behavior
 	eg, ctx := errgroup.WithContext(rctx)
 
-	fcLayers := make(mvt.Layers, len(layersToCompute))
-	for i, layer := range layersToCompute {
+	// Optionally throttle the per-layer queries of the request. The results are still
+	// assembled in the order of the layers, regardless of the order they complete in.
+	var slots chan struct{}
+	if maxConcurrency > 0 {
+		slots = make(chan struct{}, maxConcurrency)
+	}
+
+	fcs := make([]*geojson.FeatureCollection, len(layers))
+	for i, layer := range layers {
 		i, layer := i, layer // Fun stuff: https://blog.cloudflare.com/a-go-gotcha-when-closures-and-goroutines-collide/
 		eg.Go(func() error {
-			Logger.Debugf("Retrieving vector tile for layer [%s] @ (%d, %d, %d)", layer.Name, x, y, z)
-			fc, err := layer.Source.GetFeatures(ctx, req)
-			if err != nil {
-				return err
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
-			fcLayer := mvt.NewLayer(layer.Name, fc)
-			fcLayer.Version = 2 // Set to tile spec v2
-			fcLayer.ProjectToTile(req.MapTile())
-			fcLayer.Clip(mvt.MapboxGLDefaultExtentBound)
-
-			if s.Simplify {
-				minZoom := layer.Minzoom
-				maxZoom := layer.Maxzoom
-				simplifyThreshold := calculateSimplificationThreshold(minZoom, maxZoom, z)
-				Logger.Debugf("Simplifying @ zoom [%d], epsilon [%f]", z, simplifyThreshold)
-				fcLayer.Simplify(simplify.DouglasPeucker(simplifyThreshold))
-				fcLayer.RemoveEmpty(1.0, 1.0)
+			RequestLogger(ctx).Debugf("Retrieving vector tile for layer [%s] @ (%d, %d, %d)", layer.Name, req.X, req.Y, req.Z)
+			fc, err := layer.GetFeatures(ctx, req)
+			if err != nil {
+				if !layer.skipFailure(ctx, err) {
+					return err
+				}
+				// Optional layers are rendered empty, and the tile isn't cached so that the
+				// layer reappears once its source recovers
+				fc = geojson.NewFeatureCollection()
+				req.MarkPartial()
 			}
-			fcLayers[i] = fcLayer
+			fcs[i] = fc
 			return nil
 		})
 	}
 	// Wait for all of the goroutines spawned in this errgroup to complete or fail
 	if err := eg.Wait(); err != nil {
 		// If any of them fail, return the error
+		return nil, err
+	}
+	return fcs, nil
+}
+
+// tileBounds formats the WGS84 bounds of the requested tile for the TileBoundsHeader
+func tileBounds(r *http.Request) string {
+	z, _ := strconv.Atoi(chi.URLParam(r, "z"))
+	x, _ := strconv.Atoi(chi.URLParam(r, "x"))
+	y, _ := strconv.Atoi(chi.URLParam(r, "y"))
+	bound := maptile.New(uint32(x), uint32(y), maptile.Zoom(z)).Bound()
+	coords := []float64{bound.Left(), bound.Bottom(), bound.Right(), bound.Top()}
+	values := make([]string, len(coords))
+	for i, c := range coords {
+		values[i] = strconv.FormatFloat(c, 'f', -1, 64)
+	}
+	return strings.Join(values, ",")
+}
+
+// setServerTiming sets the Server-Timing header of a rendered tile, if enabled
+func (s *Server) setServerTiming(w io.Writer, fetch, encode time.Duration) {
+	if !s.ServerTiming {
+		return
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	setHeader(w, "Server-Timing", fmt.Sprintf("fetch;dur=%.1f, encode;dur=%.1f", ms(fetch), ms(encode)))
+}
+
+// emptyTileHeader is the internal response header that marks tiles without any features, so
+// that they can be cached with the NegativeCache expiry. It is never sent to clients.
+const emptyTileHeader = "X-Tilenol-Empty"
+
+// setEmptyHeader marks the response as an empty tile if none of the layers have any features
+func setEmptyHeader(w io.Writer, fcs []*geojson.FeatureCollection) {
+	if isEmptyTile(fcs) {
+		setHeader(w, emptyTileHeader, "true")
+	}
+}
+
+// isEmptyTile returns whether or not none of the layers of a tile have any features
+func isEmptyTile(fcs []*geojson.FeatureCollection) bool {
+	for _, fc := range fcs {
+		if len(fc.Features) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// putTile stores a rendered tile in the cache, using the separate expiry of empty tiles if the
+// cache is a NegativeCache
+func (s *Server) putTile(key string, rendered *responseBuffer) error {
+	if cache, ok := s.Cache.(NegativeCache); ok && rendered.Header().Get(emptyTileHeader) != "" {
+		return cache.PutEmpty(key, rendered.Bytes())
+	}
+	return s.Cache.Put(key, rendered.Bytes())
+}
+
+// setPartialHeaders marks the response as a partial tile, which must not be cached
+func setPartialHeaders(w io.Writer, req *TileRequest) {
+	if req.IsPartial() {
+		setHeader(w, PartialTileHeader, "true")
+		setHeader(w, "Cache-Control", NoCache)
+	}
+}
+
+// getVectorTile computes a vector tile response for the incoming request
+func (s *Server) getVectorTile(rctx context.Context, w io.Writer, r *http.Request) error {
+	start := time.Now()
+	req, layersToCompute, fcs, err := s.getTileFeatures(rctx, r)
+	if err != nil {
 		return err
 	}
+	fetched := time.Now()
 
-	// Lastly, marshal the object into the response output
-	data, marshalErr := mvt.MarshalGzipped(fcLayers)
-	if marshalErr != nil {
+	data, err := encodeVectorTile(rctx, s.encodePool, req, layersToCompute, fcs)
+	if err != nil {
+		return err
+	}
+	s.setServerTiming(w, fetched.Sub(start), time.Since(fetched))
+	setPartialHeaders(w, req)
+	setEmptyHeader(w, fcs)
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeVectorTile encodes the features of each of the layers into a gzipped MVT tile, using
+// the bounded worker pool so that CPU-bound encoding doesn't starve the source fetches of other
+// requests
+func encodeVectorTile(ctx context.Context, pool *WorkerPool, req *TileRequest, layers []Layer, fcs []*geojson.FeatureCollection) ([]byte, error) {
+	if req.sidecarProperties() {
+		if err := stripProperties(layers, fcs); err != nil {
+			return nil, err
+		}
+	}
+	var data []byte
+	err := pool.Do(ctx, func() error {
+		fcLayers := make(mvt.Layers, len(layers))
+		for i, layer := range layers {
+			fcLayers[i] = layer.encodeMVTLayer(req, fcs[i])
+		}
+		// Lastly, marshal the object into the response output
+		var marshalErr error
+		data, marshalErr = mvt.MarshalGzipped(fcLayers)
 		return marshalErr
+	})
+	if err != nil {
+		return nil, err
 	}
+	return data, nil
+}
+
+// buildTopology builds the TopoJSON topology of the tile request, with one object per layer
+func buildTopology(req *TileRequest, layers []Layer, fcs []*geojson.FeatureCollection) *Topology {
+	topology := newTopologyBuilder(req.MapTile().Bound(), TopoJSONQuantization)
+	for i, layer := range layers {
+		topology.addLayer(layer.Name, fcs[i])
+	}
+	return topology.build()
+}
+
+// getTopoJSONTile computes a gzipped TopoJSON tile response for the incoming request, with one
+// object per requested layer
+func (s *Server) getTopoJSONTile(rctx context.Context, w io.Writer, r *http.Request) error {
+	start := time.Now()
+	req, layersToCompute, fcs, err := s.getTileFeatures(rctx, r)
+	if err != nil {
+		return err
+	}
+	fetched := time.Now()
+
+	var data []byte
+	var contentType string
+	err = s.encodePool.Do(rctx, func() error {
+		var encodeErr error
+		data, contentType, encodeErr = s.encodeJSON(r, buildTopology(req, layersToCompute, fcs), TopoJSONContentType)
+		return encodeErr
+	})
+	if err != nil {
+		return err
+	}
+	s.setServerTiming(w, fetched.Sub(start), time.Since(fetched))
+	setHeader(w, "Content-Type", contentType)
+	setPartialHeaders(w, req)
+	setEmptyHeader(w, fcs)
 	_, err = w.Write(data)
 	return err
 }
 
 // handleError is a helper function to generate a generic tile server error response
 func (s *Server) handleError(err error, w http.ResponseWriter, r *http.Request) {
-	var errCode int
-	switch err.(type) {
-	case InvalidRequestError:
-		errCode = http.StatusBadRequest
-	default:
-		errCode = http.StatusInternalServerError
-	}
-	Logger.Errorf("Tile request failed: %s (HTTP error %d)", err.Error(), errCode)
-	http.Error(w, err.Error(), errCode)
+	writeError(w, r, err)
 }
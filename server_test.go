@@ -3,11 +3,23 @@ package tilenol
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFilterLayersByName(t *testing.T) {
@@ -30,7 +42,7 @@ func TestFilterLayersByName(t *testing.T) {
 
 func TestFilterLayersByZoom(t *testing.T) {
 	layers := []Layer{
-		Layer{Name: "a", Minzoom: 10},
+		Layer{Name: "a", Minzoom: 10, Maxzoom: MaxZoom},
 		Layer{Name: "b", Maxzoom: 10},
 		Layer{Name: "c", Minzoom: 5, Maxzoom: 15},
 	}
@@ -51,6 +63,12 @@ func TestFilterLayersByZoom(t *testing.T) {
 	if len(filteredZ20) != 1 {
 		t.Error("z = 20")
 	}
+
+	// An explicit maxzoom of 0 only covers z = 0
+	filteredZ1 := filterLayersByZoom([]Layer{Layer{Name: "d"}}, 1)
+	if len(filteredZ1) != 0 {
+		t.Error("z = 1")
+	}
 }
 
 func TestCalculateSimplificationThreshold(t *testing.T) {
@@ -108,6 +126,327 @@ func TestUnCachedHandler(t *testing.T) {
 	}
 }
 
+func TestPartialTileNotCached(t *testing.T) {
+	server := &Server{Cache: NewInMemoryCache()}
+	var requests []interface{}
+	handler := func(_ context.Context, w io.Writer, _ *http.Request) error {
+		requests = append(requests, nil)
+		setHeader(w, PartialTileHeader, "true")
+		setHeader(w, "Cache-Control", NoCache)
+		return nil
+	}
+	cachedHandler := server.cached(handler)
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil)
+		w := httptest.NewRecorder()
+		cachedHandler.ServeHTTP(w, r)
+		res := w.Result()
+		if res.Header.Get(PartialTileHeader) != "true" {
+			t.Error("Partial tile header not set")
+		}
+		if res.Header.Get("Cache-Control") != NoCache {
+			t.Errorf("Invalid Cache-Control for partial tile: %s", res.Header.Get("Cache-Control"))
+		}
+	}
+	if len(requests) != 10 {
+		t.Error("Partial tiles should not be cached")
+	}
+}
+
+func TestSharedRender(t *testing.T) {
+	server := &Server{Cache: &NilCache{}}
+	var renders int32
+	release := make(chan struct{})
+	handler := func(_ context.Context, w io.Writer, _ *http.Request) error {
+		atomic.AddInt32(&renders, 1)
+		<-release
+		setHeader(w, "X-Rendered", "true")
+		_, err := w.Write([]byte("tile"))
+		return err
+	}
+	cachedHandler := server.cached(handler)
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 10)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w http.ResponseWriter) {
+			defer wg.Done()
+			cachedHandler.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+		}(responses[i])
+	}
+	// Give all of the requests the chance to join the in-progress render
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&renders))
+	for _, w := range responses {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "true", w.Header().Get("X-Rendered"))
+		assert.Equal(t, "tile", w.Body.String())
+	}
+
+	// Renders aren't shared once they're done
+	cachedHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&renders))
+}
+
+// concurrencySource is a fake Source that tracks the maximum number of concurrent requests
+type concurrencySource struct {
+	active, max *int32
+	point       orb.Point
+}
+
+func (c *concurrencySource) GetFeatures(context.Context, *TileRequest) (*geojson.FeatureCollection, error) {
+	active := atomic.AddInt32(c.active, 1)
+	defer atomic.AddInt32(c.active, -1)
+	for {
+		max := atomic.LoadInt32(c.max)
+		if active <= max || atomic.CompareAndSwapInt32(c.max, max, active) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	fc := geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(c.point))
+	return fc, nil
+}
+
+func TestMaxLayerConcurrency(t *testing.T) {
+	var active, max int32
+	server := &Server{Cache: &NilCache{}, MaxLayerConcurrency: 2}
+	for i := 0; i < 6; i++ {
+		server.Layers = append(server.Layers, Layer{
+			Name:    fmt.Sprintf("layer%d", i),
+			Maxzoom: MaxZoom,
+			Source:  &concurrencySource{active: &active, max: &max, point: orb.Point{float64(i), 0}},
+		})
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&max))
+	layers, err := mvt.UnmarshalGzipped(w.Body.Bytes())
+	assert.Nil(t, err)
+	if assert.Len(t, layers, 6) {
+		for i, layer := range layers {
+			assert.Equal(t, fmt.Sprintf("layer%d", i), layer.Name, "Layers keep their order")
+		}
+	}
+}
+
+// emptyCache is a fake NegativeCache that records the empty tiles separately
+type emptyCache struct {
+	*InMemoryCache
+	mu    sync.Mutex
+	empty map[string][]byte
+}
+
+func (e *emptyCache) PutEmpty(key string, val []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.empty[key] = val
+	return nil
+}
+
+func (e *emptyCache) isEmpty(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, exists := e.empty[key]
+	return exists
+}
+
+func TestNegativeCache(t *testing.T) {
+	cache := &emptyCache{InMemoryCache: NewInMemoryCache().(*InMemoryCache), empty: make(map[string][]byte)}
+	server := &Server{Cache: cache}
+	handler := func(_ context.Context, w io.Writer, r *http.Request) error {
+		fc := geojson.NewFeatureCollection()
+		if !strings.HasPrefix(r.URL.Path, "/_all/0/") {
+			fc.Append(geojson.NewFeature(orb.Point{0, 0}))
+		}
+		setEmptyHeader(w, []*geojson.FeatureCollection{fc})
+		_, err := w.Write([]byte("tile"))
+		return err
+	}
+	cachedHandler := server.cached(handler)
+
+	w := httptest.NewRecorder()
+	cachedHandler.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(emptyTileHeader), "The empty tile header is internal")
+	assert.Contains(t, cache.empty, "/_all/0/0/0.mvt")
+	assert.False(t, cache.Exists("/_all/0/0/0.mvt"))
+
+	cachedHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/_all/1/0/0.mvt", nil))
+	assert.NotContains(t, cache.empty, "/_all/1/0/0.mvt")
+	assert.True(t, cache.Exists("/_all/1/0/0.mvt"))
+}
+
+// expiredCache is a fake StaleCache whose values have all expired
+type expiredCache struct {
+	NilCache
+	stale map[string][]byte
+}
+
+func (e *expiredCache) GetStale(key string) ([]byte, error) {
+	v, exists := e.stale[key]
+	if !exists {
+		return nil, ErrNoValue
+	}
+	return v, nil
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	cache := &expiredCache{stale: map[string][]byte{"/_all/0/0/0.mvt": []byte("stale")}}
+	server := &Server{Cache: cache, ServeStaleOnError: true}
+	handler := func(context.Context, io.Writer, *http.Request) error {
+		return errors.New("Source unavailable")
+	}
+	cachedHandler := server.cached(handler)
+
+	w := httptest.NewRecorder()
+	cachedHandler.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	res := w.Result()
+	if res.StatusCode != http.StatusOK || w.Body.String() != "stale" {
+		t.Errorf("Expected the stale tile to be served: %d %s", res.StatusCode, w.Body.String())
+	}
+	if res.Header.Get("Warning") != StaleWarning {
+		t.Errorf("Invalid Warning header for stale tile: %s", res.Header.Get("Warning"))
+	}
+	if res.Header.Get("Cache-Control") != NoCache {
+		t.Errorf("Invalid Cache-Control for stale tile: %s", res.Header.Get("Cache-Control"))
+	}
+
+	// Tiles without a stale copy still fail
+	w = httptest.NewRecorder()
+	cachedHandler.ServeHTTP(w, httptest.NewRequest("GET", "/_all/1/0/0.mvt", nil))
+	if w.Result().StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected an error without a stale tile: %d", w.Result().StatusCode)
+	}
+
+	// Stale tiles are only served when enabled
+	server.ServeStaleOnError = false
+	w = httptest.NewRecorder()
+	cachedHandler.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	if w.Result().StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected an error with serving stale tiles disabled: %d", w.Result().StatusCode)
+	}
+}
+
+func TestCachedContentTypes(t *testing.T) {
+	server := &Server{
+		Cache:       NewInMemoryCache(),
+		EnableJSONP: true,
+		Layers: []Layer{
+			Layer{Name: "points", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})},
+		},
+	}
+	api, _ := server.setupRoutes()
+	contentTypes := map[string]string{
+		"/points/0/0/0.mvt":                             MVTContentType,
+		"/points/0/0/0.pbf":                             MVTContentType,
+		"/points/0/0/0.png":                             PNGContentType,
+		"/points/0/0/0.topojson":                        TopoJSONContentType,
+		"/points/0/0/0.topojson?callback=render":        JSONPContentType,
+		"/points/0/0/0/properties.json":                 SidecarContentType,
+		"/points/0/0/0/properties.json?callback=render": JSONPContentType,
+	}
+	for path, contentType := range contentTypes {
+		// The second request is served from the cache
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			assert.Equal(t, 200, w.Code)
+			assert.Equal(t, contentType, w.Header().Get("Content-Type"), "Invalid content type for %s (request %d)", path, i)
+		}
+	}
+
+	// Stale tiles also keep their content type
+	cache := &expiredCache{stale: map[string][]byte{"/_all/0/0/0.topojson": []byte("stale")}}
+	server = &Server{Cache: cache, ServeStaleOnError: true}
+	r := chi.NewRouter()
+	r.Get("/{layers}/{z}/{x}/{y}.topojson", server.cached(func(context.Context, io.Writer, *http.Request) error {
+		return errors.New("Source unavailable")
+	}))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.topojson", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, TopoJSONContentType, w.Header().Get("Content-Type"))
+}
+
+func TestNeighborTiles(t *testing.T) {
+	assert.Empty(t, neighborTiles(0, 0, 0))
+	assert.ElementsMatch(t, [][2]int{{1, 0}, {0, 1}, {1, 1}}, neighborTiles(0, 0, 1))
+	assert.ElementsMatch(t, [][2]int{
+		{7, 3}, {0, 3}, {1, 3},
+		{7, 4}, {1, 4},
+		{7, 5}, {0, 5}, {1, 5},
+	}, neighborTiles(0, 4, 3), "Neighbors should wrap around the antimeridian")
+	assert.Len(t, neighborTiles(3, 0, 3), 5, "Neighbors should not wrap around the poles")
+}
+
+func TestPrefetchNeighbors(t *testing.T) {
+	cache := NewInMemoryCache()
+	server := &Server{Cache: cache, PrefetchNeighbors: true}
+	handler := func(_ context.Context, w io.Writer, r *http.Request) error {
+		_, err := w.Write([]byte(chi.URLParam(r, "x") + "/" + chi.URLParam(r, "y")))
+		return err
+	}
+	r := chi.NewRouter()
+	r.Get("/{layers}/{z}/{x}/{y}.mvt", server.cached(handler))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/_all/1/0/0.mvt?q=test", nil))
+	assert.Equal(t, "0/0", w.Body.String())
+
+	expected := map[string]string{
+		"/_all/1/1/0.mvt?q=test": "1/0",
+		"/_all/1/0/1.mvt?q=test": "0/1",
+		"/_all/1/1/1.mvt?q=test": "1/1",
+	}
+	deadline := time.Now().Add(time.Second)
+	for key, value := range expected {
+		for !cache.Exists(key) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cached, err := cache.Get(key)
+		assert.Nil(t, err, "Neighbor tile [%s] was not prefetched", key)
+		assert.Equal(t, value, string(cached))
+	}
+}
+
+func TestPrefetchNeighborsNegativeCache(t *testing.T) {
+	cache := &emptyCache{InMemoryCache: NewInMemoryCache().(*InMemoryCache), empty: make(map[string][]byte)}
+	server := &Server{Cache: cache, PrefetchNeighbors: true}
+	handler := func(_ context.Context, w io.Writer, r *http.Request) error {
+		fc := geojson.NewFeatureCollection()
+		if chi.URLParam(r, "x") == "0" {
+			fc.Append(geojson.NewFeature(orb.Point{0, 0}))
+		}
+		setEmptyHeader(w, []*geojson.FeatureCollection{fc})
+		_, err := w.Write([]byte("tile"))
+		return err
+	}
+	r := chi.NewRouter()
+	r.Get("/{layers}/{z}/{x}/{y}.mvt", server.cached(handler))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/_all/1/0/0.mvt", nil))
+
+	// Prefetched empty tiles are stored with the negative cache expiry, like requested ones
+	deadline := time.Now().Add(time.Second)
+	for _, key := range []string{"/_all/1/1/0.mvt", "/_all/1/1/1.mvt"} {
+		for !cache.isEmpty(key) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.True(t, cache.isEmpty(key), "Empty neighbor tile [%s] was not negatively cached", key)
+		assert.False(t, cache.Exists(key))
+	}
+	for !cache.Exists("/_all/1/0/1.mvt") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, cache.Exists("/_all/1/0/1.mvt"))
+	assert.False(t, cache.isEmpty("/_all/1/0/1.mvt"))
+}
+
 func TestAPI(t *testing.T) {
 	server := &Server{Cache: &NilCache{}}
 	api, internal := server.setupRoutes()
@@ -121,6 +460,30 @@ func TestAPI(t *testing.T) {
 	if res.StatusCode != 200 {
 		t.Error("Non-200 tile response")
 	}
+	if res.Header.Get("X-Request-Id") == "" {
+		t.Error("Request ID not generated")
+	}
+
+	// Test TopoJSON tile endpoint
+	r = httptest.NewRequest("GET", "/_all/0/0/0.topojson", nil)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	res = w.Result()
+	if res.StatusCode != 200 {
+		t.Error("Non-200 TopoJSON tile response")
+	}
+	if res.Header.Get("Content-Type") != TopoJSONContentType {
+		t.Errorf("Invalid TopoJSON content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	// Test request ID propagation
+	r = httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil)
+	r.Header.Set("X-Request-Id", "my-request")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if actual := w.Result().Header.Get("X-Request-Id"); actual != "my-request" {
+		t.Errorf("Invalid request ID: %s", actual)
+	}
 
 	// Test healthcheck
 	body = ioutil.NopCloser(bytes.NewReader([]byte{}))
@@ -131,4 +494,291 @@ func TestAPI(t *testing.T) {
 	if res.StatusCode != 200 {
 		t.Error("Non-200 healthcheck response")
 	}
+
+	// Test metrics
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	internal.ServeHTTP(w, r)
+	res = w.Result()
+	if res.StatusCode != 200 {
+		t.Error("Non-200 metrics response")
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	short := 30 * time.Second
+	noCache := time.Duration(0)
+	server := &Server{
+		Cache: &NilCache{},
+		Layers: []Layer{
+			Layer{Name: "static"},
+			Layer{Name: "live", CacheMaxAge: &short},
+			Layer{Name: "realtime", CacheMaxAge: &noCache},
+		},
+	}
+	handler := func(context.Context, io.Writer, *http.Request) error {
+		return nil
+	}
+	r := chi.NewRouter()
+	r.Get("/{layers}/{z}/{x}/{y}.mvt", server.cached(handler))
+	expectations := map[string]string{
+		"/static/0/0/0.mvt":      "max-age=86400",
+		"/live/0/0/0.mvt":        "max-age=30",
+		"/static,live/0/0/0.mvt": "max-age=30",
+		"/realtime/0/0/0.mvt":    "no-cache",
+		"/_all/0/0/0.mvt":        "no-cache",
+	}
+	for path, expected := range expectations {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if actual := w.Result().Header.Get("Cache-Control"); actual != expected {
+			t.Errorf("Invalid Cache-Control for %s: %s (expected = %s)", path, actual, expected)
+		}
+	}
+}
+
+// modifiedSource is a fake LastModifiedSource with a fixed modification time
+type modifiedSource struct {
+	staticSource
+	modified time.Time
+}
+
+func (m *modifiedSource) LastModified(context.Context, *TileRequest) (time.Time, error) {
+	return m.modified, nil
+}
+
+func TestLastModified(t *testing.T) {
+	modified := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	server := &Server{
+		Cache: &NilCache{},
+		Layers: []Layer{
+			Layer{Name: "modified", Maxzoom: MaxZoom, Source: &modifiedSource{modified: modified}},
+			Layer{Name: "static", Maxzoom: MaxZoom, Source: newStaticSource()},
+		},
+	}
+	var requests int
+	handler := func(context.Context, io.Writer, *http.Request) error {
+		requests++
+		return nil
+	}
+	r := chi.NewRouter()
+	r.Get("/{layers}/{z}/{x}/{y}.mvt", server.cached(handler))
+
+	expectations := []struct {
+		path            string
+		ifModifiedSince time.Time
+		status          int
+		lastModified    string
+	}{
+		{"/modified/0/0/0.mvt", time.Time{}, http.StatusOK, modified.Format(http.TimeFormat)},
+		{"/modified/0/0/0.mvt", modified, http.StatusNotModified, modified.Format(http.TimeFormat)},
+		{"/modified/0/0/0.mvt", modified.Add(-time.Hour), http.StatusOK, modified.Format(http.TimeFormat)},
+		{"/modified,static/0/0/0.mvt", modified, http.StatusOK, ""},
+	}
+	for _, e := range expectations {
+		req := httptest.NewRequest("GET", e.path, nil)
+		if !e.ifModifiedSince.IsZero() {
+			req.Header.Set("If-Modified-Since", e.ifModifiedSince.Format(http.TimeFormat))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != e.status {
+			t.Errorf("Invalid status code for %s: %d (expected = %d)", e.path, res.StatusCode, e.status)
+		}
+		if actual := res.Header.Get("Last-Modified"); actual != e.lastModified {
+			t.Errorf("Invalid Last-Modified for %s: %s (expected = %s)", e.path, actual, e.lastModified)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("Not modified tiles should not be rendered (rendered = %d)", requests)
+	}
+}
+
+func TestTilesetRequest(t *testing.T) {
+	server := &Server{
+		Cache: &NilCache{},
+		Layers: []Layer{
+			Layer{Name: "roads", Maxzoom: MaxZoom, Source: newStaticSource(orb.LineString{{0, 0}, {1, 1}})},
+			Layer{Name: "buildings", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})},
+			Layer{Name: "pois", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{2, 2})},
+		},
+		Tilesets: []Tileset{Tileset{Name: "combined", Layers: []string{"pois", "roads"}}},
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/combined/0/0/0.mvt", nil))
+	res := w.Result()
+	if res.StatusCode != 200 {
+		t.Fatalf("Non-200 tile response: %d", res.StatusCode)
+	}
+	layers, err := mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	if len(layers) != 2 || layers[0].Name != "pois" || layers[1].Name != "roads" {
+		t.Errorf("Tileset should return its layers in order: %+v", layers)
+	}
+
+	// Clients can compose tiles out of a subset of the requested layers
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt?"+LayersArg+"=roads,buildings", nil))
+	layers, err = mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	if len(layers) != 2 || layers[0].Name != "roads" || layers[1].Name != "buildings" {
+		t.Errorf("Expected only the layers of the %s parameter: %+v", LayersArg, layers)
+	}
+
+	// Only the layers of the tileset can be selected
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/combined/0/0/0.mvt?"+LayersArg+"=pois,buildings", nil))
+	if res := w.Result(); res.StatusCode != 400 {
+		t.Errorf("Expected a 400 response for a layer outside of the tileset: %d", res.StatusCode)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "[buildings]") {
+		t.Errorf("Expected the offending layer name in the error: %s", body)
+	}
+}
+
+func TestDefaultLayerRequest(t *testing.T) {
+	server := &Server{
+		Cache: &NilCache{},
+		Layers: []Layer{
+			Layer{Name: "roads", Maxzoom: MaxZoom, Source: newStaticSource(orb.LineString{{0, 0}, {1, 1}})},
+			Layer{Name: "pois", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{2, 2})},
+		},
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/0/0/0.mvt", nil))
+	if res := w.Result(); res.StatusCode != 404 {
+		t.Fatalf("Expected a 404 response without a default layer: %d", res.StatusCode)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "roads, pois") {
+		t.Errorf("Expected the available layers to be listed: %s", body)
+	}
+
+	server.DefaultLayer = "pois"
+	api, _ = server.setupRoutes()
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/0/0/0.mvt", nil))
+	if res := w.Result(); res.StatusCode != 200 {
+		t.Fatalf("Non-200 tile response: %d", res.StatusCode)
+	}
+	layers, err := mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	if len(layers) != 1 || layers[0].Name != "pois" {
+		t.Errorf("Expected the default layer: %+v", layers)
+	}
+
+	// A single layer is the default
+	server.DefaultLayer = ""
+	server.Layers = server.Layers[:1]
+	api, _ = server.setupRoutes()
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/0/0/0.mvt", nil))
+	layers, err = mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	if len(layers) != 1 || layers[0].Name != "roads" {
+		t.Errorf("Expected the single layer: %+v", layers)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	server := &Server{
+		Cache:  &NilCache{},
+		Layers: []Layer{Layer{Name: "points", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})}},
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/0/0/0.mvt", nil))
+	if timing := w.Result().Header.Get("Server-Timing"); timing != "" {
+		t.Errorf("Server-Timing should not be set by default: %s", timing)
+	}
+
+	server.ServerTiming = true
+	for _, path := range []string{"/points/0/0/0.mvt", "/points/0/0/0.topojson", "/points/0/0/0/properties.json"} {
+		w = httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		timing := w.Result().Header.Get("Server-Timing")
+		if !strings.HasPrefix(timing, "fetch;dur=") || !strings.Contains(timing, ", encode;dur=") {
+			t.Errorf("Invalid Server-Timing for %s: %s", path, timing)
+		}
+	}
+}
+
+func TestOptionalLayer(t *testing.T) {
+	overlay := Layer{Name: "overlay", Maxzoom: MaxZoom, Source: &flakySource{err: errors.New("Source unavailable")}}
+	server := &Server{
+		Cache:  NewInMemoryCache(),
+		Layers: []Layer{Layer{Name: "points", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})}, overlay},
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	if res := w.Result(); res.StatusCode == 200 {
+		t.Fatal("Expected an error response for a failing critical layer")
+	}
+
+	server.Layers[1].Optional = true
+	api, _ = server.setupRoutes()
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/_all/0/0/0.mvt", nil))
+	res := w.Result()
+	if res.StatusCode != 200 {
+		t.Fatalf("Non-200 tile response for a failing optional layer: %d", res.StatusCode)
+	}
+	if res.Header.Get(PartialTileHeader) != "true" {
+		t.Error("Tiles without an optional layer should be flagged as partial")
+	}
+	layers, err := mvt.UnmarshalGzipped(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode tile: %v", err)
+	}
+	for _, layer := range layers {
+		if layer.Name == "points" && len(layer.Features) != 1 {
+			t.Errorf("Expected the critical layer to be rendered: %+v", layer)
+		}
+		if layer.Name == "overlay" && len(layer.Features) != 0 {
+			t.Errorf("Expected the optional layer to be empty: %+v", layer)
+		}
+	}
+
+	// Invalid and canceled requests still fail
+	if server.Layers[1].skipFailure(context.Background(), InvalidRequestError{"Invalid geometry"}) {
+		t.Error("Invalid requests should not be skipped")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if server.Layers[1].skipFailure(ctx, ctx.Err()) {
+		t.Error("Canceled requests should not be skipped")
+	}
+}
+
+func TestTileBoundsHeader(t *testing.T) {
+	server := &Server{
+		Cache:  &NilCache{},
+		Layers: []Layer{Layer{Name: "points", Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1})}},
+	}
+	api, _ := server.setupRoutes()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/1/1/0.mvt", nil))
+	if bounds := w.Result().Header.Get(TileBoundsHeader); bounds != "" {
+		t.Errorf("%s should not be set by default: %s", TileBoundsHeader, bounds)
+	}
+
+	server.TileBounds = true
+	api, _ = server.setupRoutes()
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/1/1/0.mvt", nil))
+	bounds := strings.Split(w.Result().Header.Get(TileBoundsHeader), ",")
+	if len(bounds) != 4 || bounds[0] != "0" || bounds[1] != "0" || bounds[2] != "180" || !strings.HasPrefix(bounds[3], "85.0511") {
+		t.Errorf("Invalid %s header: %v", TileBoundsHeader, bounds)
+	}
 }
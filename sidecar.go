@@ -0,0 +1,97 @@
+package tilenol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// PropertiesArg is the request parameter for choosing how feature properties are returned
+	PropertiesArg = "properties"
+	// SidecarProperties is the PropertiesArg value for geometry-only vector tiles, whose feature
+	// properties are served separately by the properties.json endpoint
+	SidecarProperties = "sidecar"
+	// SidecarContentType is the content type of sidecar feature properties
+	SidecarContentType = "application/json"
+	// SidecarFormat is the format of sidecar feature properties requests, see ParseTilePath
+	SidecarFormat = "properties"
+)
+
+// sidecarProperties returns whether or not the feature properties are requested separately
+func (t *TileRequest) sidecarProperties() bool {
+	values := t.Args[PropertiesArg]
+	return len(values) > 0 && values[0] == SidecarProperties
+}
+
+// stripProperties removes the properties of the features for a geometry-only vector tile
+func stripProperties(layers []Layer, fcs []*geojson.FeatureCollection) error {
+	for i, layer := range layers {
+		if layer.FeatureIDs == OmitFeatureIDs {
+			return InvalidRequestError{fmt.Sprintf("Layer [%s] omits feature IDs, which sidecar properties require", layer.Name)}
+		}
+		// Keep the property holding the MVT feature ID, if any, so that it can still be encoded
+		property := idProperty(layer.FeatureIDs)
+		for _, feature := range fcs[i].Features {
+			properties := geojson.Properties{}
+			if v, exists := feature.Properties[property]; exists && property != "" {
+				properties[property] = v
+			}
+			feature.Properties = properties
+		}
+	}
+	return nil
+}
+
+// featureProperties maps the MVT feature IDs of the layer's features to their properties.
+// Features without an MVT feature ID are skipped.
+func (l *Layer) featureProperties(fc *geojson.FeatureCollection) (map[string]geojson.Properties, error) {
+	if l.FeatureIDs == OmitFeatureIDs {
+		return nil, InvalidRequestError{fmt.Sprintf("Layer [%s] omits feature IDs, which sidecar properties require", l.Name)}
+	}
+	properties := make(map[string]geojson.Properties, len(fc.Features))
+	for i, feature := range fc.Features {
+		id := featureID(feature, i, l.FeatureIDs)
+		if id == nil {
+			continue
+		}
+		properties[fmt.Sprint(id)] = feature.Properties
+	}
+	return properties, nil
+}
+
+// getTileProperties computes the gzipped sidecar properties response of a single layer for the
+// incoming request, keyed by the feature IDs of the matching geometry-only vector tile
+func (s *Server) getTileProperties(rctx context.Context, w io.Writer, r *http.Request) error {
+	start := time.Now()
+	req, layers, fcs, err := s.getTileFeatures(rctx, r)
+	if err != nil {
+		return err
+	}
+	fetched := time.Now()
+	if len(layers) > 1 {
+		return InvalidRequestError{"Sidecar properties can only be requested for a single layer"}
+	}
+	properties := make(map[string]geojson.Properties)
+	if len(layers) == 1 {
+		properties, err = layers[0].featureProperties(fcs[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	data, contentType, err := s.encodeJSON(r, properties, SidecarContentType)
+	if err != nil {
+		return err
+	}
+	s.setServerTiming(w, fetched.Sub(start), time.Since(fetched))
+	setHeader(w, "Content-Type", contentType)
+	setPartialHeaders(w, req)
+	setEmptyHeader(w, fcs)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,59 @@
+package tilenol
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt/vectortile"
+	"github.com/paulmach/orb/geojson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSidecarProperties(t *testing.T) {
+	server := &Server{
+		Cache: &NilCache{},
+		Layers: []Layer{
+			Layer{Name: "points", Minzoom: MinZoom, Maxzoom: MaxZoom, Source: newStaticSource(orb.Point{1, 1}, orb.Point{-1, -1})},
+		},
+	}
+	api, _ := server.setupRoutes()
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/0/0/0.mvt?properties=sidecar", nil))
+	assert.Equal(t, 200, w.Code)
+	// Decode the raw tile, since mvt.Unmarshal skips features without properties
+	gr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	tile := &vectortile.Tile{}
+	assert.Nil(t, tile.Unmarshal(data), "Failed to decode MVT tile")
+	assert.Len(t, tile.Layers[0].Features, 2)
+	for _, feature := range tile.Layers[0].Features {
+		assert.NotNil(t, feature.Id)
+		assert.Empty(t, feature.Tags)
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/points/0/0/0/properties.json", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, SidecarContentType, w.Header().Get("Content-Type"))
+	gr, err = gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	var properties map[string]geojson.Properties
+	assert.Nil(t, json.NewDecoder(gr).Decode(&properties))
+	assert.Equal(t, map[string]geojson.Properties{
+		"0": geojson.Properties{"id": "0"},
+		"1": geojson.Properties{"id": "1"},
+	}, properties)
+}
+
+func TestSidecarPropertiesOmittedIDs(t *testing.T) {
+	layer := Layer{Name: "points", FeatureIDs: OmitFeatureIDs}
+	_, err := layer.featureProperties(geojson.NewFeatureCollection())
+	assert.IsType(t, InvalidRequestError{}, err)
+}
@@ -0,0 +1,141 @@
+package tilenol
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/planar"
+)
+
+// snapFeatures snaps the projected geometries of the MVT layer to its integer extent grid,
+// dropping the features whose geometries become degenerate (i.e. zero-length lines and
+// zero-area polygons), which would otherwise only add size and rendering artifacts to the tile
+func snapFeatures(layer *mvt.Layer) {
+	features := layer.Features[:0]
+	for _, feature := range layer.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		if feature.Geometry = snapGeometry(feature.Geometry); feature.Geometry != nil {
+			features = append(features, feature)
+		}
+	}
+	layer.Features = features
+}
+
+// snapPoint rounds the point to the nearest grid position
+func snapPoint(p orb.Point) orb.Point {
+	return orb.Point{math.Round(p[0]), math.Round(p[1])}
+}
+
+// snapPoints rounds the points to the grid, collapsing consecutive duplicates
+func snapPoints(points []orb.Point) []orb.Point {
+	var snapped []orb.Point
+	for _, p := range points {
+		p = snapPoint(p)
+		if len(snapped) == 0 || snapped[len(snapped)-1] != p {
+			snapped = append(snapped, p)
+		}
+	}
+	return snapped
+}
+
+// snapRing snaps a ring to the grid, returning nil if it has no area left
+func snapRing(ring orb.Ring) orb.Ring {
+	snapped := orb.Ring(snapPoints(ring))
+	if len(snapped) > 0 && snapped[0] != snapped[len(snapped)-1] {
+		snapped = append(snapped, snapped[0])
+	}
+	if len(snapped) < 4 || planar.Area(snapped) == 0 {
+		return nil
+	}
+	return snapped
+}
+
+// snapPolygon snaps a polygon to the grid, returning nil if its exterior ring has no area left.
+// Degenerate interior rings are dropped.
+func snapPolygon(polygon orb.Polygon) orb.Polygon {
+	var snapped orb.Polygon
+	for i, ring := range polygon {
+		ring = snapRing(ring)
+		if ring == nil {
+			if i == 0 {
+				return nil
+			}
+			continue
+		}
+		snapped = append(snapped, ring)
+	}
+	return snapped
+}
+
+// snapGeometry snaps a geometry to the grid, returning nil if it becomes degenerate. The
+// degenerate parts of multi-geometries and collections are dropped.
+func snapGeometry(g orb.Geometry) orb.Geometry {
+	switch g := g.(type) {
+	case orb.Point:
+		return snapPoint(g)
+	case orb.MultiPoint:
+		if len(g) == 0 {
+			return nil
+		}
+		snapped := make(orb.MultiPoint, len(g))
+		for i, p := range g {
+			snapped[i] = snapPoint(p)
+		}
+		return snapped
+	case orb.LineString:
+		snapped := orb.LineString(snapPoints(g))
+		if len(snapped) < 2 {
+			return nil
+		}
+		return snapped
+	case orb.MultiLineString:
+		var snapped orb.MultiLineString
+		for _, ls := range g {
+			if line, ok := snapGeometry(ls).(orb.LineString); ok {
+				snapped = append(snapped, line)
+			}
+		}
+		if len(snapped) == 0 {
+			return nil
+		}
+		return snapped
+	case orb.Ring:
+		if polygon := snapPolygon(orb.Polygon{g}); polygon != nil {
+			return polygon[0]
+		}
+		return nil
+	case orb.Bound:
+		return snapGeometry(g.ToPolygon())
+	case orb.Polygon:
+		if polygon := snapPolygon(g); polygon != nil {
+			return polygon
+		}
+		return nil
+	case orb.MultiPolygon:
+		var snapped orb.MultiPolygon
+		for _, polygon := range g {
+			if polygon = snapPolygon(polygon); polygon != nil {
+				snapped = append(snapped, polygon)
+			}
+		}
+		if len(snapped) == 0 {
+			return nil
+		}
+		return snapped
+	case orb.Collection:
+		var snapped orb.Collection
+		for _, child := range g {
+			if child = snapGeometry(child); child != nil {
+				snapped = append(snapped, child)
+			}
+		}
+		if len(snapped) == 0 {
+			return nil
+		}
+		return snapped
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapGeometry(t *testing.T) {
+	assert.Equal(t, orb.Point{1, 2}, snapGeometry(orb.Point{1.2, 1.6}))
+	assert.Equal(t, orb.LineString{{0, 0}, {2, 2}}, snapGeometry(orb.LineString{{0, 0}, {0.2, 0.1}, {2, 2}}))
+	assert.Nil(t, snapGeometry(orb.LineString{{0, 0}, {0.2, 0.1}}), "Expected a zero-length line to be dropped")
+	assert.Nil(t, snapGeometry(orb.Polygon{{{0, 0}, {0.3, 0}, {0.3, 0.3}, {0, 0}}}), "Expected a zero-area polygon to be dropped")
+	assert.Nil(t, snapGeometry(orb.Polygon{{{0, 0}, {5, 0}, {10, 0.1}, {0, 0}}}), "Expected a collinear polygon to be dropped")
+
+	// Degenerate holes and parts are dropped, keeping the rest of the geometry
+	polygon := orb.Polygon{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{5, 5}, {5.2, 5}, {5.2, 5.2}, {5, 5}},
+	}
+	assert.Equal(t, orb.Polygon{polygon[0]}, snapGeometry(polygon))
+	multiLine := orb.MultiLineString{{{0, 0}, {0.1, 0}}, {{0, 0}, {3, 3}}}
+	assert.Equal(t, orb.MultiLineString{{{0, 0}, {3, 3}}}, snapGeometry(multiLine))
+	assert.Nil(t, snapGeometry(orb.MultiPolygon{{{{0, 0}, {0.1, 0}, {0.1, 0.1}, {0, 0}}}}))
+}
+
+func TestEncodeMVTLayerExtent(t *testing.T) {
+	tile := maptile.New(0, 0, 1)
+	bound := tile.Bound()
+	// A tiny polygon that collapses at a coarse extent, but not at the default extent
+	size := (bound.Max[0] - bound.Min[0]) / 1024
+	origin := orb.Point{-90, 0} // The middle of the tile's bottom edge
+	square := orb.Polygon{{
+		origin, {origin[0] + size, origin[1]}, {origin[0] + size, origin[1] + size}, {origin[0], origin[1] + size}, origin,
+	}}
+	fc := geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(square))
+	fc.Append(geojson.NewFeature(origin))
+	req := &TileRequest{X: int(tile.X), Y: int(tile.Y), Z: int(tile.Z)}
+
+	layer := &Layer{Name: "test"}
+	encoded := layer.encodeMVTLayer(req, fc)
+	assert.Equal(t, uint32(mvt.DefaultExtent), encoded.Extent)
+	assert.Len(t, encoded.Features, 2)
+
+	layer.Extent = 256
+	fc = geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(square))
+	fc.Append(geojson.NewFeature(origin))
+	encoded = layer.encodeMVTLayer(req, fc)
+	assert.Equal(t, uint32(256), encoded.Extent)
+	if assert.Len(t, encoded.Features, 1, "Expected the collapsed polygon to be dropped") {
+		assert.Equal(t, orb.Point{128, 256}, encoded.Features[0].Geometry)
+	}
+}
@@ -0,0 +1,80 @@
+package tilenol
+
+import (
+	"fmt"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceFactory creates a Source from the YAML configuration block of a registered source type
+type SourceFactory func(config *yaml.Node) (Source, error)
+
+var (
+	sourceRegistryMu sync.RWMutex
+	sourceRegistry   = make(map[string]SourceFactory)
+)
+
+// builtinSources are the YAML keys of the source types that SourceConfig supports natively
+var builtinSources = map[string]bool{
+	"elasticsearch": true,
+	"postgis":       true,
+	"http":          true,
+}
+
+// RegisterSource registers a third-party Source type, so that layers can configure it with a
+// source block under the given name, e.g.:
+//
+//	source:
+//	  mystore:
+//	    endpoint: https://mystore.example.com
+//
+// The factory is called with the YAML node of the block when the layer is created. Like
+// database/sql.Register, this is meant to be called from an init function, and it panics if
+// the name is already taken by a built-in or registered source type.
+func RegisterSource(name string, factory SourceFactory) {
+	sourceRegistryMu.Lock()
+	defer sourceRegistryMu.Unlock()
+	if factory == nil {
+		panic("tilenol: RegisterSource factory is nil")
+	}
+	if _, exists := sourceRegistry[name]; exists || builtinSources[name] {
+		panic("tilenol: RegisterSource called twice for source " + name)
+	}
+	sourceRegistry[name] = factory
+}
+
+// registeredSource looks up the factory of a registered source type
+func registeredSource(name string) (SourceFactory, error) {
+	sourceRegistryMu.RLock()
+	defer sourceRegistryMu.RUnlock()
+	factory, exists := sourceRegistry[name]
+	if !exists {
+		return nil, fmt.Errorf("Unknown source type: %s", name)
+	}
+	return factory, nil
+}
+
+// UnmarshalYAML decodes the built-in source blocks, and keeps any other named block in Custom
+// to be resolved through the source registry
+func (c *SourceConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain SourceConfig
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Custom = nil
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name := node.Content[i].Value
+		if builtinSources[name] {
+			continue
+		}
+		if c.Custom == nil {
+			c.Custom = make(map[string]*yaml.Node)
+		}
+		c.Custom[name] = node.Content[i+1]
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	RegisterSource("static", func(config *yaml.Node) (Source, error) {
+		var points []orb.Point
+		if err := config.Decode(&points); err != nil {
+			return nil, err
+		}
+		var geoms []orb.Geometry
+		for _, p := range points {
+			geoms = append(geoms, p)
+		}
+		return newStaticSource(geoms...), nil
+	})
+}
+
+func TestRegisteredSource(t *testing.T) {
+	var config LayerConfig
+	err := yaml.Unmarshal([]byte(`
+name: points
+source:
+  static:
+    - [1, 1]
+    - [2, 2]
+`), &config)
+	assert.Nil(t, err)
+	assert.Equal(t, "static", config.Source.Type())
+	assert.Nil(t, config.Validate())
+
+	layer, err := CreateLayer(config)
+	assert.Nil(t, err, "Failed to create layer: %v", err)
+	assert.Len(t, layer.Source.(*staticSource).features, 2)
+}
+
+func TestUnknownSource(t *testing.T) {
+	var config LayerConfig
+	err := yaml.Unmarshal([]byte(`
+name: points
+source:
+  unknown: {}
+`), &config)
+	assert.Nil(t, err)
+	assert.NotNil(t, config.Validate(), "Expected to fail due to an unknown source type")
+
+	config = LayerConfig{}
+	err = yaml.Unmarshal([]byte(`
+name: points
+source:
+  static: []
+  http:
+    urlTemplate: http://localhost/{z}/{x}/{y}
+`), &config)
+	assert.Nil(t, err)
+	assert.Equal(t, MultipleSourcesErr, config.Validate())
+}
+
+func TestRegisterSourceTwice(t *testing.T) {
+	assert.Panics(t, func() { RegisterSource("static", func(*yaml.Node) (Source, error) { return nil, nil }) })
+	assert.Panics(t, func() { RegisterSource("postgis", func(*yaml.Node) (Source, error) { return nil, nil }) })
+}
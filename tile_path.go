@@ -0,0 +1,59 @@
+package tilenol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// sidecarPathSuffix is the final path segment of sidecar properties requests
+const sidecarPathSuffix = "properties.json"
+
+// ParseTilePath parses the tile coordinates and the format of a tile request path, e.g.
+// "/buildings/14/2620/6331.mvt", where the layers segment is optional (e.g. "/14/2620/6331.mvt")
+// and sidecar properties paths (e.g. "/buildings/14/2620/6331/properties.json") have the
+// SidecarFormat. The format is one of MVTFormat, GeoJSONFormat, TopoJSONFormat or
+// SidecarFormat. Invalid paths yield an InvalidRequestError.
+func ParseTilePath(path string) (maptile.Tile, string, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var format string
+	if n := len(segments); n > 0 && segments[n-1] == sidecarPathSuffix {
+		segments, format = segments[:n-1], SidecarFormat
+	} else if n > 0 {
+		ext := strings.LastIndex(segments[n-1], ".")
+		if ext < 0 {
+			return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Missing tile format extension in path: %s", path)}
+		}
+		segments[n-1], format = segments[n-1][:ext], segments[n-1][ext+1:]
+		switch format {
+		case MVTFormat, GeoJSONFormat, TopoJSONFormat:
+		default:
+			return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Unsupported tile format [%s] in path: %s", format, path)}
+		}
+	}
+	if len(segments) == 4 {
+		// Skip the layers segment
+		segments = segments[1:]
+	}
+	if len(segments) != 3 {
+		return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Expected a [layers/]z/x/y tile path: %s", path)}
+	}
+	var zxy [3]int
+	for i, segment := range segments {
+		n, err := strconv.Atoi(segment)
+		if err != nil {
+			return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Invalid tile coordinate [%s] in path: %s", segment, path)}
+		}
+		zxy[i] = n
+	}
+	z, x, y := zxy[0], zxy[1], zxy[2]
+	if z < MinZoom || z > MaxZoom {
+		return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Invalid zoom level: [%d].", z)}
+	}
+	if maxTileIdx := 1<<uint32(z) - 1; x < 0 || x > maxTileIdx || y < 0 || y > maxTileIdx {
+		return maptile.Tile{}, "", InvalidRequestError{fmt.Sprintf("Invalid tile coordinates [%d, %d] for zoom level [%d].", x, y, z)}
+	}
+	return maptile.New(uint32(x), uint32(y), maptile.Zoom(z)), format, nil
+}
@@ -0,0 +1,42 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTilePath(t *testing.T) {
+	for _, e := range []struct {
+		path   string
+		tile   maptile.Tile
+		format string
+	}{
+		{"/buildings/14/2620/6331.mvt", maptile.New(2620, 6331, 14), MVTFormat},
+		{"buildings,roads/0/0/0.topojson", maptile.New(0, 0, 0), TopoJSONFormat},
+		{"/14/2620/6331.geojson", maptile.New(2620, 6331, 14), GeoJSONFormat},
+		{"//buildings/1/1/0/properties.json", maptile.New(1, 0, 1), SidecarFormat},
+		{"/1/0/1/properties.json", maptile.New(0, 1, 1), SidecarFormat},
+	} {
+		tile, format, err := ParseTilePath(e.path)
+		if assert.NoError(t, err, e.path) {
+			assert.Equal(t, e.tile, tile, e.path)
+			assert.Equal(t, e.format, format, e.path)
+		}
+	}
+
+	for _, path := range []string{
+		"",
+		"/buildings/14/2620/6331",
+		"/buildings/14/2620/6331.png",
+		"/a/b/14/2620/6331.mvt",
+		"/buildings/14/x/6331.mvt",
+		"/buildings/30/0/0.mvt",
+		"/buildings/1/2/0.mvt",
+		"/buildings/1/0/-1.mvt",
+	} {
+		_, _, err := ParseTilePath(path)
+		assert.IsType(t, InvalidRequestError{}, err, path)
+	}
+}
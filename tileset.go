@@ -0,0 +1,43 @@
+package tilenol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TilesetConfig is the YAML configuration for a tileset, which groups several layers so that
+// they can be requested together as a single multi-layer tile
+type TilesetConfig struct {
+	// Name is the name of the tileset, used in place of the layer names in tile requests
+	Name string `yaml:"name"`
+	// Layers is the ordered list of layer names included in the tileset
+	Layers []string `yaml:"layers"`
+}
+
+// Tileset is a configured group of layers
+type Tileset struct {
+	Name   string
+	Layers []string
+}
+
+// CreateTileset creates a new Tileset given a TilesetConfig, checking that all of its layers
+// are configured
+func CreateTileset(config TilesetConfig, layers []Layer) (*Tileset, error) {
+	if config.Name == "" || config.Name == AllLayers || strings.Contains(config.Name, ",") {
+		return nil, fmt.Errorf("Invalid tileset name: \"%s\"", config.Name)
+	}
+	if len(config.Layers) == 0 {
+		return nil, fmt.Errorf("Tileset \"%s\" must include at least one layer", config.Name)
+	}
+	for _, layer := range layers {
+		if layer.Name == config.Name {
+			return nil, fmt.Errorf("Tileset \"%s\" has the same name as a layer", config.Name)
+		}
+	}
+	for _, name := range config.Layers {
+		if len(filterLayersByNames(layers, []string{name})) == 0 {
+			return nil, fmt.Errorf("Tileset \"%s\" includes unknown layer \"%s\"", config.Name, name)
+		}
+	}
+	return &Tileset{Name: config.Name, Layers: config.Layers}, nil
+}
@@ -0,0 +1,28 @@
+package tilenol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateTileset(t *testing.T) {
+	layers := []Layer{Layer{Name: "roads"}, Layer{Name: "pois"}}
+
+	tileset, err := CreateTileset(TilesetConfig{Name: "combined", Layers: []string{"roads", "pois"}}, layers)
+	assert.Nil(t, err, "Failed to create tileset: %v", err)
+	assert.Equal(t, []string{"roads", "pois"}, tileset.Layers)
+
+	invalidConfigs := []TilesetConfig{
+		TilesetConfig{Layers: []string{"roads"}},
+		TilesetConfig{Name: AllLayers, Layers: []string{"roads"}},
+		TilesetConfig{Name: "a,b", Layers: []string{"roads"}},
+		TilesetConfig{Name: "combined"},
+		TilesetConfig{Name: "roads", Layers: []string{"pois"}},
+		TilesetConfig{Name: "combined", Layers: []string{"roads", "doesntexist"}},
+	}
+	for _, config := range invalidConfigs {
+		_, err := CreateTileset(config, layers)
+		assert.NotNil(t, err, "Expected invalid tileset config to fail: %+v", config)
+	}
+}
@@ -0,0 +1,358 @@
+package tilenol
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// TopoJSONQuantization is the number of quantized positions across a tile in each dimension
+const TopoJSONQuantization = 4096
+
+// Topology is a TopoJSON topology, see https://github.com/topojson/topojson-specification
+type Topology struct {
+	Type      string                       `json:"type"`
+	BBox      []float64                    `json:"bbox,omitempty"`
+	Transform *TopologyTransform           `json:"transform,omitempty"`
+	Objects   map[string]*TopologyGeometry `json:"objects"`
+	Arcs      [][][2]int                   `json:"arcs"`
+}
+
+// TopologyTransform converts the quantized positions of a Topology back into coordinates
+type TopologyTransform struct {
+	Scale     [2]float64 `json:"scale"`
+	Translate [2]float64 `json:"translate"`
+}
+
+// TopologyGeometry is a TopoJSON geometry object. Points hold their quantized coordinates, while
+// lines and polygons reference the arcs of the Topology, where a negative index ^i means that
+// arc i is reversed.
+type TopologyGeometry struct {
+	Type        string             `json:"type"`
+	ID          interface{}        `json:"id,omitempty"`
+	Properties  geojson.Properties `json:"properties,omitempty"`
+	Coordinates interface{}        `json:"coordinates,omitempty"`
+	Arcs        interface{}        `json:"arcs,omitempty"`
+	Geometries  interface{}        `json:"geometries,omitempty"`
+}
+
+// topoPoint is a quantized position
+type topoPoint [2]int
+
+// topoLine is a quantized line or (open) ring, which is cut into arcs once all of the lines of
+// the Topology are known
+type topoLine struct {
+	points []topoPoint
+	ring   bool
+	arcs   []int
+}
+
+// topologyBuilder incrementally collects the layers of a Topology
+type topologyBuilder struct {
+	topology *Topology
+	lines    []*topoLine
+	// pending assigns the arc indices to the geometries once the lines have been cut
+	pending  []func()
+	arcIndex map[string]int
+}
+
+// newTopologyBuilder creates a topologyBuilder that quantizes coordinates to the bound
+func newTopologyBuilder(bound orb.Bound, quantization int) *topologyBuilder {
+	return &topologyBuilder{
+		topology: &Topology{
+			Type: "Topology",
+			BBox: []float64{bound.Min[0], bound.Min[1], bound.Max[0], bound.Max[1]},
+			Transform: &TopologyTransform{
+				Scale: [2]float64{
+					(bound.Max[0] - bound.Min[0]) / float64(quantization-1),
+					(bound.Max[1] - bound.Min[1]) / float64(quantization-1),
+				},
+				Translate: [2]float64{bound.Min[0], bound.Min[1]},
+			},
+			Objects: make(map[string]*TopologyGeometry),
+			Arcs:    [][][2]int{},
+		},
+		arcIndex: make(map[string]int),
+	}
+}
+
+// addLayer adds the features of a layer as a named GeometryCollection object. Features whose
+// geometries collapse when quantized are dropped.
+func (b *topologyBuilder) addLayer(name string, fc *geojson.FeatureCollection) {
+	geometries := []*TopologyGeometry{}
+	for _, feature := range fc.Features {
+		geometry := b.geometry(feature.Geometry)
+		if geometry == nil {
+			continue
+		}
+		geometry.ID = feature.ID
+		if len(feature.Properties) > 0 {
+			geometry.Properties = feature.Properties
+		}
+		geometries = append(geometries, geometry)
+	}
+	b.topology.Objects[name] = &TopologyGeometry{Type: "GeometryCollection", Geometries: geometries}
+}
+
+// build cuts the lines of all of the layers into shared arcs, and returns the Topology
+func (b *topologyBuilder) build() *Topology {
+	junctions := b.junctions()
+	for _, line := range b.lines {
+		b.cut(line, junctions)
+	}
+	for _, assign := range b.pending {
+		assign()
+	}
+	return b.topology
+}
+
+// quantize converts a coordinate into a quantized position
+func (b *topologyBuilder) quantize(p orb.Point) topoPoint {
+	transform := b.topology.Transform
+	return topoPoint{
+		int(math.Round((p[0] - transform.Translate[0]) / transform.Scale[0])),
+		int(math.Round((p[1] - transform.Translate[1]) / transform.Scale[1])),
+	}
+}
+
+// line quantizes a line or ring, returning nil if it collapses
+func (b *topologyBuilder) line(points []orb.Point, ring bool) *topoLine {
+	var quantized []topoPoint
+	for _, p := range points {
+		q := b.quantize(p)
+		if len(quantized) == 0 || quantized[len(quantized)-1] != q {
+			quantized = append(quantized, q)
+		}
+	}
+	if ring && len(quantized) > 1 && quantized[0] == quantized[len(quantized)-1] {
+		quantized = quantized[:len(quantized)-1]
+	}
+	if (ring && len(quantized) < 3) || len(quantized) < 2 {
+		return nil
+	}
+	line := &topoLine{points: quantized, ring: ring}
+	b.lines = append(b.lines, line)
+	return line
+}
+
+// polygon quantizes the rings of a polygon, returning nil if its exterior ring collapses
+func (b *topologyBuilder) polygon(polygon orb.Polygon) []*topoLine {
+	var rings []*topoLine
+	for i, ring := range polygon {
+		line := b.line(ring, true)
+		if line == nil {
+			if i == 0 {
+				return nil
+			}
+			continue
+		}
+		rings = append(rings, line)
+	}
+	return rings
+}
+
+// geometry converts a geometry into a TopologyGeometry, returning nil if it collapses
+func (b *topologyBuilder) geometry(g orb.Geometry) *TopologyGeometry {
+	switch g := g.(type) {
+	case orb.Point:
+		return &TopologyGeometry{Type: "Point", Coordinates: b.quantize(g)}
+	case orb.MultiPoint:
+		if len(g) == 0 {
+			return nil
+		}
+		coordinates := make([]topoPoint, len(g))
+		for i, p := range g {
+			coordinates[i] = b.quantize(p)
+		}
+		return &TopologyGeometry{Type: "MultiPoint", Coordinates: coordinates}
+	case orb.LineString:
+		line := b.line(g, false)
+		if line == nil {
+			return nil
+		}
+		geometry := &TopologyGeometry{Type: "LineString"}
+		b.pending = append(b.pending, func() { geometry.Arcs = line.arcs })
+		return geometry
+	case orb.MultiLineString:
+		var lines []*topoLine
+		for _, ls := range g {
+			if line := b.line(ls, false); line != nil {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		geometry := &TopologyGeometry{Type: "MultiLineString"}
+		b.pending = append(b.pending, func() { geometry.Arcs = lineArcs(lines) })
+		return geometry
+	case orb.Ring:
+		return b.geometry(orb.Polygon{g})
+	case orb.Bound:
+		return b.geometry(g.ToPolygon())
+	case orb.Polygon:
+		rings := b.polygon(g)
+		if rings == nil {
+			return nil
+		}
+		geometry := &TopologyGeometry{Type: "Polygon"}
+		b.pending = append(b.pending, func() { geometry.Arcs = lineArcs(rings) })
+		return geometry
+	case orb.MultiPolygon:
+		var polygons [][]*topoLine
+		for _, polygon := range g {
+			if rings := b.polygon(polygon); rings != nil {
+				polygons = append(polygons, rings)
+			}
+		}
+		if len(polygons) == 0 {
+			return nil
+		}
+		geometry := &TopologyGeometry{Type: "MultiPolygon"}
+		b.pending = append(b.pending, func() {
+			arcs := make([][][]int, len(polygons))
+			for i, rings := range polygons {
+				arcs[i] = lineArcs(rings)
+			}
+			geometry.Arcs = arcs
+		})
+		return geometry
+	case orb.Collection:
+		geometries := []*TopologyGeometry{}
+		for _, child := range g {
+			if geometry := b.geometry(child); geometry != nil {
+				geometries = append(geometries, geometry)
+			}
+		}
+		if len(geometries) == 0 {
+			return nil
+		}
+		return &TopologyGeometry{Type: "GeometryCollection", Geometries: geometries}
+	}
+	return nil
+}
+
+// lineArcs returns the arc indices of each of the lines
+func lineArcs(lines []*topoLine) [][]int {
+	arcs := make([][]int, len(lines))
+	for i, line := range lines {
+		arcs[i] = line.arcs
+	}
+	return arcs
+}
+
+// junctions finds the positions at which lines must be cut so that shared sequences of
+// positions end up in shared arcs: the endpoints of lines, and the positions that don't have the
+// same neighbors everywhere they occur
+func (b *topologyBuilder) junctions() map[topoPoint]bool {
+	junctions := make(map[topoPoint]bool)
+	neighbors := make(map[topoPoint][2]topoPoint)
+	for _, line := range b.lines {
+		n := len(line.points)
+		if !line.ring {
+			junctions[line.points[0]] = true
+			junctions[line.points[n-1]] = true
+		}
+		for i, p := range line.points {
+			var prev, next topoPoint
+			if line.ring {
+				prev, next = line.points[(i+n-1)%n], line.points[(i+1)%n]
+			} else if i > 0 && i < n-1 {
+				prev, next = line.points[i-1], line.points[i+1]
+			} else {
+				continue
+			}
+			seen, exists := neighbors[p]
+			if !exists {
+				neighbors[p] = [2]topoPoint{prev, next}
+			} else if seen != [2]topoPoint{prev, next} && seen != [2]topoPoint{next, prev} {
+				junctions[p] = true
+			}
+		}
+	}
+	return junctions
+}
+
+// cut splits the line into arcs at the junctions
+func (b *topologyBuilder) cut(line *topoLine, junctions map[topoPoint]bool) {
+	points := line.points
+	if line.ring {
+		start := -1
+		for i, p := range points {
+			if junctions[p] {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			// Without any junctions, the ring is a single arc that is rotated to a canonical
+			// starting position, so that identical rings share it
+			start = minPointIndex(points)
+		}
+		rotated := make([]topoPoint, 0, len(points)+1)
+		rotated = append(rotated, points[start:]...)
+		rotated = append(rotated, points[:start]...)
+		points = append(rotated, rotated[0])
+	}
+	from := 0
+	for i := 1; i < len(points); i++ {
+		if junctions[points[i]] || i == len(points)-1 {
+			line.arcs = append(line.arcs, b.arc(points[from:i+1]))
+			from = i
+		}
+	}
+}
+
+// arc returns the index of the arc with the given positions, reusing an existing arc (or its
+// reverse) if possible
+func (b *topologyBuilder) arc(points []topoPoint) int {
+	if i, exists := b.arcIndex[pointsKey(points, false)]; exists {
+		return i
+	}
+	if i, exists := b.arcIndex[pointsKey(points, true)]; exists {
+		return ^i
+	}
+	i := len(b.topology.Arcs)
+	b.arcIndex[pointsKey(points, false)] = i
+	// Arc positions are delta-encoded
+	arc := make([][2]int, len(points))
+	for j, p := range points {
+		if j == 0 {
+			arc[j] = p
+		} else {
+			arc[j] = [2]int{p[0] - points[j-1][0], p[1] - points[j-1][1]}
+		}
+	}
+	b.topology.Arcs = append(b.topology.Arcs, arc)
+	return i
+}
+
+// pointsKey builds the arcIndex key of the (optionally reversed) positions
+func pointsKey(points []topoPoint, reverse bool) string {
+	var sb strings.Builder
+	for i := range points {
+		p := points[i]
+		if reverse {
+			p = points[len(points)-1-i]
+		}
+		sb.WriteString(strconv.Itoa(p[0]))
+		sb.WriteByte(',')
+		sb.WriteString(strconv.Itoa(p[1]))
+		sb.WriteByte(';')
+	}
+	return sb.String()
+}
+
+// minPointIndex returns the index of the lexicographically smallest position
+func minPointIndex(points []topoPoint) int {
+	var min int
+	for i, p := range points {
+		if p[0] < points[min][0] || (p[0] == points[min][0] && p[1] < points[min][1]) {
+			min = i
+		}
+	}
+	return min
+}
@@ -0,0 +1,86 @@
+package tilenol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopologySharedArcs(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(orb.Polygon{{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}}))
+	fc.Append(geojson.NewFeature(orb.Polygon{{{10, 0}, {20, 0}, {20, 10}, {10, 10}, {10, 0}}}))
+
+	builder := newTopologyBuilder(maptile.New(0, 0, 0).Bound(), TopoJSONQuantization)
+	builder.addLayer("areas", fc)
+	topology := builder.build()
+
+	// The shared edge is only encoded once, and is referenced in reverse by the second polygon
+	assert.Len(t, topology.Arcs, 3)
+	geometries := topology.Objects["areas"].Geometries.([]*TopologyGeometry)
+	assert.Len(t, geometries, 2)
+	assert.Equal(t, [][]int{{0, 1}}, geometries[0].Arcs)
+	assert.Equal(t, [][]int{{2, ^0}}, geometries[1].Arcs)
+	// Arcs are delta-encoded
+	start := builder.quantize(orb.Point{10, 0})
+	assert.Equal(t, [2]int(start), topology.Arcs[0][0])
+	assert.Equal(t, [2]int{0, builder.quantize(orb.Point{10, 10})[1] - start[1]}, topology.Arcs[0][1])
+}
+
+func TestTopologyIdenticalRings(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	fc.Append(geojson.NewFeature(orb.Polygon{
+		{{0, 0}, {30, 0}, {30, 30}, {0, 30}, {0, 0}},
+		{{10, 10}, {10, 20}, {20, 20}, {20, 10}, {10, 10}},
+	}))
+	fc.Append(geojson.NewFeature(orb.Polygon{{{10, 10}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}}))
+
+	builder := newTopologyBuilder(maptile.New(0, 0, 0).Bound(), TopoJSONQuantization)
+	builder.addLayer("areas", fc)
+	topology := builder.build()
+
+	// The island fills the hole, so they share a single arc
+	assert.Len(t, topology.Arcs, 2)
+	geometries := topology.Objects["areas"].Geometries.([]*TopologyGeometry)
+	assert.Equal(t, [][]int{{0}, {1}}, geometries[0].Arcs)
+	assert.Equal(t, [][]int{{^1}}, geometries[1].Arcs)
+}
+
+func TestTopologyGeometries(t *testing.T) {
+	point := geojson.NewFeature(orb.Point{1, 1})
+	point.ID = "point"
+	point.Properties["name"] = "Point"
+	fc := geojson.NewFeatureCollection()
+	fc.Append(point)
+	fc.Append(geojson.NewFeature(orb.LineString{{0, 0}, {10, 10}}))
+	// Collapses once quantized
+	fc.Append(geojson.NewFeature(orb.LineString{{1, 1}, {1.0001, 1.0001}}))
+
+	builder := newTopologyBuilder(maptile.New(0, 0, 0).Bound(), TopoJSONQuantization)
+	builder.addLayer("features", fc)
+	builder.addLayer("empty", geojson.NewFeatureCollection())
+	data, err := json.Marshal(builder.build())
+	assert.Nil(t, err)
+
+	var topology struct {
+		Type    string
+		Objects map[string]struct {
+			Type       string
+			Geometries []map[string]interface{}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(data, &topology))
+	assert.Equal(t, "Topology", topology.Type)
+	features := topology.Objects["features"]
+	assert.Equal(t, "GeometryCollection", features.Type)
+	assert.Len(t, features.Geometries, 2)
+	assert.Equal(t, "Point", features.Geometries[0]["type"])
+	assert.Equal(t, "point", features.Geometries[0]["id"])
+	assert.Equal(t, map[string]interface{}{"name": "Point"}, features.Geometries[0]["properties"])
+	assert.Equal(t, []interface{}{0.0}, features.Geometries[1]["arcs"])
+	assert.Contains(t, string(data), `"empty":{"type":"GeometryCollection","geometries":[]}`)
+}